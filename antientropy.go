@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"mymodule/consensus"
+)
+
+// defaultAntiEntropyInterval is how often a node compares its log with the
+// leader when ANTI_ENTROPY_INTERVAL is not set.
+const defaultAntiEntropyInterval = 10 * time.Second
+
+// antiEntropyMetrics records the outcome of anti-entropy rounds for /metrics.
+type antiEntropyMetrics struct {
+	mu        sync.Mutex
+	rounds    int64
+	failures  int64
+	pulled    int64
+	dropped   int64
+	lastDrift consensus.Drift
+	lastRound time.Time
+}
+
+var antiEntropyStats antiEntropyMetrics
+
+func (m *antiEntropyMetrics) record(drift consensus.Drift, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if err != nil {
+		m.failures++
+		return
+	}
+	m.rounds++
+	m.pulled += int64(drift.Pulled)
+	m.dropped += int64(drift.Dropped)
+	m.lastDrift = drift
+	m.lastRound = time.Now()
+}
+
+// antiEntropyInterval reads ANTI_ENTROPY_INTERVAL. Zero disables the loop.
+func antiEntropyInterval() time.Duration {
+	if value := os.Getenv("ANTI_ENTROPY_INTERVAL"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			return d
+		}
+		log.Printf("Invalid ANTI_ENTROPY_INTERVAL %q, using %v", value, defaultAntiEntropyInterval)
+	}
+	return defaultAntiEntropyInterval
+}
+
+// runAntiEntropy periodically pulls entries this node missed, so a replica
+// converges even when no further writes arrive to expose the gap.
+func runAntiEntropy(ctx context.Context, node *Node) {
+	interval := antiEntropyInterval()
+	if interval == 0 {
+		log.Printf("Node %d: Anti-entropy disabled", node.ID)
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		if node.core.IsLeader() || draining.Load() {
+			continue
+		}
+
+		drift, err := node.core.AntiEntropy()
+		if errors.Is(err, consensus.ErrNoPeers) {
+			continue
+		}
+		antiEntropyStats.record(drift, err)
+
+		switch {
+		case err != nil:
+			log.Printf("Node %d: Anti-entropy round failed: %v", node.ID, err)
+		case drift.Diverged && drift.Dropped > 0:
+			log.Printf("Node %d: Log diverged from node %d, replaced %d entries with %d from its newer term", node.ID, drift.Peer, drift.Dropped, drift.Pulled)
+			refreshClusterConfig(node)
+		case drift.Diverged:
+			log.Printf("Node %d: Log diverged from node %d within the first %d entries", node.ID, drift.Peer, drift.LocalID)
+		case drift.Pulled > 0:
+			log.Printf("Node %d: Anti-entropy pulled %d entries from node %d", node.ID, drift.Pulled, drift.Peer)
+			refreshClusterConfig(node)
+		}
+	}
+}
+
+// handleLogSummary serves this node's log summary to peers running anti-entropy.
+func handleLogSummary(node *Node) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		upTo, err := strconv.Atoi(r.URL.Query().Get("up_to"))
+		if err != nil {
+			http.Error(w, "Invalid up_to parameter", http.StatusBadRequest)
+			return
+		}
+
+		summary, err := node.core.LogSummary(upTo)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error summarizing log: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(summary)
+	}
+}
+
+// requestLogSummary fetches a peer's log summary up to upTo.
+func requestLogSummary(address string, upTo int) (consensus.LogSummary, error) {
+	var summary consensus.LogSummary
+
+	resp, err := newHTTPClient(httpTimeout).Get(fmt.Sprintf("%s://%s/log-summary?up_to=%d", urlScheme(), address, upTo))
+	if err != nil {
+		return summary, fmt.Errorf("error requesting log summary from %s: %v", address, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return summary, fmt.Errorf("error response from %s (%s): %s", address, resp.Status, string(body))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&summary); err != nil {
+		return summary, fmt.Errorf("error decoding log summary from %s: %v", address, err)
+	}
+	return summary, nil
+}
+
+// writeAntiEntropyMetrics writes the anti-entropy metrics in Prometheus text format.
+func writeAntiEntropyMetrics(w io.Writer, nodeID int) {
+	antiEntropyStats.mu.Lock()
+	defer antiEntropyStats.mu.Unlock()
+	m := &antiEntropyStats
+
+	fmt.Fprintf(w, "# HELP node_anti_entropy_rounds_total Anti-entropy rounds run by this node\n")
+	fmt.Fprintf(w, "# TYPE node_anti_entropy_rounds_total counter\n")
+	fmt.Fprintf(w, "node_anti_entropy_rounds_total{node_id=\"%d\",result=\"ok\"} %d\n", nodeID, m.rounds)
+	fmt.Fprintf(w, "node_anti_entropy_rounds_total{node_id=\"%d\",result=\"error\"} %d\n", nodeID, m.failures)
+
+	fmt.Fprintf(w, "# HELP node_anti_entropy_pulled_total Entries applied by anti-entropy\n")
+	fmt.Fprintf(w, "# TYPE node_anti_entropy_pulled_total counter\n")
+	fmt.Fprintf(w, "node_anti_entropy_pulled_total{node_id=\"%d\"} %d\n", nodeID, m.pulled)
+
+	fmt.Fprintf(w, "# HELP node_anti_entropy_dropped_total Diverged entries truncated by anti-entropy\n")
+	fmt.Fprintf(w, "# TYPE node_anti_entropy_dropped_total counter\n")
+	fmt.Fprintf(w, "node_anti_entropy_dropped_total{node_id=\"%d\"} %d\n", nodeID, m.dropped)
+
+	fmt.Fprintf(w, "# HELP node_log_drift_entries Entries this node lacked at the last anti-entropy round\n")
+	fmt.Fprintf(w, "# TYPE node_log_drift_entries gauge\n")
+	fmt.Fprintf(w, "node_log_drift_entries{node_id=\"%d\"} %d\n", nodeID, m.lastDrift.Behind())
+
+	fmt.Fprintf(w, "# HELP node_log_diverged Whether the last round found the log differing from its peer (1) or not (0)\n")
+	fmt.Fprintf(w, "# TYPE node_log_diverged gauge\n")
+	fmt.Fprintf(w, "node_log_diverged{node_id=\"%d\"} %d\n", nodeID, boolToInt(m.lastDrift.Diverged))
+
+	if !m.lastRound.IsZero() {
+		fmt.Fprintf(w, "# HELP node_anti_entropy_last_round_timestamp_seconds When the last anti-entropy round completed\n")
+		fmt.Fprintf(w, "# TYPE node_anti_entropy_last_round_timestamp_seconds gauge\n")
+		fmt.Fprintf(w, "node_anti_entropy_last_round_timestamp_seconds{node_id=\"%d\"} %d\n", nodeID, m.lastRound.Unix())
+	}
+}
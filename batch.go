@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"mymodule/consensus"
+)
+
+// Group commit: writes that reach the leader within batchWindow of the first
+// one are logged and applied in one database transaction and multicast as a
+// single ordered message. The middleware forwards queued writes every
+// OPERATION_INTERVAL, which must stay below the window for them to share one.
+const (
+	defaultBatchWindow  = 5 * time.Millisecond
+	defaultMaxBatchSize = 100
+)
+
+// pendingWrite is a write waiting for its batch to commit.
+type pendingWrite struct {
+	queryType QueryType
+	op        Operation
+	create    bool                     // Refuse the write if the user already exists
+	wantAcks  bool                     // Wait for the multicast and report which nodes applied the write
+	enough    func(acks []string) bool // With wantAcks, answer once it holds; nil waits for the whole multicast
+	enqueued  time.Time
+	done      chan writeResult
+}
+
+// writeResult is the outcome of one write in a batch.
+type writeResult struct {
+	position     int   // Log position assigned to the write
+	rowsAffected int64 // Rows changed on the leader
+	acks         []string
+	multicastErr error
+	err          error // The write was rejected and not logged
+}
+
+// writeBatcher coalesces concurrent writes into batches.
+type writeBatcher struct {
+	core    *consensus.Node // Supplies the term positions are assigned in
+	window  time.Duration
+	maxSize int
+	queue   chan *pendingWrite
+}
+
+var batcher *writeBatcher
+
+// startWriteBatcher creates the node's batcher and starts committing writes.
+// BATCH_WINDOW (a duration; "0" commits only what is already queued) and
+// BATCH_MAX_SIZE override the defaults.
+func startWriteBatcher(core *consensus.Node) {
+	window := defaultBatchWindow
+	if value := os.Getenv("BATCH_WINDOW"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d >= 0 {
+			window = d
+		} else {
+			log.Printf("Invalid BATCH_WINDOW %q, using %v", value, window)
+		}
+	}
+	maxSize := defaultMaxBatchSize
+	if value := os.Getenv("BATCH_MAX_SIZE"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			maxSize = n
+		} else {
+			log.Printf("Invalid BATCH_MAX_SIZE %q, using %d", value, maxSize)
+		}
+	}
+
+	batcher = &writeBatcher{
+		core:    core,
+		window:  window,
+		maxSize: maxSize,
+		queue:   make(chan *pendingWrite, maxSize),
+	}
+	go batcher.run()
+}
+
+// submitWrite queues a write for the next batch and waits for its result.
+// Writes that want acks return once enough holds for the acks collected so
+// far, or once the multicast has finished if enough is nil or never holds.
+// All others return as soon as the batch has committed on the leader.
+func submitWrite(queryType QueryType, op Operation, create bool, wantAcks bool, enough func(acks []string) bool) writeResult {
+	// Counted as in flight from the moment it is queued, so shutdown waits for it
+	inflightMulticasts.Add(1)
+	defer inflightMulticasts.Add(-1)
+
+	write := &pendingWrite{
+		queryType: queryType,
+		op:        op,
+		create:    create,
+		wantAcks:  wantAcks,
+		enough:    enough,
+		enqueued:  time.Now(),
+		done:      make(chan writeResult, 1),
+	}
+	batcher.queue <- write
+	return <-write.done
+}
+
+// run collects writes until the window after the first one closes or the
+// batch is full, then commits them.
+func (b *writeBatcher) run() {
+	for {
+		batch := []*pendingWrite{<-b.queue}
+
+		timer := time.NewTimer(b.window)
+	collect:
+		for len(batch) < b.maxSize {
+			select {
+			case write := <-b.queue:
+				batch = append(batch, write)
+			case <-timer.C:
+				break collect
+			}
+		}
+		timer.Stop()
+
+		b.commit(batch)
+	}
+}
+
+// commit logs and applies a batch in one transaction, answers the writes that
+// don't wait for acks and multicasts the committed entries in the background.
+// Writes waiting for acks are answered as soon as theirs are in, while the
+// multicast carries on.
+func (b *writeBatcher) commit(batch []*pendingWrite) {
+	start := time.Now()
+	results, entries, err := commitBatch(b.core, batch)
+	if err != nil {
+		log.Printf("Error committing batch of %d writes: %v", len(batch), err)
+		for _, write := range batch {
+			write.done <- writeResult{err: err}
+		}
+		batchStats.recordFailure(len(batch))
+		return
+	}
+	batchStats.record(batch, results, time.Since(start))
+	if len(entries) > 0 {
+		deliveries.record(deliveryReport{Node: os.Getenv("NODE_ID"), From: entries[0].ID, To: entries[len(entries)-1].ID, Status: DeliveryApplied, At: time.Now()})
+	}
+
+	var collector *ackCollector
+	for i, write := range batch {
+		if !write.wantAcks || results[i].err != nil {
+			write.done <- results[i]
+			continue
+		}
+		if collector == nil {
+			collector = collectAcks(entries[len(entries)-1].ID)
+		}
+		go func(write *pendingWrite, result writeResult) {
+			result.acks, result.multicastErr = collector.wait(write.enough)
+			write.done <- result
+		}(write, results[i])
+	}
+
+	if len(entries) == 0 {
+		return
+	}
+
+	inflightMulticasts.Add(1)
+	go func() {
+		defer inflightMulticasts.Add(-1)
+		acks, err := replicate(entries, os.Getenv("NODE_ID"), collector)
+		if err != nil {
+			fmt.Printf("Error during batch multicast: %v\n", err)
+		}
+		if collector != nil {
+			collector.add(acks)
+			collector.finish(err)
+		}
+	}()
+}
+
+// commitBatch logs and executes the writes within a single transaction. Each
+// write runs under a savepoint, so one failing write is rolled back on its own
+// and the others still commit. Positions are assigned explicitly so the log
+// stays gapless even when a write is rolled back, and every entry is stamped
+// with the term the leader holds at commit time.
+func commitBatch(core *consensus.Node, batch []*pendingWrite) ([]writeResult, []consensus.Entry, error) {
+	// A node that has lost leadership must not assign positions
+	term, leader := core.Leadership()
+	if !leader {
+		return nil, nil, consensus.ErrNotLeader
+	}
+
+	tx, err := store.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin batch transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Hold the log while reading its end and appending after it
+	last, err := tx.LastLogID()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	results := make([]writeResult, len(batch))
+	var entries []consensus.Entry
+	for i, write := range batch {
+		if err := tx.Savepoint(); err != nil {
+			return nil, nil, fmt.Errorf("failed to create savepoint: %v", err)
+		}
+
+		position := last + 1
+		data, rowsAffected, err := applyWrite(tx, position, term, write)
+		if err != nil {
+			log.Printf("Error executing %s query in batch: %v", write.queryType, err)
+			if rbErr := tx.RollbackToSavepoint(); rbErr != nil {
+				return nil, nil, fmt.Errorf("failed to roll back write: %v", rbErr)
+			}
+			results[i].err = err
+			continue
+		}
+		if err := tx.ReleaseSavepoint(); err != nil {
+			return nil, nil, fmt.Errorf("failed to release savepoint: %v", err)
+		}
+
+		last = position
+		results[i].position = position
+		results[i].rowsAffected = rowsAffected
+		entries = append(entries, consensus.Entry{
+			ID:        position,
+			Term:      term,
+			Type:      string(write.queryType),
+			Table:     write.op.table(),
+			Operation: data,
+		})
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit batch: %v", err)
+	}
+	// A configuration takes effect on the leader once logged, before replicas have it
+	for _, entry := range entries {
+		if entry.Table == configTable {
+			configAppended()
+			break
+		}
+	}
+	return results, entries, nil
+}
+
+// applyWrite logs one write at position and applies it. It returns the
+// operation's encoding as logged.
+func applyWrite(tx StoreTx, position, term int, write *pendingWrite) (json.RawMessage, int64, error) {
+	data, err := encodeOperation(write.op)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if write.create {
+		exists, err := tx.UserExists(write.op.UpsertUser.Email)
+		if err != nil {
+			return nil, 0, fmt.Errorf("error checking for existing user: %v", err)
+		}
+		if exists {
+			return nil, 0, fmt.Errorf("user %s already exists", write.op.UpsertUser.Email)
+		}
+	}
+
+	err = tx.AppendLog(LogRecord{ID: position, Term: term, Type: string(write.queryType), Table: write.op.table(), Query: write.op.String(), Operation: string(data)})
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to log transaction: %v", err)
+	}
+
+	rowsAffected, err := applyOperation(tx, write.op, position)
+	if err != nil {
+		return nil, 0, err
+	}
+	return data, rowsAffected, nil
+}
+
+// batchCounters are the group commit totals reported by /metrics.
+type batchCounters struct {
+	batches        int64
+	failedBatches  int64
+	writes         int64 // Committed writes
+	rejectedWrites int64 // Writes rolled back or lost with a failed batch
+	commitSeconds  float64
+	latencySeconds float64 // Queue wait plus commit, summed over committed writes
+	maxBatchSize   int
+}
+
+// batchMetrics tracks group commit throughput and latency.
+type batchMetrics struct {
+	mu sync.Mutex
+	batchCounters
+}
+
+var batchStats batchMetrics
+
+func (m *batchMetrics) record(batch []*pendingWrite, results []writeResult, commitTime time.Duration) {
+	now := time.Now()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.batches++
+	m.commitSeconds += commitTime.Seconds()
+	if len(batch) > m.maxBatchSize {
+		m.maxBatchSize = len(batch)
+	}
+	for i, write := range batch {
+		if results[i].err != nil {
+			m.rejectedWrites++
+			continue
+		}
+		m.writes++
+		m.latencySeconds += now.Sub(write.enqueued).Seconds()
+	}
+}
+
+func (m *batchMetrics) recordFailure(size int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.failedBatches++
+	m.rejectedWrites += int64(size)
+}
+
+// writeBatchMetrics writes the group commit metrics in Prometheus text format.
+// Throughput is rate(node_batch_writes_total) and the average batch size is
+// node_batch_writes_total / node_batches_total.
+func writeBatchMetrics(w io.Writer, nodeID int) {
+	b := batcher
+
+	batchStats.mu.Lock()
+	m := batchStats.batchCounters
+	batchStats.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP node_batch_window_seconds Group commit coalescing window\n")
+	fmt.Fprintf(w, "# TYPE node_batch_window_seconds gauge\n")
+	fmt.Fprintf(w, "node_batch_window_seconds{node_id=\"%d\"} %g\n", nodeID, b.window.Seconds())
+
+	fmt.Fprintf(w, "# HELP node_batches_total Batches committed on this node\n")
+	fmt.Fprintf(w, "# TYPE node_batches_total counter\n")
+	fmt.Fprintf(w, "node_batches_total{node_id=\"%d\",result=\"committed\"} %d\n", nodeID, m.batches)
+	fmt.Fprintf(w, "node_batches_total{node_id=\"%d\",result=\"failed\"} %d\n", nodeID, m.failedBatches)
+
+	fmt.Fprintf(w, "# HELP node_batch_writes_total Writes processed through group commit\n")
+	fmt.Fprintf(w, "# TYPE node_batch_writes_total counter\n")
+	fmt.Fprintf(w, "node_batch_writes_total{node_id=\"%d\",result=\"committed\"} %d\n", nodeID, m.writes)
+	fmt.Fprintf(w, "node_batch_writes_total{node_id=\"%d\",result=\"rejected\"} %d\n", nodeID, m.rejectedWrites)
+
+	fmt.Fprintf(w, "# HELP node_batch_size_max Largest batch committed\n")
+	fmt.Fprintf(w, "# TYPE node_batch_size_max gauge\n")
+	fmt.Fprintf(w, "node_batch_size_max{node_id=\"%d\"} %d\n", nodeID, m.maxBatchSize)
+
+	fmt.Fprintf(w, "# HELP node_batch_commit_seconds Time spent committing batches\n")
+	fmt.Fprintf(w, "# TYPE node_batch_commit_seconds summary\n")
+	fmt.Fprintf(w, "node_batch_commit_seconds_sum{node_id=\"%d\"} %g\n", nodeID, m.commitSeconds)
+	fmt.Fprintf(w, "node_batch_commit_seconds_count{node_id=\"%d\"} %d\n", nodeID, m.batches)
+
+	fmt.Fprintf(w, "# HELP node_write_latency_seconds Time from a write being queued to its batch committing\n")
+	fmt.Fprintf(w, "# TYPE node_write_latency_seconds summary\n")
+	fmt.Fprintf(w, "node_write_latency_seconds_sum{node_id=\"%d\"} %g\n", nodeID, m.latencySeconds)
+	fmt.Fprintf(w, "node_write_latency_seconds_count{node_id=\"%d\"} %d\n", nodeID, m.writes)
+}
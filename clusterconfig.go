@@ -0,0 +1,351 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// configTable holds the replicated voter configuration entries.
+const configTable = "cluster_config"
+
+// ClusterConfig is a voter configuration.
+// Configurations are written as ordinary log entries, so every replica
+// applies them at the same log position as the leader. As in Raft, a node
+// switches to a configuration as soon as the entry is appended to its log,
+// committed or not, and back to the previous one if the entry is truncated.
+// A leader starts a new change only once the log shows that the latest entry
+// is held by a majority of both the configuration it replaced and its own,
+// so a newly elected leader is bound by its predecessor's change too.
+type ClusterConfig struct {
+	ID     int   `json:"id"`
+	Voters []int `json:"voters"`
+}
+
+// ConfigChangeRequest is the body of a POST to /admin/voters.
+type ConfigChangeRequest struct {
+	Action string `json:"action"` // "add" or "remove"
+	NodeID int    `json:"node_id"`
+}
+
+var (
+	// configChangeMutex serializes the changes requested from this leader
+	configChangeMutex  sync.Mutex
+	errNoClusterConfig = errors.New("no cluster configuration committed")
+
+	// configNode is the local node, whose voters follow the log's configuration entries
+	configNode *Node
+)
+
+// Contains reports whether id is a voter in this configuration.
+func (c *ClusterConfig) Contains(id int) bool {
+	for _, voter := range c.Voters {
+		if voter == id {
+			return true
+		}
+	}
+	return false
+}
+
+// QuorumSize returns the number of votes needed for a majority of the configuration.
+func (c *ClusterConfig) QuorumSize() int {
+	return len(c.Voters)/2 + 1
+}
+
+// formatVoters encodes a voter set as a sorted, comma separated list.
+func formatVoters(voters []int) string {
+	sorted := append([]int(nil), voters...)
+	sort.Ints(sorted)
+	parts := make([]string, len(sorted))
+	for i, id := range sorted {
+		parts[i] = strconv.Itoa(id)
+	}
+	return strings.Join(parts, ",")
+}
+
+// parseVoters decodes a voter list written by formatVoters.
+func parseVoters(value string) ([]int, error) {
+	voters := []int{}
+	if value == "" {
+		return voters, nil
+	}
+	for _, part := range strings.Split(value, ",") {
+		id, err := strconv.Atoi(strings.TrimSpace(part))
+		if err != nil {
+			return nil, fmt.Errorf("invalid voter id %q: %v", part, err)
+		}
+		voters = append(voters, id)
+	}
+	return voters, nil
+}
+
+// loadClusterConfig returns the latest configuration applied to the local store.
+func loadClusterConfig() (*ClusterConfig, error) {
+	return store.LatestConfig()
+}
+
+// appendConfigEntry logs, applies and replicates a new voter configuration.
+// It returns only after the multicast has reached the tree.
+func appendConfigEntry(voters []int) error {
+	op := Operation{Kind: OpSetVoters, SetVoters: &SetVoters{Voters: voters}}
+
+	result := submitWrite(QueryTypeInsert, op, false, true, nil)
+	if result.err != nil {
+		return fmt.Errorf("failed to apply configuration entry: %v", result.err)
+	}
+	if result.multicastErr != nil {
+		return fmt.Errorf("failed to replicate configuration entry: %v", result.multicastErr)
+	}
+	return nil
+}
+
+// bootstrapClusterConfig writes the initial configuration from the live voting
+// members the first time a leader is elected in a cluster without one.
+func bootstrapClusterConfig(node *Node) {
+	if !configChangeMutex.TryLock() {
+		return
+	}
+	defer configChangeMutex.Unlock()
+
+	if _, err := loadClusterConfig(); !errors.Is(err, errNoClusterConfig) {
+		return
+	}
+
+	voters := node.core.ActiveVoters()
+
+	log.Printf("Node %d: Bootstrapping cluster configuration with voters %v", node.ID, voters)
+	if err := appendConfigEntry(voters); err != nil {
+		log.Printf("Node %d: Failed to bootstrap cluster configuration: %v", node.ID, err)
+	}
+}
+
+// configAppended switches the local node to the configuration entries just
+// appended to, or truncated from, its log.
+func configAppended() {
+	if configNode != nil {
+		refreshClusterConfig(configNode)
+	}
+}
+
+// configEntry is a configuration entry in the log.
+type configEntry struct {
+	position int
+	voters   []int
+	previous []int // Configuration it replaced, nil for the first one
+}
+
+// latestConfigEntry returns the last configuration entry in the log, or nil
+// if there is none.
+func latestConfigEntry() (*configEntry, error) {
+	entries, err := nodeStorage{}.EntriesAfter(0)
+	if err != nil {
+		return nil, fmt.Errorf("error reading log: %v", err)
+	}
+	var latest *configEntry
+	for _, entry := range entries {
+		if entry.Table != configTable {
+			continue
+		}
+		op, err := decodeOperation(entry.Operation)
+		if err != nil || op.Kind != OpSetVoters {
+			continue
+		}
+		next := &configEntry{position: entry.ID, voters: op.SetVoters.Voters}
+		if latest != nil {
+			next.previous = latest.voters
+		}
+		latest = next
+	}
+	return latest, nil
+}
+
+// configCommitted reports whether a majority of both entry's configuration
+// and the one it replaced hold the same log as this leader up to the entry.
+// Until then, a further change could produce a majority that does not
+// overlap one of the configuration the entry is still replacing.
+func configCommitted(node *Node, entry *configEntry) (bool, error) {
+	local, err := node.core.LogSummary(entry.position)
+	if err != nil {
+		return false, err
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	holds := map[int]bool{node.ID: true}
+	for _, id := range append(append([]int(nil), entry.voters...), entry.previous...) {
+		mu.Lock()
+		_, asked := holds[id]
+		holds[id] = false
+		mu.Unlock()
+		if asked {
+			continue
+		}
+		wg.Add(1)
+		go func(id int) {
+			defer wg.Done()
+			summary, err := requestLogSummary(fmt.Sprintf("node-%d:%d", id, httpPort), entry.position)
+			if err != nil {
+				log.Printf("Node %d: Cannot confirm node %d holds configuration entry %d: %v", node.ID, id, entry.position, err)
+				return
+			}
+			mu.Lock()
+			holds[id] = summary.UpTo == entry.position && summary.Digest == local.Digest
+			mu.Unlock()
+		}(id)
+	}
+	wg.Wait()
+
+	majority := func(voters []int) bool {
+		count := 0
+		for _, id := range voters {
+			if holds[id] {
+				count++
+			}
+		}
+		return count >= len(voters)/2+1
+	}
+	return majority(entry.voters) && (entry.previous == nil || majority(entry.previous)), nil
+}
+
+// refreshClusterConfig reloads the latest configuration into the node.
+func refreshClusterConfig(node *Node) {
+	config, err := loadClusterConfig()
+	if err != nil && !errors.Is(err, errNoClusterConfig) {
+		log.Printf("Node %d: %v", node.ID, err)
+		return
+	}
+
+	node.mutex.Lock()
+	node.config = config
+	node.mutex.Unlock()
+
+	if config != nil {
+		node.core.SetVoters(config.Voters)
+	} else {
+		node.core.SetVoters(nil)
+	}
+}
+
+// handleVoters serves GET and POST /admin/voters.
+// GET returns the committed configuration; POST adds or removes a single voter.
+func handleVoters(node *Node) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			config, err := loadClusterConfig()
+			if err != nil && !errors.Is(err, errNoClusterConfig) {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(map[string]interface{}{
+				"config": config,
+			})
+		case http.MethodPost:
+			handleConfigChange(node, w, r)
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func handleConfigChange(node *Node, w http.ResponseWriter, r *http.Request) {
+	if !node.core.IsLeader() {
+		http.Error(w, "Only leader can change the cluster configuration", http.StatusForbidden)
+		return
+	}
+	if draining.Load() {
+		http.Error(w, "Node is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+
+	var req ConfigChangeRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "Bad request", http.StatusBadRequest)
+		return
+	}
+	if req.NodeID <= 0 {
+		http.Error(w, "node_id must be a positive node ID", http.StatusBadRequest)
+		return
+	}
+
+	// Only one single-server change may be in flight at a time, which keeps
+	// every pair of consecutive configurations' majorities overlapping. The
+	// log decides whether the previous one is done, whichever leader made it.
+	if !configChangeMutex.TryLock() {
+		http.Error(w, "Another configuration change is in progress", http.StatusConflict)
+		return
+	}
+	defer configChangeMutex.Unlock()
+
+	latest, err := latestConfigEntry()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if latest == nil {
+		http.Error(w, errNoClusterConfig.Error(), http.StatusConflict)
+		return
+	}
+	committed, err := configCommitted(node, latest)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !committed {
+		http.Error(w, fmt.Sprintf("The previous configuration change (entry %d) is not committed yet", latest.position), http.StatusConflict)
+		return
+	}
+	config := &ClusterConfig{Voters: latest.voters}
+
+	voters := append([]int(nil), config.Voters...)
+	switch req.Action {
+	case "add":
+		if config.Contains(req.NodeID) {
+			http.Error(w, fmt.Sprintf("Node %d is already a voter", req.NodeID), http.StatusConflict)
+			return
+		}
+		voters = append(voters, req.NodeID)
+	case "remove":
+		if !config.Contains(req.NodeID) {
+			http.Error(w, fmt.Sprintf("Node %d is not a voter", req.NodeID), http.StatusConflict)
+			return
+		}
+		if len(voters) == 1 {
+			http.Error(w, "Cannot remove the last voter", http.StatusConflict)
+			return
+		}
+		filtered := voters[:0]
+		for _, id := range voters {
+			if id != req.NodeID {
+				filtered = append(filtered, id)
+			}
+		}
+		voters = filtered
+	default:
+		http.Error(w, "Invalid action (use 'add' or 'remove')", http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Node %d: Changing voters from %v to %v", node.ID, config.Voters, voters)
+	if err := appendConfigEntry(voters); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	node.mutex.RLock()
+	current := node.config
+	node.mutex.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status": "success",
+		"config": current,
+	})
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"testing"
+
+	"mymodule/consensus"
+)
+
+// configEntryAt returns a replicated SetVoters entry at position.
+func configEntryAt(t *testing.T, position int, voters ...int) consensus.Entry {
+	t.Helper()
+	op, err := encodeOperation(Operation{Kind: OpSetVoters, SetVoters: &SetVoters{Voters: voters}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return consensus.Entry{ID: position, Term: 1, Type: string(QueryTypeInsert), Table: configTable, Operation: op}
+}
+
+func TestConfigTakesEffectWhenAppended(t *testing.T) {
+	store = migrated(t, newMemoryStore())
+	node := &Node{ID: 1}
+	node.core = consensus.NewNode(consensus.Options{ID: 1, Storage: nodeStorage{}})
+	configNode = node
+	defer func() { configNode = nil }()
+
+	voters := func() []int {
+		node.mutex.RLock()
+		defer node.mutex.RUnlock()
+		if node.config == nil {
+			return nil
+		}
+		return node.config.Voters
+	}
+
+	if err := (nodeStorage{}).Append(configEntryAt(t, 1, 1, 2, 3)); err != nil {
+		t.Fatal(err)
+	}
+	if err := (nodeStorage{}).Append(configEntryAt(t, 2, 1, 2, 3, 4)); err != nil {
+		t.Fatal(err)
+	}
+	// Neither entry is known to be committed, yet the node already uses the latest
+	if got := voters(); !equal(got, []int{1, 2, 3, 4}) {
+		t.Fatalf("voters after appending are %v, want [1 2 3 4]", got)
+	}
+	if got := node.core.Status().Voters; !equal(got, []int{1, 2, 3, 4}) {
+		t.Fatalf("consensus voters are %v, want [1 2 3 4]", got)
+	}
+
+	latest, err := latestConfigEntry()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest.position != 2 || !equal(latest.voters, []int{1, 2, 3, 4}) || !equal(latest.previous, []int{1, 2, 3}) {
+		t.Fatalf("latest configuration entry is %+v", latest)
+	}
+
+	// Truncating the entry returns to the configuration before it
+	if err := (nodeStorage{}).TruncateFrom(2); err != nil {
+		t.Fatal(err)
+	}
+	if got := voters(); !equal(got, []int{1, 2, 3}) {
+		t.Fatalf("voters after truncating are %v, want [1 2 3]", got)
+	}
+	if latest, err := latestConfigEntry(); err != nil || latest.position != 1 || latest.previous != nil {
+		t.Fatalf("latest configuration entry after truncating is %+v, %v", latest, err)
+	}
+}
@@ -0,0 +1,329 @@
+package consensus
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sort"
+	"strconv"
+)
+
+// LogSummary describes a node's log so a peer can tell whether it is behind
+// or has diverged without transferring the entries.
+type LogSummary struct {
+	LastID int    `json:"last_id"`
+	UpTo   int    `json:"up_to"`  // Digest covers the entries with ID <= UpTo
+	Digest string `json:"digest"` // DigestEntries of those entries
+}
+
+// Drift is what one anti-entropy round found.
+type Drift struct {
+	Peer     int  // Node compared with, 0 if the round was skipped
+	LocalID  int  // Last entry before the round
+	PeerID   int  // Peer's last entry
+	Pulled   int  // Entries applied from the peer
+	Diverged bool // The logs differ on their common prefix
+	Dropped  int  // Entries truncated to repair a divergence
+}
+
+// Behind returns how many entries this node lacked at the start of the round.
+func (d Drift) Behind() int {
+	if d.PeerID > d.LocalID {
+		return d.PeerID - d.LocalID
+	}
+	return 0
+}
+
+// digestInterval is how many entries apart LogSummary keeps the digests it
+// resumes from, trading memory for the entries read to digest a prefix.
+const digestInterval = 256
+
+// DigestEntries returns a SHA-256 digest of the entries in order. Every field
+// that is replicated is covered, so equal digests mean equal logs. The digest
+// is chained, each entry hashed with the digest before it, so the digest of a
+// longer log continues from that of its prefix.
+func DigestEntries(entries []Entry) string {
+	digest := ""
+	for _, e := range entries {
+		digest = chainDigest(digest, e)
+	}
+	return digest
+}
+
+// chainDigest returns the digest of a log whose entries before e digest to prev.
+func chainDigest(prev string, e Entry) string {
+	h := sha256.New()
+	h.Write([]byte(prev))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(e.ID)))
+	h.Write([]byte{0})
+	h.Write([]byte(strconv.Itoa(e.Term)))
+	h.Write([]byte{0})
+	h.Write([]byte(e.Type))
+	h.Write([]byte{0})
+	h.Write([]byte(e.Table))
+	h.Write([]byte{0})
+	h.Write(e.Operation)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// LogSummary answers a peer's anti-entropy request, digesting this node's
+// entries up to upTo. It continues from the nearest digest it cached at or
+// before upTo, so a round reads only the entries appended since the last one.
+// Entries change only when the log is truncated, which drops the digests
+// from that position on, so it does not need to wait for concurrent appends.
+func (n *Node) LogSummary(upTo int) (LogSummary, error) {
+	last, err := n.storage.LastEntryID()
+	if err != nil {
+		return LogSummary{}, fmt.Errorf("error reading last entry: %v", err)
+	}
+	if upTo > last {
+		upTo = last
+	}
+
+	from, digest, gen := n.cachedDigest(upTo)
+	if from == upTo {
+		return LogSummary{LastID: last, UpTo: upTo, Digest: digest}, nil
+	}
+	entries, err := n.storage.EntriesAfter(from)
+	if err != nil {
+		return LogSummary{}, fmt.Errorf("error reading entries: %v", err)
+	}
+	checkpoints := make(map[int]string)
+	for _, e := range entries {
+		if e.ID > upTo {
+			break
+		}
+		digest = chainDigest(digest, e)
+		if e.ID%digestInterval == 0 {
+			checkpoints[e.ID] = digest
+		}
+	}
+	n.cacheDigests(gen, upTo, digest, checkpoints)
+	return LogSummary{LastID: last, UpTo: upTo, Digest: digest}, nil
+}
+
+// cachedDigest returns the furthest cached digest at or before upTo, with
+// the entry it covers up to, and the generation it was read in.
+func (n *Node) cachedDigest(upTo int) (from int, digest string, gen int) {
+	n.digestMu.Lock()
+	defer n.digestMu.Unlock()
+
+	if n.digestTip > 0 && n.digestTip <= upTo {
+		return n.digestTip, n.digests[n.digestTip], n.digestGen
+	}
+	for id := upTo - upTo%digestInterval; id > 0; id -= digestInterval {
+		if digest, ok := n.digests[id]; ok {
+			return id, digest, n.digestGen
+		}
+	}
+	return 0, "", n.digestGen
+}
+
+// cacheDigests keeps the digests LogSummary computed in generation gen,
+// unless the log was cut since.
+func (n *Node) cacheDigests(gen, upTo int, digest string, checkpoints map[int]string) {
+	n.digestMu.Lock()
+	defer n.digestMu.Unlock()
+
+	if gen != n.digestGen {
+		return
+	}
+	for id, d := range checkpoints {
+		n.digests[id] = d
+	}
+	if upTo > n.digestTip {
+		if n.digestTip%digestInterval != 0 {
+			delete(n.digests, n.digestTip)
+		}
+		n.digests[upTo] = digest
+		n.digestTip = upTo
+	}
+}
+
+// forgetDigests drops the cached digests of entries from from on, which are
+// about to be replaced.
+func (n *Node) forgetDigests(from int) {
+	n.digestMu.Lock()
+	defer n.digestMu.Unlock()
+
+	for id := range n.digests {
+		if id >= from {
+			delete(n.digests, id)
+		}
+	}
+	if n.digestTip >= from {
+		n.digestTip = 0
+	}
+	n.digestGen++
+}
+
+// ForgetLog drops what the node cached about its log, for when the log was
+// cleared behind its back.
+func (n *Node) ForgetLog() {
+	n.forgetDigests(1)
+}
+
+// AntiEntropy compares this node's log with the leader, or a random active
+// peer when no leader is known, and pulls any entries it is missing. Logs
+// that differ on their common prefix are repaired from the first entry that
+// differs, if the peer's entry there is from a newer term.
+// The leader holds the authoritative log and skips the round.
+func (n *Node) AntiEntropy() (Drift, error) {
+	if n.IsLeader() {
+		return Drift{}, nil
+	}
+	peer := n.antiEntropyPeer()
+	if peer == 0 {
+		return Drift{}, ErrNoPeers
+	}
+
+	last, err := n.storage.LastEntryID()
+	if err != nil {
+		return Drift{}, fmt.Errorf("error reading last entry: %v", err)
+	}
+	drift := Drift{Peer: peer, LocalID: last}
+
+	// The peer is asked without holding applyMu, so two nodes comparing with
+	// each other cannot wait on one another
+	remote, err := n.transport.LogSummary(peer, last)
+	if err != nil {
+		return drift, fmt.Errorf("error fetching log summary from node %d: %v", peer, err)
+	}
+	drift.PeerID = remote.LastID
+
+	local, err := n.LogSummary(remote.UpTo)
+	if err != nil {
+		return drift, err
+	}
+	if local.Digest != remote.Digest {
+		drift.Diverged = true
+		return n.repair(drift, remote.UpTo)
+	}
+	if remote.LastID <= last {
+		return drift, nil
+	}
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	// Multicasts may have filled some of the difference in the meantime
+	last, err = n.storage.LastEntryID()
+	if err != nil {
+		return drift, fmt.Errorf("error reading last entry: %v", err)
+	}
+	if remote.LastID <= last {
+		return drift, nil
+	}
+
+	entries, err := n.transport.FetchEntries(peer, last)
+	if err != nil {
+		return drift, fmt.Errorf("error fetching entries from node %d: %v", peer, err)
+	}
+	var missing []Entry
+	next := last + 1
+	for _, e := range entries {
+		if e.ID != next {
+			break
+		}
+		missing = append(missing, e)
+		next++
+	}
+	if len(missing) == 0 {
+		return drift, nil
+	}
+	if err := n.storage.Append(missing...); err != nil {
+		return drift, err
+	}
+	drift.Pulled = len(missing)
+	return drift, n.drainReorderBuffer()
+}
+
+// repair brings back in line a log that differs from the peer's within the
+// first upTo entries. Logs that agree up to a position agree on every one
+// before it, so the first entry that differs is found by bisecting with log
+// summaries. If the peer's entry there is from a newer term, the log is
+// truncated from that position and the peer's entries are applied instead;
+// otherwise the peer is the one to repair, in its own round.
+func (n *Node) repair(drift Drift, upTo int) (Drift, error) {
+	agree, differ := 0, upTo
+	for differ-agree > 1 {
+		mid := agree + (differ-agree)/2
+		remote, err := n.transport.LogSummary(drift.Peer, mid)
+		if err != nil {
+			return drift, fmt.Errorf("error fetching log summary from node %d: %v", drift.Peer, err)
+		}
+		local, err := n.LogSummary(mid)
+		if err != nil {
+			return drift, err
+		}
+		if local.Digest == remote.Digest {
+			agree = mid
+		} else {
+			differ = mid
+		}
+	}
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	entries, err := n.transport.FetchEntries(drift.Peer, differ-1)
+	if err != nil {
+		return drift, fmt.Errorf("error fetching entries from node %d: %v", drift.Peer, err)
+	}
+	logged, err := n.storage.EntriesAfter(differ - 1)
+	if err != nil {
+		return drift, fmt.Errorf("error reading entries: %v", err)
+	}
+	if len(entries) == 0 || entries[0].ID != differ || len(logged) == 0 || logged[0].ID != differ {
+		// One of the logs changed since the summaries were taken
+		return drift, nil
+	}
+	if logged[0].Term >= entries[0].Term {
+		return drift, nil
+	}
+
+	if err := n.truncate(differ); err != nil {
+		return drift, err
+	}
+	drift.Dropped = len(logged)
+
+	var missing []Entry
+	next := differ
+	for _, e := range entries {
+		if e.ID != next {
+			break
+		}
+		missing = append(missing, e)
+		next++
+	}
+	if err := n.storage.Append(missing...); err != nil {
+		return drift, err
+	}
+	drift.Pulled = len(missing)
+	return drift, n.drainReorderBuffer()
+}
+
+// antiEntropyPeer returns the known leader, or else a random active member.
+func (n *Node) antiEntropyPeer() int {
+	if leader := n.LeaderID(); leader != 0 && leader != n.id {
+		return leader
+	}
+
+	n.mu.RLock()
+	var peers []int
+	for id, active := range n.active {
+		if active && id != n.id {
+			peers = append(peers, id)
+		}
+	}
+	n.mu.RUnlock()
+	if len(peers) == 0 {
+		return 0
+	}
+	sort.Ints(peers)
+
+	n.randMu.Lock()
+	defer n.randMu.Unlock()
+	return peers[n.rand.Intn(len(peers))]
+}
@@ -0,0 +1,138 @@
+// Package consensus holds the node's leader election and replication rules.
+//
+// The logic talks to the outside world only through the Transport, Clock and
+// Storage interfaces. The node binary plugs in TCP/HTTP and Postgres, while
+// package simulation runs many nodes in one process with simulated time.
+package consensus
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Role describes how a node takes part in elections and replication.
+type Role string
+
+const (
+	RoleVoter   Role = "voter"   // Votes, can lead and stores user data
+	RoleLearner Role = "learner" // Receives replication but does not vote
+	RoleWitness Role = "witness" // Votes but stores no user data and never leads
+)
+
+// ParseRole maps a role label to a Role, defaulting to RoleVoter.
+func ParseRole(role string) Role {
+	switch Role(role) {
+	case RoleLearner, RoleWitness:
+		return Role(role)
+	default:
+		return RoleVoter
+	}
+}
+
+// VoteRequest asks a peer to vote for a candidate in a term. LastEntryTerm
+// and LastEntryID describe the candidate's last entry, so voters can refuse
+// candidates whose log is behind their own.
+type VoteRequest struct {
+	CandidateID   int
+	Term          int
+	LastEntryID   int
+	LastEntryTerm int
+}
+
+// VoteResponse answers a VoteRequest.
+type VoteResponse struct {
+	VoteGranted bool
+	Term        int
+}
+
+// Heartbeat is sent by the leader to assert its leadership for a term.
+type Heartbeat struct {
+	Term   int
+	Leader int
+}
+
+// HeartbeatResponse answers a Heartbeat with the follower's term. A leader
+// that sees a newer term has been deposed and steps down.
+type HeartbeatResponse struct {
+	Term int
+}
+
+// Entry is one replicated write in the transaction log. The leader assigns ID,
+// a gapless sequence number, and Term when the write commits; every replica
+// stores both unchanged. Operation is the encoded write, opaque to consensus
+// and applied by Storage.
+type Entry struct {
+	ID        int             `json:"id"`
+	Term      int             `json:"term"`
+	Type      string          `json:"type"`
+	Table     string          `json:"table_name"`
+	Operation json.RawMessage `json:"operation"`
+}
+
+// Member is a node's view of another member from the membership service.
+type Member struct {
+	Role     Role
+	IsLeader bool
+}
+
+// Transport carries messages between nodes. Calls are synchronous and must
+// not be made while holding a Node's lock.
+type Transport interface {
+	RequestVote(to int, req VoteRequest) (VoteResponse, error)
+	SendHeartbeat(to int, hb Heartbeat) (HeartbeatResponse, error)
+	// FetchEntries returns the entries the given node holds after afterID.
+	FetchEntries(from int, afterID int) ([]Entry, error)
+	// Broadcast delivers a new entry from the leader to the other members.
+	Broadcast(entry Entry) error
+	// LogSummary returns the given node's log summary, digested up to upTo.
+	LogSummary(from int, upTo int) (LogSummary, error)
+}
+
+// Clock supplies the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// Storage is the node's durable transaction log and the data it applies to.
+type Storage interface {
+	// LastEntryID returns the ID of the last applied entry, or 0 if none.
+	LastEntryID() (int, error)
+	// Append applies and logs the entries, in order, as one unit. It returns
+	// ErrAlreadyApplied, applying nothing, if any entry's ID is already stored.
+	Append(entries ...Entry) error
+	// EntriesAfter returns the logged entries with an ID greater than id.
+	EntriesAfter(id int) ([]Entry, error)
+	// TruncateFrom removes the entries with an ID of id or more and undoes
+	// what they applied, so a diverged log can take the leader's entries.
+	TruncateFrom(id int) error
+}
+
+// SystemClock is a Clock backed by the wall clock.
+type SystemClock struct{}
+
+// Now returns the current wall clock time.
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+var (
+	ErrNotLeader      = errors.New("node is not the leader")
+	ErrNoLeader       = errors.New("no known leader")
+	ErrAlreadyApplied = errors.New("entry already applied")
+	ErrOutOfSync      = errors.New("log still out of sync after catch-up")
+	ErrNoPeers        = errors.New("no peer to compare logs with")
+	ErrBuffered       = errors.New("entries held until the gap before them fills")
+	ErrStaleTerm      = errors.New("entries are from a term older than the node's")
+)
+
+// Default timings, matching the node binary's behaviour.
+const (
+	DefaultHeartbeatInterval = 2 * time.Second
+	DefaultLeaderTimeout     = 4 * time.Second
+	DefaultMinElectionJitter = 150 * time.Millisecond
+	DefaultMaxElectionJitter = 300 * time.Millisecond
+
+	DefaultReorderTimeout    = time.Second
+	DefaultReorderBufferSize = 1000
+)
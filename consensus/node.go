@@ -0,0 +1,658 @@
+package consensus
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Options configures a Node. Zero timings fall back to the defaults.
+type Options struct {
+	ID        int
+	Role      Role
+	Transport Transport
+	Clock     Clock
+	Storage   Storage
+	Rand      *rand.Rand
+
+	HeartbeatInterval time.Duration
+	LeaderTimeout     time.Duration
+	MinElectionJitter time.Duration
+	MaxElectionJitter time.Duration
+
+	// ReorderTimeout is how long entries that arrive ahead of a gap wait for
+	// it to fill before the missing entries are fetched from the leader, and
+	// ReorderBufferSize how many entries may wait at once.
+	ReorderTimeout    time.Duration
+	ReorderBufferSize int
+}
+
+// Status is a snapshot of a node's election state.
+type Status struct {
+	ID       int
+	Role     Role
+	Term     int
+	IsLeader bool
+	LeaderID int
+	Active   map[int]bool
+	Roles    map[int]Role
+	Voters   []int // Committed voter configuration, nil before bootstrap
+}
+
+// Node runs the election and in-order apply rules for one cluster member.
+// It never sleeps or spawns long-lived goroutines: the caller drives it by
+// calling Tick again after the duration Tick returns.
+type Node struct {
+	id        int
+	role      Role
+	transport Transport
+	clock     Clock
+	storage   Storage
+	rand      *rand.Rand
+	opts      Options
+
+	mu            sync.RWMutex
+	randMu        sync.Mutex
+	leader        bool
+	leaderID      int
+	term          int
+	votedFor      int // Candidate granted a vote in term, 0 if none
+	lastHeartbeat time.Time
+	campaignAt    time.Time
+	active        map[int]bool
+	roles         map[int]Role
+	voters        []int
+
+	// applyMu serializes appends so entries are applied in ID order
+	applyMu      sync.Mutex
+	reorder      map[int]Entry // Entries waiting for a gap to fill
+	reorderSince time.Time     // When the current gap was first seen
+	buffered     atomic.Int64
+	fallbacks    atomic.Int64
+	truncations  atomic.Int64
+
+	// digestMu guards the digests LogSummary resumes from, see antientropy.go
+	digestMu  sync.Mutex
+	digests   map[int]string // Chained digest at every digestInterval-th entry and at digestTip
+	digestTip int            // Furthest entry summarized
+	digestGen int            // Bumped when the log is cut, so a summary in progress caches nothing
+}
+
+// NewNode creates a node from opts.
+func NewNode(opts Options) *Node {
+	if opts.Clock == nil {
+		opts.Clock = SystemClock{}
+	}
+	if opts.Rand == nil {
+		opts.Rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if opts.Role == "" {
+		opts.Role = RoleVoter
+	}
+	if opts.HeartbeatInterval == 0 {
+		opts.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if opts.LeaderTimeout == 0 {
+		opts.LeaderTimeout = DefaultLeaderTimeout
+	}
+	if opts.MinElectionJitter == 0 {
+		opts.MinElectionJitter = DefaultMinElectionJitter
+	}
+	if opts.MaxElectionJitter < opts.MinElectionJitter {
+		opts.MaxElectionJitter = opts.MinElectionJitter
+	}
+	if opts.MaxElectionJitter == 0 {
+		opts.MaxElectionJitter = DefaultMaxElectionJitter
+	}
+	if opts.ReorderTimeout == 0 {
+		opts.ReorderTimeout = DefaultReorderTimeout
+	}
+	if opts.ReorderBufferSize == 0 {
+		opts.ReorderBufferSize = DefaultReorderBufferSize
+	}
+
+	return &Node{
+		id:        opts.ID,
+		role:      opts.Role,
+		transport: opts.Transport,
+		clock:     opts.Clock,
+		storage:   opts.Storage,
+		rand:      opts.Rand,
+		opts:      opts,
+		active:    make(map[int]bool),
+		roles:     make(map[int]Role),
+		reorder:   make(map[int]Entry),
+		digests:   make(map[int]string),
+	}
+}
+
+// ID returns the node's ID.
+func (n *Node) ID() int {
+	return n.id
+}
+
+// Role returns the role the node was started with.
+func (n *Node) Role() Role {
+	return n.role
+}
+
+// IsLeader reports whether the node currently believes it is the leader.
+func (n *Node) IsLeader() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.leader
+}
+
+// LeaderID returns the last known leader, or 0 if none is known.
+func (n *Node) LeaderID() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.leaderID
+}
+
+// Term returns the node's current term.
+func (n *Node) Term() int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.term
+}
+
+// Leadership returns the node's current term and whether it leads in that
+// term, read together so a term change cannot fall between them.
+func (n *Node) Leadership() (term int, leader bool) {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.term, n.leader
+}
+
+// Status returns a copy of the node's election state.
+func (n *Node) Status() Status {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	active := make(map[int]bool, len(n.active))
+	for id, ok := range n.active {
+		active[id] = ok
+	}
+	roles := make(map[int]Role, len(n.roles))
+	for id, role := range n.roles {
+		roles[id] = role
+	}
+	var voters []int
+	if n.voters != nil {
+		voters = append([]int{}, n.voters...)
+	}
+
+	return Status{
+		ID:       n.id,
+		Role:     n.role,
+		Term:     n.term,
+		IsLeader: n.leader,
+		LeaderID: n.leaderID,
+		Active:   active,
+		Roles:    roles,
+		Voters:   voters,
+	}
+}
+
+// SetMembers replaces the node's view of the live members, as reported by
+// the membership service.
+func (n *Node) SetMembers(members map[int]Member) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	ids := make([]int, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	n.active = make(map[int]bool, len(members))
+	n.roles = make(map[int]Role, len(members))
+	for _, id := range ids {
+		n.active[id] = true
+		n.roles[id] = members[id].Role
+		// Leadership of this node is only ever decided by its own elections;
+		// the membership service may still be reporting an earlier term
+		if members[id].IsLeader && id != n.id {
+			n.leaderID = id
+		}
+	}
+}
+
+// SetVoters installs the committed voter configuration. A nil slice means no
+// configuration has been committed and voters are derived from member roles.
+func (n *Node) SetVoters(voters []int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if voters == nil {
+		n.voters = nil
+		return
+	}
+	n.voters = append([]int{}, voters...)
+	sort.Ints(n.voters)
+}
+
+// ObserveLeader adopts a leader discovered out of band, such as by asking a peer.
+func (n *Node) ObserveLeader(leader, term int) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if term >= n.term {
+		n.term = term
+		n.leader = n.id == leader
+		n.leaderID = leader
+		n.lastHeartbeat = n.clock.Now()
+	}
+}
+
+// StepDown gives up leadership, for example before a graceful shutdown.
+// Callers should stop calling Tick first, or the node may win again.
+func (n *Node) StepDown() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.leader = false
+	if n.leaderID == n.id {
+		n.leaderID = 0
+	}
+}
+
+// Tick runs one round of the election loop and returns how long the caller
+// should wait before calling Tick again.
+func (n *Node) Tick() time.Duration {
+	n.flushReorderBuffer()
+	wait := n.tick()
+	if d := n.reorderWait(); d > 0 && d < wait {
+		wait = d
+	}
+	return wait
+}
+
+func (n *Node) tick() time.Duration {
+	if !n.leaderActive() {
+		n.mu.Lock()
+		now := n.clock.Now()
+		if n.campaignAt.IsZero() {
+			// Randomized backoff so that nodes don't campaign in lockstep
+			n.campaignAt = now.Add(n.jitter())
+		}
+		wait := n.campaignAt.Sub(now)
+		if wait <= 0 {
+			n.campaignAt = time.Time{}
+		}
+		n.mu.Unlock()
+
+		if wait > 0 {
+			return wait
+		}
+		n.startElection()
+	} else {
+		n.recognizeLeader()
+	}
+
+	if n.IsLeader() {
+		n.sendHeartbeats()
+	}
+
+	return n.opts.HeartbeatInterval
+}
+
+func (n *Node) jitter() time.Duration {
+	n.randMu.Lock()
+	defer n.randMu.Unlock()
+
+	span := int64(n.opts.MaxElectionJitter - n.opts.MinElectionJitter)
+	if span <= 0 {
+		return n.opts.MinElectionJitter
+	}
+	return n.opts.MinElectionJitter + time.Duration(n.rand.Int63n(span))
+}
+
+func (n *Node) leaderActive() bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.clock.Now().Sub(n.lastHeartbeat) < n.opts.LeaderTimeout
+}
+
+// roleOf returns the registered role of a member. Caller must hold n.mu.
+func (n *Node) roleOf(id int) Role {
+	if id == n.id {
+		return n.role
+	}
+	return n.roles[id]
+}
+
+// isVotingMember reports whether a member counts toward quorum.
+// The committed configuration decides once it exists; before that every
+// member that did not register as a learner votes.
+// Caller must hold n.mu.
+func (n *Node) isVotingMember(id int) bool {
+	if n.voters != nil {
+		for _, voter := range n.voters {
+			if voter == id {
+				return true
+			}
+		}
+		return false
+	}
+	return n.roleOf(id) != RoleLearner
+}
+
+// IsVotingMember reports whether a member counts toward quorum.
+func (n *Node) IsVotingMember(id int) bool {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+	return n.isVotingMember(id)
+}
+
+// canLead reports whether a member may become leader. Caller must hold n.mu.
+func (n *Node) canLead(id int) bool {
+	return n.isVotingMember(id) && n.roleOf(id) != RoleWitness
+}
+
+// votingMembers returns the IDs that take part in elections: the committed
+// voters, or the active voting members before a configuration exists.
+// Caller must hold n.mu.
+func (n *Node) votingMembers() []int {
+	if n.voters != nil {
+		return append([]int{}, n.voters...)
+	}
+	ids := make([]int, 0, len(n.active))
+	for id, active := range n.active {
+		if active && n.isVotingMember(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// ActiveVoters returns the live members that count toward quorum.
+func (n *Node) ActiveVoters() []int {
+	n.mu.RLock()
+	defer n.mu.RUnlock()
+
+	ids := make([]int, 0, len(n.active))
+	for id, active := range n.active {
+		if active && n.isVotingMember(id) {
+			ids = append(ids, id)
+		}
+	}
+	sort.Ints(ids)
+	return ids
+}
+
+// votingMemberCount returns the number of active members that count toward
+// quorum. Caller must hold n.mu.
+func (n *Node) votingMemberCount() int {
+	count := 0
+	for id, active := range n.active {
+		if active && n.isVotingMember(id) {
+			count++
+		}
+	}
+	return count
+}
+
+// quorumSize returns the votes needed for a majority, computed from the
+// committed configuration rather than the live lease list when one exists.
+// Caller must hold n.mu.
+func (n *Node) quorumSize() int {
+	if n.voters != nil {
+		return len(n.voters)/2 + 1
+	}
+	return n.votingMemberCount()/2 + 1
+}
+
+func (n *Node) startElection() {
+	// Witnesses hold no data, so they never campaign
+	if n.role == RoleWitness {
+		return
+	}
+
+	lastEntryID, lastEntryTerm, err := n.lastEntry()
+	if err != nil {
+		return
+	}
+
+	n.mu.Lock()
+
+	if n.leaderID > 0 && n.active[n.leaderID] && n.leaderID != n.id {
+		n.mu.Unlock()
+		return
+	}
+
+	if n.clock.Now().Sub(n.lastHeartbeat) < n.opts.LeaderTimeout {
+		n.mu.Unlock()
+		return
+	}
+
+	// Non-voting learners wait to be added to the configuration
+	if !n.canLead(n.id) {
+		n.mu.Unlock()
+		return
+	}
+
+	// Defer to lower IDs that can lead. If none of them has won after a
+	// second timeout (for example because their logs are behind), campaign anyway.
+	if n.clock.Now().Sub(n.lastHeartbeat) < 2*n.opts.LeaderTimeout {
+		for id, active := range n.active {
+			if active && id < n.id && n.canLead(id) {
+				n.mu.Unlock()
+				return
+			}
+		}
+	}
+
+	n.term++
+	n.votedFor = n.id
+	n.leader = false
+	currentTerm := n.term
+
+	peers := make([]int, 0, len(n.active))
+	for _, id := range n.votingMembers() {
+		if id != n.id {
+			peers = append(peers, id)
+		}
+	}
+	quorumSize := n.quorumSize()
+
+	n.mu.Unlock()
+
+	// Requests go out concurrently, but responses are counted in ID order so
+	// that the outcome only depends on what the peers answered
+	responses := make([]*VoteResponse, len(peers))
+	var wg sync.WaitGroup
+	for i, id := range peers {
+		wg.Add(1)
+		go func(i, targetID int) {
+			defer wg.Done()
+			req := VoteRequest{CandidateID: n.id, Term: currentTerm, LastEntryID: lastEntryID, LastEntryTerm: lastEntryTerm}
+			resp, err := n.transport.RequestVote(targetID, req)
+			if err == nil {
+				responses[i] = &resp
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	votes := 1
+	for _, resp := range responses {
+		if resp == nil {
+			continue
+		}
+		if resp.Term > n.term {
+			// A newer term exists; abandon the campaign
+			n.term = resp.Term
+			n.votedFor = 0
+			n.leader = false
+			return
+		}
+		if resp.VoteGranted {
+			votes++
+		}
+	}
+
+	// Someone else may have won this term while we were waiting
+	if n.term != currentTerm || n.votedFor != n.id {
+		return
+	}
+
+	if votes >= quorumSize && !n.leader {
+		n.leader = true
+		n.leaderID = n.id
+		n.lastHeartbeat = n.clock.Now()
+	}
+}
+
+func (n *Node) recognizeLeader() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	// Only voting members count toward quorum
+	activeCount := n.votingMemberCount()
+
+	// Quorum comes from the committed configuration once one exists
+	quorumSize := n.quorumSize()
+
+	if activeCount < quorumSize || !n.canLead(n.id) {
+		n.leader = false
+		return
+	}
+
+	// Another live leader means this node lost its term; it never promotes
+	// itself here, since that needs an election
+	if n.leaderID > 0 && n.active[n.leaderID] && n.leaderID != n.id {
+		n.leader = false
+	}
+}
+
+func (n *Node) sendHeartbeats() {
+	n.mu.Lock()
+	if !n.leader {
+		n.mu.Unlock()
+		return
+	}
+	// The leader hears its own heartbeat, which keeps its quorum check running
+	n.lastHeartbeat = n.clock.Now()
+	hb := Heartbeat{Term: n.term, Leader: n.id}
+	targets := make([]int, 0, len(n.active))
+	for id, active := range n.active {
+		if active && id != n.id {
+			targets = append(targets, id)
+		}
+	}
+	n.mu.Unlock()
+
+	sort.Ints(targets)
+	responses := make([]*HeartbeatResponse, len(targets))
+	var wg sync.WaitGroup
+	for i, id := range targets {
+		wg.Add(1)
+		go func(i, targetID int) {
+			defer wg.Done()
+			resp, err := n.transport.SendHeartbeat(targetID, hb)
+			if err == nil {
+				responses[i] = &resp
+			}
+		}(i, id)
+	}
+	wg.Wait()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, resp := range responses {
+		if resp != nil && resp.Term > n.term {
+			// A follower has moved on to a newer term, so this node was
+			// deposed; an election in that term picks the next leader
+			n.term = resp.Term
+			n.votedFor = 0
+			n.leader = false
+			if n.leaderID == n.id {
+				n.leaderID = 0
+			}
+		}
+	}
+}
+
+// lastEntry returns the ID and term of the last logged entry, or zeros for
+// an empty log.
+func (n *Node) lastEntry() (int, int, error) {
+	last, err := n.storage.LastEntryID()
+	if err != nil || last == 0 {
+		return last, 0, err
+	}
+	entries, err := n.storage.EntriesAfter(last - 1)
+	if err != nil {
+		return 0, 0, err
+	}
+	if len(entries) == 0 {
+		return last, 0, nil
+	}
+	return entries[0].ID, entries[0].Term, nil
+}
+
+// HandleVoteRequest decides whether to grant a vote. A node grants at most
+// one vote per term, never votes for a candidate whose log is behind its own,
+// and never votes at all as a non-voting learner. Logs are compared by the
+// term of their last entry first and only then by its ID, since a longer log
+// may end in a deposed leader's entries.
+func (n *Node) HandleVoteRequest(req VoteRequest) VoteResponse {
+	lastEntryID, lastEntryTerm, err := n.lastEntry()
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	response := VoteResponse{VoteGranted: false, Term: n.term}
+
+	if !n.isVotingMember(n.id) || err != nil {
+		return response
+	}
+
+	if req.LastEntryTerm < lastEntryTerm || (req.LastEntryTerm == lastEntryTerm && req.LastEntryID < lastEntryID) {
+		// Electing this candidate would lose entries we hold. Move to its term
+		// so that our own campaign outbids it.
+		if req.Term > n.term {
+			n.term = req.Term
+			n.votedFor = 0
+			n.leader = false
+		}
+		response.Term = n.term
+		return response
+	}
+
+	if req.Term > n.term ||
+		(req.Term == n.term && (n.votedFor == 0 || n.votedFor == req.CandidateID)) {
+		response.VoteGranted = true
+		n.term = req.Term
+		n.votedFor = req.CandidateID
+		n.leader = false
+		n.leaderID = req.CandidateID
+		n.lastHeartbeat = n.clock.Now()
+	}
+	response.Term = n.term
+	return response
+}
+
+// HandleHeartbeat accepts a heartbeat from a leader of the current or a newer
+// term, and answers with the node's term so that a stale leader steps down.
+func (n *Node) HandleHeartbeat(hb Heartbeat) HeartbeatResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if hb.Term >= n.term {
+		n.term = hb.Term
+		n.leader = false // This node is definitely not the leader
+		n.leaderID = hb.Leader
+		n.votedFor = hb.Leader
+		n.lastHeartbeat = n.clock.Now()
+	}
+	return HeartbeatResponse{Term: n.term}
+}
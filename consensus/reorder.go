@@ -0,0 +1,119 @@
+package consensus
+
+import (
+	"sort"
+	"time"
+)
+
+// Entries that arrive ahead of a gap are held in a reorder buffer instead of
+// triggering a fetch from the leader straight away: concurrent deliveries
+// often just overtake each other. The buffer is applied as soon as the gap
+// fills, and only when it stays open for ReorderTimeout, or the buffer
+// outgrows ReorderBufferSize, are the missing entries fetched from the leader.
+//
+// The buffer is guarded by applyMu.
+
+// bufferEntries holds entries that follow a gap. It returns false if the gap
+// has been open too long or the buffer is full, in which case the caller
+// falls back to fetching from the leader.
+func (n *Node) bufferEntries(entries []Entry) bool {
+	now := n.clock.Now()
+	if len(n.reorder) == 0 {
+		n.reorderSince = now
+	}
+	if now.Sub(n.reorderSince) >= n.opts.ReorderTimeout || len(n.reorder)+len(entries) > n.opts.ReorderBufferSize {
+		return false
+	}
+
+	for _, e := range entries {
+		n.reorder[e.ID] = e
+	}
+	n.buffered.Store(int64(len(n.reorder)))
+	return true
+}
+
+// drainReorderBuffer applies the buffered entries that now follow the log
+// without a gap and discards those already applied.
+func (n *Node) drainReorderBuffer() error {
+	if len(n.reorder) == 0 {
+		return nil
+	}
+
+	last, err := n.storage.LastEntryID()
+	if err != nil {
+		return err
+	}
+	for id := range n.reorder {
+		if id <= last {
+			delete(n.reorder, id)
+		}
+	}
+
+	var run []Entry
+	for next := last + 1; ; next++ {
+		e, ok := n.reorder[next]
+		if !ok {
+			break
+		}
+		run = append(run, e)
+	}
+	if len(run) > 0 {
+		if err := n.storage.Append(run...); err != nil {
+			return err
+		}
+		for _, e := range run {
+			delete(n.reorder, e.ID)
+		}
+		// Whatever is left waits on a new gap
+		n.reorderSince = n.clock.Now()
+	}
+
+	n.buffered.Store(int64(len(n.reorder)))
+	return nil
+}
+
+// flushReorderBuffer fetches the missing entries from the leader once the gap
+// in front of the buffer has been open for ReorderTimeout.
+func (n *Node) flushReorderBuffer() {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	if len(n.reorder) == 0 || n.clock.Now().Sub(n.reorderSince) < n.opts.ReorderTimeout {
+		return
+	}
+
+	ids := make([]int, 0, len(n.reorder))
+	for id := range n.reorder {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+
+	last, err := n.storage.LastEntryID()
+	if err != nil {
+		return
+	}
+	n.fallbacks.Add(1)
+	if err := n.fillGap(last, ids[0]); err != nil {
+		// Try again after another timeout
+		n.reorderSince = n.clock.Now()
+		return
+	}
+	n.drainReorderBuffer()
+}
+
+// ReorderStatus returns the number of entries waiting in the reorder buffer
+// and how many times a gap had to be fetched from the leader.
+func (n *Node) ReorderStatus() (buffered int, fallbacks int64) {
+	return int(n.buffered.Load()), n.fallbacks.Load()
+}
+
+// reorderWait returns how long until the buffer's gap times out, or 0 if
+// nothing is buffered.
+func (n *Node) reorderWait() time.Duration {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	if len(n.reorder) == 0 {
+		return 0
+	}
+	return n.opts.ReorderTimeout - n.clock.Now().Sub(n.reorderSince)
+}
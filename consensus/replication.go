@@ -0,0 +1,236 @@
+package consensus
+
+import "fmt"
+
+// HandleEntry applies an entry received from the leader. Entries must be
+// applied in ID order: duplicates return ErrAlreadyApplied, and an entry
+// that arrives ahead of a gap returns ErrBuffered and is applied once the gap
+// fills. A gap still open after ReorderTimeout is filled from the leader.
+func (n *Node) HandleEntry(entry Entry) error {
+	return n.HandleEntries(entry)
+}
+
+// HandleEntries applies a batch of consecutive entries from the leader in a
+// single Append. A batch from a term older than the node's comes from a
+// deposed leader and is refused with ErrStaleTerm. Entries that were already
+// applied are skipped, and ErrAlreadyApplied is returned only if that leaves
+// nothing to apply. Where the log holds an entry from an older term at one of
+// the batch's positions, the log is truncated from there and the batch
+// replaces it.
+func (n *Node) HandleEntries(entries ...Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+	for i := 1; i < len(entries); i++ {
+		if entries[i].ID != entries[i-1].ID+1 {
+			return fmt.Errorf("batch is not consecutive at entry %d", entries[i].ID)
+		}
+	}
+	if entries[len(entries)-1].Term < n.Term() {
+		return ErrStaleTerm
+	}
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	last, err := n.storage.LastEntryID()
+	if err != nil {
+		return fmt.Errorf("error reading last entry: %v", err)
+	}
+	if entries[0].ID <= last {
+		if last, err = n.reconcile(entries, last); err != nil {
+			return err
+		}
+	}
+	entries = unapplied(entries, last)
+	if len(entries) == 0 {
+		return ErrAlreadyApplied
+	}
+
+	if entries[0].ID > last+1 {
+		if n.bufferEntries(entries) {
+			return ErrBuffered
+		}
+		n.fallbacks.Add(1)
+		if err := n.fillGap(last, entries[0].ID); err != nil {
+			return err
+		}
+		if err := n.drainReorderBuffer(); err != nil {
+			return err
+		}
+		last, err = n.storage.LastEntryID()
+		if err != nil {
+			return fmt.Errorf("error reading last entry: %v", err)
+		}
+		entries = unapplied(entries, last)
+		if len(entries) == 0 {
+			return ErrAlreadyApplied
+		}
+		if entries[0].ID != last+1 {
+			return ErrOutOfSync
+		}
+	}
+
+	if err := n.storage.Append(entries...); err != nil {
+		return err
+	}
+	return n.drainReorderBuffer()
+}
+
+// unapplied drops the leading entries with an ID up to last.
+func unapplied(entries []Entry, last int) []Entry {
+	for len(entries) > 0 && entries[0].ID <= last {
+		entries = entries[1:]
+	}
+	return entries
+}
+
+// reconcile compares the entries with the ones logged at the same positions.
+// At the first position logged with an older term it truncates the log, so
+// the entries replace what a deposed leader wrote there, and returns the new
+// end of the log. Caller must hold n.applyMu.
+func (n *Node) reconcile(entries []Entry, last int) (int, error) {
+	logged, err := n.storage.EntriesAfter(entries[0].ID - 1)
+	if err != nil {
+		return last, fmt.Errorf("error reading entries: %v", err)
+	}
+	terms := make(map[int]int, len(logged))
+	for _, e := range logged {
+		terms[e.ID] = e.Term
+	}
+
+	for _, e := range entries {
+		term, ok := terms[e.ID]
+		if !ok || term > e.Term {
+			break
+		}
+		if term < e.Term {
+			if err := n.truncate(e.ID); err != nil {
+				return last, err
+			}
+			return e.ID - 1, nil
+		}
+	}
+	return last, nil
+}
+
+// truncate removes the log from position from on, along with the buffered
+// entries there, which may come from the same deposed leader.
+// Caller must hold n.applyMu.
+func (n *Node) truncate(from int) error {
+	if err := n.storage.TruncateFrom(from); err != nil {
+		return fmt.Errorf("error truncating log from entry %d: %v", from, err)
+	}
+	for id := range n.reorder {
+		if id >= from {
+			delete(n.reorder, id)
+		}
+	}
+	n.buffered.Store(int64(len(n.reorder)))
+	n.forgetDigests(from)
+	n.truncations.Add(1)
+	return nil
+}
+
+// Truncations returns how many times the log was truncated because entries
+// from a newer term replaced the ones at its end.
+func (n *Node) Truncations() int64 {
+	return n.truncations.Load()
+}
+
+// fillGap fetches and applies the leader's entries between last and before,
+// exclusive. Caller must hold n.applyMu.
+func (n *Node) fillGap(last, before int) error {
+	leader := n.LeaderID()
+	if leader == 0 || leader == n.id {
+		return ErrNoLeader
+	}
+
+	entries, err := n.transport.FetchEntries(leader, last)
+	if err != nil {
+		return fmt.Errorf("error fetching missing entries from node %d: %v", leader, err)
+	}
+
+	var missing []Entry
+	next := last + 1
+	for _, e := range entries {
+		if e.ID != next || e.ID >= before {
+			break
+		}
+		missing = append(missing, e)
+		next++
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return n.storage.Append(missing...)
+}
+
+// CatchUp pulls every entry the leader has that this node is missing.
+// It is used on startup before the node accepts multicasts.
+func (n *Node) CatchUp() (int, error) {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+
+	leader := n.LeaderID()
+	if leader == 0 || leader == n.id {
+		return 0, ErrNoLeader
+	}
+
+	last, err := n.storage.LastEntryID()
+	if err != nil {
+		return 0, fmt.Errorf("error reading last entry: %v", err)
+	}
+
+	entries, err := n.transport.FetchEntries(leader, last)
+	if err != nil {
+		return 0, fmt.Errorf("error fetching entries from node %d: %v", leader, err)
+	}
+
+	var missing []Entry
+	next := last + 1
+	for _, e := range entries {
+		if e.ID != next {
+			break
+		}
+		missing = append(missing, e)
+		next++
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+	if err := n.storage.Append(missing...); err != nil {
+		return 0, err
+	}
+	return len(missing), n.drainReorderBuffer()
+}
+
+// Propose assigns the next log position and the current term to a new entry
+// on the leader, applies it locally and broadcasts it to the other members.
+// The term and leadership are read together, so a node that steps down
+// meanwhile cannot stamp an entry with the term that deposed it.
+func (n *Node) Propose(entry Entry) (Entry, error) {
+	n.applyMu.Lock()
+	term, leader := n.Leadership()
+	if !leader {
+		n.applyMu.Unlock()
+		return Entry{}, ErrNotLeader
+	}
+	last, err := n.storage.LastEntryID()
+	if err != nil {
+		n.applyMu.Unlock()
+		return Entry{}, fmt.Errorf("error reading last entry: %v", err)
+	}
+	entry.ID = last + 1
+	entry.Term = term
+	if err := n.storage.Append(entry); err != nil {
+		n.applyMu.Unlock()
+		return Entry{}, err
+	}
+	n.applyMu.Unlock()
+
+	if err := n.transport.Broadcast(entry); err != nil {
+		return entry, fmt.Errorf("error broadcasting entry %d: %v", entry.ID, err)
+	}
+	return entry, nil
+}
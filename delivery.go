@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Delivery tracking: a write is identified by the sequence number the leader
+// assigned it. Every node reports the positions it applies, and senders report
+// the ones they could not deliver, to the leader, which keeps the latest
+// report per node for recent positions and serves them on /deliveries/{position}.
+// Reports are best effort and kept in memory, so a new leader only knows
+// about writes applied after it took over.
+const (
+	deliveryReportInterval = 500 * time.Millisecond
+	deliveryHistory        = 10000 // Positions tracked on the leader
+	deliveryQueueSize      = 1000  // Reports waiting to be sent
+)
+
+// Delivery states reported for a node.
+const (
+	DeliveryApplied = "applied"
+	DeliveryPending = "pending"
+	DeliveryFailed  = "failed"
+)
+
+// deliveryReport says that Node applied, or could not be sent, the entries
+// From..To.
+type deliveryReport struct {
+	Node    string    `json:"node"`
+	From    int       `json:"from"`
+	To      int       `json:"to"`
+	Status  string    `json:"status"`
+	At      time.Time `json:"at"`
+	Message string    `json:"message,omitempty"`
+}
+
+// deliveryBatch is the body of a POST to /deliveries.
+type deliveryBatch struct {
+	Reporter string           `json:"reporter"`
+	Reports  []deliveryReport `json:"reports"`
+}
+
+// NodeDelivery is one node's state for a write.
+type NodeDelivery struct {
+	Node    string     `json:"node"`
+	Status  string     `json:"status"`
+	At      *time.Time `json:"at,omitempty"`
+	Message string     `json:"message,omitempty"`
+}
+
+// DeliveryStatus is the answer to /deliveries/{position}.
+type DeliveryStatus struct {
+	Position int            `json:"position"`
+	Applied  int            `json:"applied"`
+	Pending  int            `json:"pending"`
+	Failed   int            `json:"failed"`
+	Nodes    []NodeDelivery `json:"nodes"`
+}
+
+// deliveryTracker aggregates reports on the leader.
+type deliveryTracker struct {
+	mu        sync.Mutex
+	positions map[int]map[string]deliveryReport
+	newest    int
+}
+
+var (
+	deliveries     = &deliveryTracker{positions: make(map[int]map[string]deliveryReport)}
+	pendingReports = make(chan deliveryReport, deliveryQueueSize)
+)
+
+// record stores r for each of its positions. An applied report is final, so a
+// later failure from a retried delivery does not overwrite it.
+func (t *deliveryTracker) record(r deliveryReport) {
+	ackApplied(r)
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for position := r.From; position <= r.To; position++ {
+		if position <= t.newest-deliveryHistory {
+			continue
+		}
+		nodes := t.positions[position]
+		if nodes == nil {
+			nodes = make(map[string]deliveryReport)
+			t.positions[position] = nodes
+		}
+		if nodes[r.Node].Status == DeliveryApplied {
+			continue
+		}
+		nodes[r.Node] = r
+	}
+
+	if r.To > t.newest {
+		t.newest = r.To
+		for position := range t.positions {
+			if position <= t.newest-deliveryHistory {
+				delete(t.positions, position)
+			}
+		}
+	}
+}
+
+// status reports which of members have applied position. Nodes that reported
+// on it but are no longer members are listed too.
+func (t *deliveryTracker) status(position int, members []string) (DeliveryStatus, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	reports, ok := t.positions[position]
+	if !ok {
+		return DeliveryStatus{}, false
+	}
+
+	status := DeliveryStatus{Position: position}
+	seen := make(map[string]bool)
+	add := func(node string) {
+		if seen[node] {
+			return
+		}
+		seen[node] = true
+
+		d := NodeDelivery{Node: node, Status: DeliveryPending}
+		if r, ok := reports[node]; ok {
+			at := r.At
+			d.Status, d.At, d.Message = r.Status, &at, r.Message
+		}
+		switch d.Status {
+		case DeliveryApplied:
+			status.Applied++
+		case DeliveryFailed:
+			status.Failed++
+		default:
+			status.Pending++
+		}
+		status.Nodes = append(status.Nodes, d)
+	}
+	for _, node := range members {
+		add(node)
+	}
+	for node := range reports {
+		add(node)
+	}
+
+	sort.Slice(status.Nodes, func(i, j int) bool {
+		a, _ := strconv.Atoi(status.Nodes[i].Node)
+		b, _ := strconv.Atoi(status.Nodes[j].Node)
+		return a < b
+	})
+	return status, true
+}
+
+// reportDelivery queues a report for the leader. Reports are dropped rather
+// than slowing down replication when the queue is full.
+func reportDelivery(r deliveryReport) {
+	select {
+	case pendingReports <- r:
+	default:
+		log.Printf("Delivery report queue full, dropping report for entries %d-%d", r.From, r.To)
+	}
+}
+
+// reportApplied reports that this node applied the entries from..to.
+func reportApplied(from, to int) {
+	reportDelivery(deliveryReport{Node: os.Getenv("NODE_ID"), From: from, To: to, Status: DeliveryApplied, At: time.Now()})
+}
+
+// runDeliveryReports sends queued reports to the leader every
+// deliveryReportInterval. The leader records its own directly.
+func runDeliveryReports(ctx context.Context, node *Node) {
+	ticker := time.NewTicker(deliveryReportInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var reports []deliveryReport
+	drain:
+		for {
+			select {
+			case r := <-pendingReports:
+				reports = append(reports, r)
+			default:
+				break drain
+			}
+		}
+		if len(reports) == 0 {
+			continue
+		}
+
+		if node.core.IsLeader() {
+			for _, r := range reports {
+				deliveries.record(r)
+			}
+			continue
+		}
+		leader := node.core.LeaderID()
+		if leader == 0 {
+			continue
+		}
+		if err := sendDeliveryReports(fmt.Sprintf("node-%d:8080", leader), deliveryBatch{Reporter: strconv.Itoa(node.ID), Reports: reports}); err != nil {
+			log.Printf("Node %d: Failed to send %d delivery reports: %v", node.ID, len(reports), err)
+		}
+	}
+}
+
+// sendDeliveryReports posts a batch of reports to the leader.
+func sendDeliveryReports(address string, batch deliveryBatch) error {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return fmt.Errorf("failed to marshal delivery reports: %v", err)
+	}
+	resp, err := newHTTPClient(httpTimeout).Post(fmt.Sprintf("%s://%s/deliveries", urlScheme(), address), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("error response (%s): %s", resp.Status, string(body))
+	}
+	return nil
+}
+
+// handleDeliveries accepts reports from other nodes on POST /deliveries and
+// serves a write's delivery state on GET /deliveries/{position}.
+func handleDeliveries(node *Node) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			var batch deliveryBatch
+			if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+				http.Error(w, "Invalid delivery reports", http.StatusBadRequest)
+				return
+			}
+			if !peerIsNode(r.TLS, batch.Reporter) {
+				http.Error(w, "Peer certificate does not match reporter", http.StatusForbidden)
+				return
+			}
+			if !node.core.IsLeader() {
+				http.Error(w, "Node is not the leader", http.StatusServiceUnavailable)
+				return
+			}
+			for _, report := range batch.Reports {
+				deliveries.record(report)
+			}
+			w.WriteHeader(http.StatusOK)
+
+		case http.MethodGet:
+			position, err := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/deliveries/"))
+			if err != nil || position <= 0 {
+				http.Error(w, "Invalid position", http.StatusBadRequest)
+				return
+			}
+
+			var members []string
+			for id, active := range node.core.Status().Active {
+				if active {
+					members = append(members, strconv.Itoa(id))
+				}
+			}
+			status, ok := deliveries.status(position, members)
+			if !ok {
+				http.Error(w, fmt.Sprintf("Position %d is not tracked by this node", position), http.StatusNotFound)
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(status)
+
+		default:
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
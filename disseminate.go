@@ -0,0 +1,359 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"math/rand"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Dissemination strategies, selected per cluster with DISSEMINATION. The
+// leader stamps its strategy on every message and each hop forwards it the
+// same way, so nodes that disagree during a rollout still deliver it.
+const (
+	StrategyTree   = "tree"   // Down the spanning tree, each node forwarding to its children
+	StrategyDirect = "direct" // From the leader to every node at once
+	StrategyGossip = "gossip" // Epidemic: each node forwards to a few random peers
+
+	defaultGossipFanout = 2
+)
+
+// Disseminator delivers a batch committed on the leader to the other nodes.
+// Both methods return the acks collected when msg.WantAcks is set.
+type Disseminator interface {
+	Name() string
+	// Originate sends a batch from the leader, nodeId.
+	Originate(msg MulticastMessage, nodeId string) ([]string, error)
+	// Forward passes on a batch nodeId received from msg.SourceNode.
+	Forward(msg MulticastMessage, nodeId string) ([]string, error)
+}
+
+var disseminators = map[string]Disseminator{
+	StrategyTree:   treeDisseminator{},
+	StrategyDirect: directDisseminator{},
+	StrategyGossip: gossipDisseminator{},
+}
+
+var (
+	strategyOnce  sync.Once
+	localStrategy string
+)
+
+// disseminationStrategy reads DISSEMINATION, falling back to the tree.
+func disseminationStrategy() string {
+	strategyOnce.Do(func() {
+		localStrategy = StrategyTree
+		if value := os.Getenv("DISSEMINATION"); value != "" {
+			if _, ok := disseminators[value]; ok {
+				localStrategy = value
+			} else {
+				log.Printf("Invalid DISSEMINATION %q, using %s", value, localStrategy)
+			}
+		}
+	})
+	return localStrategy
+}
+
+// disseminatorFor returns the strategy named in a message. Messages from
+// before strategies existed name none and travel down the tree.
+func disseminatorFor(name string) (Disseminator, error) {
+	if name == "" {
+		return disseminators[StrategyTree], nil
+	}
+	d, ok := disseminators[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown dissemination strategy %q", name)
+	}
+	return d, nil
+}
+
+// treeDisseminator forwards down the spanning tree.
+type treeDisseminator struct{}
+
+func (treeDisseminator) Name() string { return StrategyTree }
+
+func (treeDisseminator) Originate(msg MulticastMessage, nodeId string) ([]string, error) {
+	// The leader's tree is the cluster's, published under an epoch for the hops to follow
+	if _, err := treeNodeFor(nodeId); err != nil {
+		return nil, err
+	}
+	msg.Epoch = GetGlobalTree().Publish(msg.Term)
+	return sendToChildren(msg, nodeId)
+}
+
+func (treeDisseminator) Forward(msg MulticastMessage, nodeId string) ([]string, error) {
+	return sendToChildren(msg, nodeId)
+}
+
+// directDisseminator sends from the leader to every node, so no node waits on
+// another. Failed deliveries are handed off like in the tree, with no
+// descendants to reroute to.
+type directDisseminator struct{}
+
+func (directDisseminator) Name() string { return StrategyDirect }
+
+func (directDisseminator) Originate(msg MulticastMessage, nodeId string) ([]string, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), multicastTimeout)
+	defer cancel()
+
+	targets, err := peersOf(nodeId)
+	if err != nil {
+		return nil, err
+	}
+	return deliverWithRetry(ctx, targets, msg, func(*SpanningTreeNode) []string { return nil })
+}
+
+func (directDisseminator) Forward(msg MulticastMessage, nodeId string) ([]string, error) {
+	return nil, nil // The leader reached everyone itself
+}
+
+// gossipDisseminator sends to GOSSIP_FANOUT random peers, which do the same
+// until the message's TTL runs out. Peers that already applied the batch
+// drop it, and a node the epidemic misses catches up through reordering,
+// anti-entropy or the next batch, so failed sends are not handed off.
+type gossipDisseminator struct{}
+
+func (gossipDisseminator) Name() string { return StrategyGossip }
+
+func (g gossipDisseminator) Originate(msg MulticastMessage, nodeId string) ([]string, error) {
+	peers, err := peersOf(nodeId)
+	if err != nil {
+		return nil, err
+	}
+	// Enough rounds for the fan-out to cover the cluster, plus one for losses
+	fanout := gossipFanout()
+	msg.TTL = 1
+	if len(peers) > 1 && fanout > 1 {
+		msg.TTL = int(math.Ceil(math.Log(float64(len(peers)+1))/math.Log(float64(fanout)))) + 1
+	}
+	return gossipTo(pickPeers(peers, fanout, ""), msg)
+}
+
+func (g gossipDisseminator) Forward(msg MulticastMessage, nodeId string) ([]string, error) {
+	if msg.TTL <= 1 {
+		return nil, nil
+	}
+	peers, err := peersOf(nodeId)
+	if err != nil {
+		return nil, err
+	}
+	sender := msg.SourceNode
+	msg.TTL--
+	msg.SourceNode = nodeId
+	return gossipTo(pickPeers(peers, gossipFanout(), sender), msg)
+}
+
+// gossipFanout reads GOSSIP_FANOUT.
+func gossipFanout() int {
+	if value := os.Getenv("GOSSIP_FANOUT"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Invalid GOSSIP_FANOUT %q, using %d", value, defaultGossipFanout)
+	}
+	return defaultGossipFanout
+}
+
+// pickPeers returns up to n random peers other than exclude.
+func pickPeers(peers []*SpanningTreeNode, n int, exclude string) []*SpanningTreeNode {
+	candidates := make([]*SpanningTreeNode, 0, len(peers))
+	for _, peer := range peers {
+		if peer.ID != exclude {
+			candidates = append(candidates, peer)
+		}
+	}
+	rand.Shuffle(len(candidates), func(i, j int) { candidates[i], candidates[j] = candidates[j], candidates[i] })
+	if len(candidates) > n {
+		candidates = candidates[:n]
+	}
+	return candidates
+}
+
+// gossipTo sends msg once to each peer in parallel.
+func gossipTo(peers []*SpanningTreeNode, msg MulticastMessage) ([]string, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var acks []string
+	failed := 0
+
+	for _, peer := range peers {
+		wg.Add(1)
+		go func(peer *SpanningTreeNode) {
+			defer wg.Done()
+			peerAcks, err := sendMulticast(peer.address, msg)
+			if err == nil {
+				msg.ack(peerAcks)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				fmt.Printf("Failed to gossip to node %s: %v\n", peer.ID, err)
+				failed++
+				return
+			}
+			acks = append(acks, peerAcks...)
+		}(peer)
+	}
+	wg.Wait()
+
+	if failed == len(peers) && len(peers) > 0 {
+		return acks, fmt.Errorf("gossip failed to all %d peers", len(peers))
+	}
+	return acks, nil
+}
+
+// peersOf brings the spanning tree up to date with the membership list and
+// returns every node in it other than nodeId. The tree is kept under every
+// strategy, since it also locates the destinations of hinted handoff.
+func peersOf(nodeId string) ([]*SpanningTreeNode, error) {
+	if _, err := treeNodeFor(nodeId); err != nil {
+		return nil, err
+	}
+
+	var peers []*SpanningTreeNode
+	var walk func(node *SpanningTreeNode)
+	walk = func(node *SpanningTreeNode) {
+		if node == nil {
+			return
+		}
+		node.mu.RLock()
+		children := append([]*SpanningTreeNode(nil), node.Children...)
+		node.mu.RUnlock()
+
+		if node.ID != nodeId {
+			peers = append(peers, node)
+		}
+		for _, child := range children {
+			walk(child)
+		}
+	}
+	walk(GetGlobalTree().Root)
+
+	sort.Slice(peers, func(i, j int) bool { return peers[i].ID < peers[j].ID })
+	return peers, nil
+}
+
+// disseminationCounters are one strategy's totals on this node.
+type disseminationCounters struct {
+	originated     int64   // Batches this node sent as leader
+	sent           int64   // Messages delivered, every hop and retry included
+	failed         int64   // Messages that could not be delivered
+	bytes          int64   // Bytes of the messages sent
+	received       int64   // Messages received that applied or buffered entries
+	duplicates     int64   // Messages received for entries already applied
+	latencySeconds float64 // Commit on the leader to apply here, summed over received
+}
+
+// disseminationMetrics compares the strategies' latency and bandwidth.
+type disseminationMetrics struct {
+	mu         sync.Mutex
+	strategies map[string]*disseminationCounters
+}
+
+var disseminationStats = disseminationMetrics{strategies: make(map[string]*disseminationCounters)}
+
+// counters returns the strategy's counters. Caller must hold m.mu.
+func (m *disseminationMetrics) counters(strategy string) *disseminationCounters {
+	if strategy == "" {
+		strategy = StrategyTree
+	}
+	c := m.strategies[strategy]
+	if c == nil {
+		c = &disseminationCounters{}
+		m.strategies[strategy] = c
+	}
+	return c
+}
+
+func (m *disseminationMetrics) recordOriginated(strategy string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counters(strategy).originated++
+}
+
+func (m *disseminationMetrics) recordSend(strategy string, size int, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.counters(strategy)
+	if err != nil {
+		c.failed++
+		return
+	}
+	c.sent++
+	c.bytes += int64(size)
+}
+
+func (m *disseminationMetrics) recordReceived(msg MulticastMessage, duplicate bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	c := m.counters(msg.Strategy)
+	if duplicate {
+		c.duplicates++
+		return
+	}
+	c.received++
+	if !msg.CommittedAt.IsZero() {
+		c.latencySeconds += time.Since(msg.CommittedAt).Seconds()
+	}
+}
+
+// writeDisseminationMetrics writes the dissemination metrics in Prometheus text format.
+// Bandwidth per batch is node_dissemination_bytes_total summed over the
+// cluster divided by the leader's node_dissemination_batches_total.
+func writeDisseminationMetrics(w io.Writer, nodeID int) {
+	disseminationStats.mu.Lock()
+	defer disseminationStats.mu.Unlock()
+
+	strategies := make([]string, 0, len(disseminationStats.strategies))
+	for strategy := range disseminationStats.strategies {
+		strategies = append(strategies, strategy)
+	}
+	sort.Strings(strategies)
+
+	fmt.Fprintf(w, "# HELP node_dissemination_strategy Strategy this node uses for the batches it originates\n")
+	fmt.Fprintf(w, "# TYPE node_dissemination_strategy gauge\n")
+	fmt.Fprintf(w, "node_dissemination_strategy{node_id=\"%d\",strategy=\"%s\"} 1\n", nodeID, disseminationStrategy())
+
+	fmt.Fprintf(w, "# HELP node_dissemination_batches_total Batches originated by this node as leader\n")
+	fmt.Fprintf(w, "# TYPE node_dissemination_batches_total counter\n")
+	for _, strategy := range strategies {
+		fmt.Fprintf(w, "node_dissemination_batches_total{node_id=\"%d\",strategy=\"%s\"} %d\n", nodeID, strategy, disseminationStats.strategies[strategy].originated)
+	}
+
+	fmt.Fprintf(w, "# HELP node_dissemination_messages_total Multicast messages sent by this node\n")
+	fmt.Fprintf(w, "# TYPE node_dissemination_messages_total counter\n")
+	for _, strategy := range strategies {
+		c := disseminationStats.strategies[strategy]
+		fmt.Fprintf(w, "node_dissemination_messages_total{node_id=\"%d\",strategy=\"%s\",result=\"ok\"} %d\n", nodeID, strategy, c.sent)
+		fmt.Fprintf(w, "node_dissemination_messages_total{node_id=\"%d\",strategy=\"%s\",result=\"error\"} %d\n", nodeID, strategy, c.failed)
+	}
+
+	fmt.Fprintf(w, "# HELP node_dissemination_bytes_total Bytes of multicast messages sent by this node\n")
+	fmt.Fprintf(w, "# TYPE node_dissemination_bytes_total counter\n")
+	for _, strategy := range strategies {
+		fmt.Fprintf(w, "node_dissemination_bytes_total{node_id=\"%d\",strategy=\"%s\"} %d\n", nodeID, strategy, disseminationStats.strategies[strategy].bytes)
+	}
+
+	fmt.Fprintf(w, "# HELP node_dissemination_received_total Multicast messages received by this node\n")
+	fmt.Fprintf(w, "# TYPE node_dissemination_received_total counter\n")
+	for _, strategy := range strategies {
+		c := disseminationStats.strategies[strategy]
+		fmt.Fprintf(w, "node_dissemination_received_total{node_id=\"%d\",strategy=\"%s\",result=\"new\"} %d\n", nodeID, strategy, c.received)
+		fmt.Fprintf(w, "node_dissemination_received_total{node_id=\"%d\",strategy=\"%s\",result=\"duplicate\"} %d\n", nodeID, strategy, c.duplicates)
+	}
+
+	fmt.Fprintf(w, "# HELP node_dissemination_latency_seconds Time from a batch committing on the leader to it reaching this node\n")
+	fmt.Fprintf(w, "# TYPE node_dissemination_latency_seconds summary\n")
+	for _, strategy := range strategies {
+		c := disseminationStats.strategies[strategy]
+		fmt.Fprintf(w, "node_dissemination_latency_seconds_sum{node_id=\"%d\",strategy=\"%s\"} %g\n", nodeID, strategy, c.latencySeconds)
+		fmt.Fprintf(w, "node_dissemination_latency_seconds_count{node_id=\"%d\",strategy=\"%s\"} %d\n", nodeID, strategy, c.received)
+	}
+}
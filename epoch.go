@@ -0,0 +1,170 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+// Tree epochs: only the leader derives the tree from membership. Each time
+// its tree changes it publishes it under the next epoch number, and every
+// multicast it originates carries the epoch it was routed with. Epochs are
+// ordered by the leader's term first, since a new leader numbers its epochs
+// from wherever its own tree was. A node whose tree is older than a message's
+// epoch, or has changed locally since it was adopted, fetches the leader's
+// /tree before forwarding, so every hop routes along the same edges. A node
+// that cannot reach the leader falls back to its own view of membership.
+
+var (
+	treeSyncMu      sync.Mutex // One fetch of the leader's tree at a time
+	treeFetches     atomic.Int64
+	treeFetchErrors atomic.Int64
+)
+
+// epochBefore reports whether epoch a, published in term termA, is older
+// than epoch b of termB.
+func epochBefore(termA, a, termB, b int) bool {
+	if termA != termB {
+		return termA < termB
+	}
+	return a < b
+}
+
+// Publish returns the epoch of the tree as it is now, starting a new one if
+// the tree changed since the last publication or leadership passed to term.
+// Called by the leader.
+func (s *SpanningTree) Publish(term int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.Epoch == 0 || s.Version != s.published || s.EpochTerm != term {
+		s.Epoch++
+		s.EpochTerm = term
+		s.published = s.Version
+		fmt.Printf("Published spanning tree epoch %d in term %d\n", s.Epoch, term)
+	}
+	return s.Epoch
+}
+
+// Behind reports whether the tree must be fetched from the leader to route a
+// message of epoch, published in term.
+func (s *SpanningTree) Behind(term, epoch int) bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Root == nil || epochBefore(s.EpochTerm, s.Epoch, term, epoch) || s.Version != s.published
+}
+
+// Adopt replaces the tree with the leader's view of it at view.Epoch, unless
+// the tree is already at a newer epoch.
+func (s *SpanningTree) Adopt(view TreeView) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if view.Root == nil || epochBefore(view.Term, view.Epoch, s.EpochTerm, s.Epoch) {
+		return
+	}
+	s.Root = reconstructNode(view.Root, nil, make(map[string]*SpanningTreeNode))
+	s.Fanout = view.Fanout
+	s.Regions = view.Regions
+	s.Plan = view.Plan
+	s.Epoch = view.Epoch
+	s.EpochTerm = view.Term
+	s.members = nil
+	s.leader = ""
+	s.Version++
+	s.published = s.Version
+	s.check("adopting the leader's tree")
+}
+
+// CurrentEpoch returns the tree's epoch.
+func (s *SpanningTree) CurrentEpoch() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Epoch
+}
+
+// Find returns nodeID's position in the tree, or nil.
+func (s *SpanningTree) Find(nodeID string) *SpanningTreeNode {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.Root.FindNodeDFS(nodeID)
+}
+
+// routeFor returns nodeId's position in the tree msg was routed with.
+func routeFor(msg MulticastMessage, nodeId string) (*SpanningTreeNode, error) {
+	// Messages from nodes that predate epochs carry none
+	if msg.Epoch == 0 {
+		return treeNodeFor(nodeId)
+	}
+
+	tree := GetGlobalTree()
+	if tree.Behind(msg.Term, msg.Epoch) {
+		if err := syncTree(msg.Term, msg.Epoch); err != nil {
+			log.Printf("Failed to fetch tree epoch %d, routing with local membership: %v", msg.Epoch, err)
+			return treeNodeFor(nodeId)
+		}
+	}
+	node := tree.Find(nodeId)
+	if node == nil {
+		return nil, fmt.Errorf("node %s not found in tree epoch %d", nodeId, msg.Epoch)
+	}
+	return node, nil
+}
+
+// syncTree fetches the leader's tree unless another caller already brought
+// this node up to epoch of term.
+func syncTree(term, epoch int) error {
+	treeSyncMu.Lock()
+	defer treeSyncMu.Unlock()
+
+	tree := GetGlobalTree()
+	if !tree.Behind(term, epoch) {
+		return nil
+	}
+
+	members, err := getMembershipList(os.Getenv("MEMBERSHIP_HOST"))
+	if err != nil {
+		return err
+	}
+	leader, err := GetLeaderNode(members)
+	if err != nil {
+		return err
+	}
+
+	treeFetches.Add(1)
+	view, err := fetchTree(leader.Address)
+	if err != nil {
+		treeFetchErrors.Add(1)
+		return err
+	}
+	if epochBefore(view.Term, view.Epoch, term, epoch) {
+		// The leader changed, or has not seen the message's epoch; its tree is still the newest known
+		log.Printf("Leader %s is at tree epoch %d, message was routed with %d", leader.ID, view.Epoch, epoch)
+	}
+	tree.Adopt(view)
+	fmt.Printf("Adopted spanning tree epoch %d from leader %s\n", view.Epoch, leader.ID)
+	return nil
+}
+
+// fetchTree reads a node's GET /tree.
+func fetchTree(address string) (TreeView, error) {
+	var view TreeView
+	resp, err := newHTTPClient(httpTimeout).Get(fmt.Sprintf("%s://%s/tree", urlScheme(), address))
+	if err != nil {
+		return view, fmt.Errorf("failed to fetch tree: %v", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return view, fmt.Errorf("error response (%s): %s", resp.Status, string(body))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&view); err != nil {
+		return view, fmt.Errorf("failed to decode tree: %v", err)
+	}
+	return view, nil
+}
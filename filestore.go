@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// fileStore is a memory store backed by a single append-only file. Each
+// committed transaction is appended as one JSON line of changes and synced
+// before the commit returns. On start the file is replayed and rewritten as a
+// single snapshot line, so it only grows between restarts. A line left
+// incomplete by a crash belongs to a transaction that never committed and is
+// dropped.
+type fileStore struct {
+	*memoryStore
+	path string
+	file *os.File
+	size int64 // Length of the file up to the last complete line
+}
+
+// openFileStore loads the store kept at path, creating it if needed.
+func openFileStore(path string) (*fileStore, error) {
+	s := &fileStore{memoryStore: newMemoryStore(), path: path}
+	s.memoryStore.name = "file"
+
+	lines, err := s.replay()
+	if err != nil {
+		return nil, err
+	}
+	if err := s.compact(); err != nil {
+		return nil, err
+	}
+	s.memoryStore.persist = s.append
+	log.Printf("Node %s loaded %d committed transactions from %s", os.Getenv("NODE_ID"), lines, path)
+	return s, nil
+}
+
+// replay applies the transactions in the file, returning how many it read.
+func (s *fileStore) replay() (int, error) {
+	f, err := os.Open(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error opening store file: %v", err)
+	}
+	defer f.Close()
+
+	reader := bufio.NewReader(f)
+	lines := 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(bytes.TrimSpace(line)) > 0 {
+				log.Printf("Dropping incomplete transaction at the end of %s", s.path)
+			}
+			return lines, nil
+		}
+		if err != nil {
+			return lines, fmt.Errorf("error reading store file: %v", err)
+		}
+		lines++
+
+		var changes []storeChange
+		if err := json.Unmarshal(line, &changes); err != nil {
+			return lines, fmt.Errorf("store file %s is corrupt at transaction %d: %v", s.path, lines, err)
+		}
+		for _, change := range changes {
+			if _, err := s.state.apply(change); err != nil {
+				return lines, fmt.Errorf("error replaying transaction %d of %s: %v", lines, s.path, err)
+			}
+		}
+	}
+}
+
+// compact rewrites the file as one snapshot of the current state and opens
+// it for appending.
+func (s *fileStore) compact() error {
+	snapshot, err := s.memoryStore.Snapshot()
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal([]storeChange{{Kind: changeLoad, Snapshot: snapshot}})
+	if err != nil {
+		return fmt.Errorf("failed to encode store snapshot: %v", err)
+	}
+	line = append(line, '\n')
+
+	// Write the new file beside the old one and swap it in atomically
+	tmp := s.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error creating store file: %v", err)
+	}
+	if _, err := f.Write(line); err != nil {
+		f.Close()
+		return fmt.Errorf("error writing store file: %v", err)
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return fmt.Errorf("error syncing store file: %v", err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error closing store file: %v", err)
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		return fmt.Errorf("error replacing store file: %v", err)
+	}
+	if dir, err := os.Open(filepath.Dir(s.path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+
+	s.file, err = os.OpenFile(s.path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return fmt.Errorf("error opening store file: %v", err)
+	}
+	s.size = int64(len(line))
+	return nil
+}
+
+// append writes a transaction's changes to the file and syncs it. A failed
+// write is cut off, so the file always ends with a complete transaction.
+func (s *fileStore) append(changes []storeChange) error {
+	line, err := json.Marshal(changes)
+	if err != nil {
+		return fmt.Errorf("failed to encode transaction: %v", err)
+	}
+	line = append(line, '\n')
+
+	if _, err := s.file.Write(line); err != nil {
+		s.file.Truncate(s.size)
+		return fmt.Errorf("error writing store file: %v", err)
+	}
+	if err := s.file.Sync(); err != nil {
+		s.file.Truncate(s.size)
+		return fmt.Errorf("error syncing store file: %v", err)
+	}
+	s.size += int64(len(line))
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.file.Close()
+}
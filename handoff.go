@@ -0,0 +1,367 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Hinted handoff: a multicast that a child could not receive after every
+// retry is kept in the store's hint queue and replayed to it in order once
+// it is reachable again. Later messages for that child queue behind it. If the
+// child leaves the tree instead, the message is delivered to the descendants
+// it had when the delivery failed, with this node standing in as their parent.
+// A destination's queue holds at most HANDOFF_MAX_HINTS messages; beyond that
+// the oldest are dropped, and the destination catches up on them from the
+// leader's log instead. A hint the destination rejects, such as one from a
+// deposed leader's term, is dropped too rather than blocking those behind it.
+const (
+	defaultHandoffInterval = 5 * time.Second
+	defaultHandoffMaxHints = 1000
+)
+
+// hintStore tracks how many hints are queued for each destination.
+type hintStore struct {
+	mu          sync.Mutex
+	pending     map[string]int
+	redelivered map[string]int // Last hint for a destination redelivered to each orphan, keyed "destination>orphan"
+	replayed    int64          // Hints delivered to their destination
+	rerouted    int64          // Hints handed to the descendants of a departed destination
+	dropped     int64          // Hints dropped from a full queue
+	rejected    int64          // Hints dropped because their destination refused them
+}
+
+var hints = &hintStore{pending: make(map[string]int), redelivered: make(map[string]int)}
+
+// load reads the queued hints left from before a restart.
+func (h *hintStore) load() error {
+	counts, err := store.HintCounts()
+	if err != nil {
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for destination, count := range counts {
+		h.pending[destination] = count
+	}
+	return nil
+}
+
+// reset forgets the queue after the store's was deleted.
+func (h *hintStore) reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.pending = make(map[string]int)
+	h.redelivered = make(map[string]int)
+}
+
+// handoffMaxHints reads HANDOFF_MAX_HINTS, the most messages queued for one
+// destination.
+func handoffMaxHints() int {
+	if value := os.Getenv("HANDOFF_MAX_HINTS"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Invalid HANDOFF_MAX_HINTS %q, using %d", value, defaultHandoffMaxHints)
+	}
+	return defaultHandoffMaxHints
+}
+
+// Pending returns the number of hints queued for destination.
+func (h *hintStore) Pending(destination string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.pending[destination]
+}
+
+// Enqueue stores msg for destination. descendants are the nodes below the
+// destination at the time, which receive the message if it leaves the tree.
+// A full queue drops its oldest messages to make room.
+func (h *hintStore) Enqueue(destination string, descendants []string, msg MulticastMessage) error {
+	msg.WantAcks = false // Nobody is waiting for a replay
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal hinted message: %v", err)
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if err := store.AddHint(destination, descendants, string(data)); err != nil {
+		return fmt.Errorf("failed to store hinted message for node %s: %v", destination, err)
+	}
+	h.pending[destination]++
+
+	if max := handoffMaxHints(); h.pending[destination] > max {
+		dropped, err := store.TrimHints(destination, max)
+		if err != nil {
+			return fmt.Errorf("failed to trim hinted messages for node %s: %v", destination, err)
+		}
+		h.pending[destination] -= dropped
+		h.dropped += int64(dropped)
+		log.Printf("Hinted handoff queue for node %s is full, dropped the oldest %d messages", destination, dropped)
+	}
+	return nil
+}
+
+// remove deletes a delivered hint. A hint dropped from a full queue in the
+// meantime was counted then.
+func (h *hintStore) remove(id int, destination string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	removed, err := store.RemoveHint(id)
+	if err != nil {
+		return fmt.Errorf("failed to delete hinted message %d: %v", id, err)
+	}
+	if !removed {
+		return nil
+	}
+	if h.pending[destination]--; h.pending[destination] <= 0 {
+		delete(h.pending, destination)
+	}
+	return nil
+}
+
+func (h *hintStore) destinations() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	destinations := make([]string, 0, len(h.pending))
+	for destination := range h.pending {
+		destinations = append(destinations, destination)
+	}
+	sort.Strings(destinations)
+	return destinations
+}
+
+// hint is one queued message.
+type hint struct {
+	id          int
+	descendants []string
+	msg         MulticastMessage
+}
+
+// queued returns destination's hints in the order they were stored.
+func (h *hintStore) queued(destination string) ([]hint, error) {
+	records, err := store.Hints(destination)
+	if err != nil {
+		return nil, fmt.Errorf("error reading hinted messages for node %s: %v", destination, err)
+	}
+
+	var queued []hint
+	for _, record := range records {
+		q := hint{id: record.ID, descendants: record.Descendants}
+		if err := json.Unmarshal([]byte(record.Message), &q.msg); err != nil {
+			return nil, fmt.Errorf("error decoding hinted message %d: %v", q.id, err)
+		}
+		queued = append(queued, q)
+	}
+	return queued, nil
+}
+
+// replay delivers the queued hints for every destination.
+func (h *hintStore) replay(nodeID string) {
+	for _, destination := range h.destinations() {
+		if err := h.replayTo(nodeID, destination); err != nil {
+			log.Printf("Hinted handoff to node %s: %v", destination, err)
+		}
+	}
+}
+
+// replayTo delivers destination's hints in order, stopping at the first
+// failure to reach it so that later messages never overtake earlier ones.
+// A hint the destination rejects is dropped and replay moves on.
+func (h *hintStore) replayTo(nodeID string, destination string) error {
+	queued, err := h.queued(destination)
+	if err != nil {
+		return err
+	}
+
+	tree := GetGlobalTree()
+	tree.mu.RLock()
+	built := tree.Root != nil
+	tree.mu.RUnlock()
+	if !built {
+		return fmt.Errorf("spanning tree not built yet")
+	}
+	for _, q := range queued {
+		target := tree.Find(destination)
+		if target == nil {
+			// The destination left the tree, so hand the message to its orphans
+			h.reroute(nodeID, q)
+		} else if _, err := sendMulticast(target.address, q.msg); err != nil {
+			var rejected *multicastRejected
+			if !errors.As(err, &rejected) {
+				return fmt.Errorf("still unreachable, %d messages queued: %v", h.Pending(destination), err)
+			}
+			log.Printf("Node %s rejected hinted message %s, dropping it: %v", destination, q.msg.MessageID, err)
+			h.mu.Lock()
+			h.rejected++
+			h.mu.Unlock()
+		} else {
+			fmt.Printf("Replayed hinted message %s to node %s\n", q.msg.MessageID, destination)
+			h.mu.Lock()
+			h.replayed++
+			h.mu.Unlock()
+		}
+		if err := h.remove(q.id, destination); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// reroute delivers a hint for a departed destination to each of its former
+// descendants still in the tree. A descendant that cannot be reached gets a
+// hint of its own; one that rejects the message does not.
+func (h *hintStore) reroute(nodeID string, q hint) {
+	tree := GetGlobalTree()
+	for _, descendant := range q.descendants {
+		if descendant == nodeID {
+			continue
+		}
+		target := tree.Find(descendant)
+		if target == nil {
+			continue
+		}
+		if _, err := sendMulticast(target.address, q.msg); err != nil {
+			fmt.Printf("Failed to reroute hinted message to node %s: %v\n", descendant, err)
+			var rejected *multicastRejected
+			if errors.As(err, &rejected) {
+				h.mu.Lock()
+				h.rejected++
+				h.mu.Unlock()
+				continue
+			}
+			if err := h.Enqueue(descendant, nil, q.msg); err != nil {
+				log.Printf("%v", err)
+			}
+			continue
+		}
+		fmt.Printf("Rerouted hinted message %s to orphaned node %s\n", q.msg.MessageID, descendant)
+	}
+	h.mu.Lock()
+	h.rerouted++
+	h.mu.Unlock()
+}
+
+// redeliver sends the hints queued for a suspected destination, which its
+// children missed, to each orphan in order. The hints stay queued in case the
+// destination comes back. Once an orphan cannot be reached, the rest of its
+// messages are queued for it.
+func (h *hintStore) redeliver(destination string, orphans []*SpanningTreeNode) {
+	queued, err := h.queued(destination)
+	if err != nil {
+		log.Printf("Redelivering to orphans of node %s: %v", destination, err)
+		return
+	}
+
+	for _, orphan := range orphans {
+		key := destination + ">" + orphan.ID
+		h.mu.Lock()
+		last := h.redelivered[key]
+		h.mu.Unlock()
+
+		unreachable := false
+		for _, q := range queued {
+			if q.id <= last {
+				continue
+			}
+			if !unreachable {
+				if _, err := sendMulticast(orphan.address, q.msg); err != nil {
+					fmt.Printf("Failed to redeliver %s to orphan %s: %v\n", q.msg.MessageID, orphan.ID, err)
+					var rejected *multicastRejected
+					unreachable = !errors.As(err, &rejected)
+				} else {
+					orphanRedelivery.Add(1)
+				}
+			}
+			if unreachable {
+				if err := h.Enqueue(orphan.ID, subtreeIDs(orphan), q.msg); err != nil {
+					log.Printf("%v", err)
+				}
+			}
+			last = q.id
+		}
+
+		h.mu.Lock()
+		h.redelivered[key] = last
+		h.mu.Unlock()
+	}
+}
+
+// subtreeIDs returns the IDs of every node below node.
+func subtreeIDs(node *SpanningTreeNode) []string {
+	node.mu.RLock()
+	children := append([]*SpanningTreeNode(nil), node.Children...)
+	node.mu.RUnlock()
+
+	var ids []string
+	for _, child := range children {
+		if child == nil {
+			continue
+		}
+		child.mu.RLock()
+		ids = append(ids, child.ID)
+		child.mu.RUnlock()
+		ids = append(ids, subtreeIDs(child)...)
+	}
+	return ids
+}
+
+// runHandoff replays queued hints every HANDOFF_INTERVAL.
+func runHandoff(ctx context.Context, node *Node) {
+	interval := defaultHandoffInterval
+	if value := os.Getenv("HANDOFF_INTERVAL"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			interval = d
+		} else {
+			log.Printf("Invalid HANDOFF_INTERVAL %q, using %v", value, interval)
+		}
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	nodeID := os.Getenv("NODE_ID")
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			hints.replay(nodeID)
+		}
+	}
+}
+
+// writeHandoffMetrics writes the hinted handoff metrics in Prometheus text format.
+func writeHandoffMetrics(w io.Writer, nodeID int) {
+	hints.mu.Lock()
+	defer hints.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP node_hinted_handoff_pending Messages queued for an unreachable child\n")
+	fmt.Fprintf(w, "# TYPE node_hinted_handoff_pending gauge\n")
+	for destination, count := range hints.pending {
+		fmt.Fprintf(w, "node_hinted_handoff_pending{node_id=\"%d\",destination=\"%s\"} %d\n", nodeID, destination, count)
+	}
+
+	fmt.Fprintf(w, "# HELP node_hinted_handoff_delivered_total Queued messages delivered later\n")
+	fmt.Fprintf(w, "# TYPE node_hinted_handoff_delivered_total counter\n")
+	fmt.Fprintf(w, "node_hinted_handoff_delivered_total{node_id=\"%d\",via=\"destination\"} %d\n", nodeID, hints.replayed)
+	fmt.Fprintf(w, "node_hinted_handoff_delivered_total{node_id=\"%d\",via=\"orphans\"} %d\n", nodeID, hints.rerouted)
+
+	fmt.Fprintf(w, "# HELP node_hinted_handoff_dropped_total Queued messages dropped from a full queue, left to catch-up\n")
+	fmt.Fprintf(w, "# TYPE node_hinted_handoff_dropped_total counter\n")
+	fmt.Fprintf(w, "node_hinted_handoff_dropped_total{node_id=\"%d\"} %d\n", nodeID, hints.dropped)
+
+	fmt.Fprintf(w, "# HELP node_hinted_handoff_rejected_total Queued messages dropped because their destination refused them\n")
+	fmt.Fprintf(w, "# TYPE node_hinted_handoff_rejected_total counter\n")
+	fmt.Fprintf(w, "node_hinted_handoff_rejected_total{node_id=\"%d\"} %d\n", nodeID, hints.rejected)
+}
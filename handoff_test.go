@@ -0,0 +1,124 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"mymodule/consensus"
+)
+
+// withDestination points the global tree at a single node, "2", served by
+// handler, and gives the test an empty store and hint queue.
+func withDestination(t *testing.T, handler http.HandlerFunc) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	store = migrated(t, newMemoryStore())
+	hints = &hintStore{pending: make(map[string]int), redelivered: make(map[string]int)}
+
+	tree := GetGlobalTree()
+	tree.mu.Lock()
+	saved := tree.Root
+	tree.Root = &SpanningTreeNode{ID: "2", address: strings.TrimPrefix(server.URL, "http://")}
+	tree.mu.Unlock()
+	t.Cleanup(func() {
+		tree.mu.Lock()
+		tree.Root = saved
+		tree.mu.Unlock()
+	})
+}
+
+func hintFor(pid int) MulticastMessage {
+	return MulticastMessage{PID: pid, Term: 1, MessageID: fmt.Sprintf("m%d", pid), Batch: []consensus.Entry{{ID: pid, Term: 1}}}
+}
+
+func TestReplayDropsRejectedHints(t *testing.T) {
+	var mu sync.Mutex
+	var delivered []int
+	withDestination(t, func(w http.ResponseWriter, r *http.Request) {
+		var msg MulticastMessage
+		json.NewDecoder(r.Body).Decode(&msg)
+		if msg.PID == 1 {
+			http.Error(w, "Entries are from an older term", http.StatusConflict)
+			return
+		}
+		mu.Lock()
+		delivered = append(delivered, msg.PID)
+		mu.Unlock()
+	})
+
+	for pid := 1; pid <= 3; pid++ {
+		if err := hints.Enqueue("2", nil, hintFor(pid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := hints.replayTo("1", "2"); err != nil {
+		t.Fatalf("replay stopped at the rejected hint: %v", err)
+	}
+
+	if !equal(delivered, []int{2, 3}) {
+		t.Fatalf("delivered %v, want [2 3]", delivered)
+	}
+	if pending := hints.Pending("2"); pending != 0 {
+		t.Fatalf("%d hints still queued", pending)
+	}
+	if hints.rejected != 1 {
+		t.Fatalf("counted %d rejected hints, want 1", hints.rejected)
+	}
+}
+
+func TestReplayKeepsHintsWhileUnavailable(t *testing.T) {
+	withDestination(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "Node still out of sync after recovery", http.StatusInternalServerError)
+	})
+
+	for pid := 1; pid <= 2; pid++ {
+		if err := hints.Enqueue("2", nil, hintFor(pid)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := hints.replayTo("1", "2"); err == nil {
+		t.Fatal("replay succeeded against a failing destination")
+	}
+	if pending := hints.Pending("2"); pending != 2 {
+		t.Fatalf("%d hints queued, want 2", pending)
+	}
+}
+
+func TestHandOffReportsSubtree(t *testing.T) {
+	store = migrated(t, newMemoryStore())
+	hints = &hintStore{pending: make(map[string]int), redelivered: make(map[string]int)}
+	for len(pendingReports) > 0 {
+		<-pendingReports
+	}
+
+	child := &SpanningTreeNode{ID: "2"}
+	for _, id := range []string{"4", "5"} {
+		child.Children = append(child.Children, &SpanningTreeNode{ID: id, Parent: child})
+	}
+	handOff(child, subtreeIDs(child), hintFor(7))
+
+	var reported []string
+	for len(pendingReports) > 0 {
+		r := <-pendingReports
+		if r.Status != DeliveryFailed || r.To != 7 {
+			t.Fatalf("unexpected report %+v", r)
+		}
+		reported = append(reported, r.Node)
+	}
+	if !equal(reported, []string{"2", "4", "5"}) {
+		t.Fatalf("reported failures for %v, want [2 4 5]", reported)
+	}
+
+	// An empty batch is not reported, rather than panicking
+	handOff(child, nil, MulticastMessage{PID: 8})
+	if len(pendingReports) != 0 {
+		t.Fatalf("reported an empty batch")
+	}
+}
@@ -0,0 +1,529 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Latency-aware layout: with TREE_LAYOUT=latency every node probes each peer
+// on the election port once per heartbeat interval, measuring the round trip
+// time and, from a second probe carrying a payload, the throughput of the
+// link. Followers return their measurements in the reply to the leader's
+// heartbeat. The leader plans the tree that gets a write to the last node
+// soonest and sends the plan down with its heartbeats, so every node forwards
+// along the same tree. A plan only replaces the current one when membership
+// changed or it is faster by more than LATENCY_HYSTERESIS, and at most once
+// per LATENCY_REBUILD_INTERVAL, so noisy measurements do not make the tree flap.
+const (
+	probePayloadSize    = 16 << 10 // Bytes in the throughput probe
+	latencyMessageBytes = 4 << 10  // Size of a typical multicast batch, for transfer time
+	unknownLinkMillis   = 1000.0   // Cost assumed for a link nobody has measured
+	linkSmoothing       = 0.3      // Weight of a new sample in the moving average
+
+	defaultLatencyRebuildInterval = 30 * time.Second
+	defaultLatencyHysteresis      = 0.2
+)
+
+// LinkStats is what a node measured on its link to a peer.
+type LinkStats struct {
+	RTTMillis  float64 `json:"rtt_ms"`
+	Throughput float64 `json:"throughput_bps,omitempty"` // Bytes per second
+}
+
+// LinkProbe is sent on the election port to measure a link. The receiver
+// answers each probe with an empty object.
+type LinkProbe struct {
+	From    int    `json:"from"`
+	Payload string `json:"payload,omitempty"`
+}
+
+// HeartbeatAck is a follower's reply to a heartbeat, carrying its term and
+// its measurements.
+type HeartbeatAck struct {
+	Term  int               `json:"term"`
+	Links map[int]LinkStats `json:"links"`
+}
+
+// LatencyPlan is a tree laid out by the leader from measured links.
+type LatencyPlan struct {
+	Version int              `json:"version"`
+	Leader  string           `json:"leader"`
+	CostMs  float64          `json:"cost_ms"` // Time for a write to reach the last node
+	Root    SerializableNode `json:"root"`
+}
+
+// nodes returns the IDs in the plan.
+func (p *LatencyPlan) nodes() []string {
+	var ids []string
+	var walk func(n SerializableNode)
+	walk = func(n SerializableNode) {
+		ids = append(ids, n.ID)
+		for _, child := range n.Children {
+			walk(child)
+		}
+	}
+	walk(p.Root)
+	sort.Strings(ids)
+	return ids
+}
+
+// linkTable holds this node's measurements and, on the leader, every
+// follower's, along with the plan in force.
+type linkTable struct {
+	mu      sync.Mutex
+	own     map[int]LinkStats
+	reports map[int]map[int]LinkStats
+	plan    *LatencyPlan
+	planned time.Time
+	applied int64 // Plans adopted by this node as leader
+	held    int64 // Better plans held back by hysteresis
+}
+
+var links = &linkTable{
+	own:     make(map[int]LinkStats),
+	reports: make(map[int]map[int]LinkStats),
+}
+
+var (
+	layoutOnce     sync.Once
+	latencyEnabled bool
+)
+
+// latencyLayout reports whether TREE_LAYOUT selects the latency-aware tree.
+// The default, auto, lays the tree out by region or as a complete k-ary tree.
+func latencyLayout() bool {
+	layoutOnce.Do(func() {
+		switch value := os.Getenv("TREE_LAYOUT"); value {
+		case "", "auto":
+		case "latency":
+			latencyEnabled = true
+		default:
+			log.Printf("Invalid TREE_LAYOUT %q, using auto", value)
+		}
+	})
+	return latencyEnabled
+}
+
+// latencyRebuildInterval reads LATENCY_REBUILD_INTERVAL, the least time
+// between two plans for the same membership.
+func latencyRebuildInterval() time.Duration {
+	if value := os.Getenv("LATENCY_REBUILD_INTERVAL"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Invalid LATENCY_REBUILD_INTERVAL %q, using %v", value, defaultLatencyRebuildInterval)
+	}
+	return defaultLatencyRebuildInterval
+}
+
+// latencyHysteresis reads LATENCY_HYSTERESIS, the fraction by which a new plan
+// must beat the current one to replace it.
+func latencyHysteresis() float64 {
+	if value := os.Getenv("LATENCY_HYSTERESIS"); value != "" {
+		if h, err := strconv.ParseFloat(value, 64); err == nil && h >= 0 && h < 1 {
+			return h
+		}
+		log.Printf("Invalid LATENCY_HYSTERESIS %q, using %g", value, defaultLatencyHysteresis)
+	}
+	return defaultLatencyHysteresis
+}
+
+// smooth folds sample into the moving average old.
+func smooth(old, sample float64) float64 {
+	if old == 0 {
+		return sample
+	}
+	return old + linkSmoothing*(sample-old)
+}
+
+// observe records a measurement of the link to peer. A zero throughput
+// leaves the previous estimate in place.
+func (t *linkTable) observe(peer int, rtt time.Duration, throughput float64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	stats := t.own[peer]
+	stats.RTTMillis = smooth(stats.RTTMillis, float64(rtt)/float64(time.Millisecond))
+	if throughput > 0 {
+		stats.Throughput = smooth(stats.Throughput, throughput)
+	}
+	t.own[peer] = stats
+}
+
+// snapshot returns a copy of this node's measurements.
+func (t *linkTable) snapshot() map[int]LinkStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	own := make(map[int]LinkStats, len(t.own))
+	for peer, stats := range t.own {
+		own[peer] = stats
+	}
+	return own
+}
+
+// recordReport stores the measurements a follower returned with a heartbeat.
+func (t *linkTable) recordReport(from int, measured map[int]LinkStats) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.reports[from] = measured
+}
+
+// currentPlan returns the plan in force, or nil.
+func (t *linkTable) currentPlan() *LatencyPlan {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.plan
+}
+
+// weights returns the one-way cost in milliseconds of sending a batch over
+// each link, from self's and the followers' measurements. Both ends' views
+// of a link are averaged.
+func (t *linkTable) weights(self int) func(a, b int) float64 {
+	t.mu.Lock()
+	measured := make(map[int]map[int]LinkStats, len(t.reports)+1)
+	for from, stats := range t.reports {
+		measured[from] = stats
+	}
+	own := make(map[int]LinkStats, len(t.own))
+	for peer, stats := range t.own {
+		own[peer] = stats
+	}
+	measured[self] = own
+	t.mu.Unlock()
+
+	return func(a, b int) float64 {
+		var rtt, throughput float64
+		var rtts, throughputs int
+		for _, s := range []LinkStats{measured[a][b], measured[b][a]} {
+			if s.RTTMillis > 0 {
+				rtt += s.RTTMillis
+				rtts++
+			}
+			if s.Throughput > 0 {
+				throughput += s.Throughput
+				throughputs++
+			}
+		}
+		if rtts == 0 {
+			return unknownLinkMillis
+		}
+		cost := rtt / float64(rtts) / 2
+		if throughputs > 0 {
+			cost += latencyMessageBytes / (throughput / float64(throughputs)) * 1000
+		}
+		return cost
+	}
+}
+
+// planLatencyTree grows a tree from leader, each step attaching the node
+// that can be reached soonest through a node with fewer than k children.
+// It returns each node's children and the time for a write to reach the
+// last node.
+func planLatencyTree(leader int, others []int, k int, weight func(a, b int) float64) (map[int][]int, float64) {
+	children := make(map[int][]int)
+	arrival := map[int]float64{leader: 0}
+	inTree := []int{leader}
+	remaining := append([]int(nil), others...)
+	sort.Ints(remaining)
+
+	var cost float64
+	for len(remaining) > 0 {
+		bestParent, bestIndex, best := 0, -1, math.Inf(1)
+		for _, u := range inTree {
+			if len(children[u]) >= k {
+				continue
+			}
+			for i, v := range remaining {
+				if at := arrival[u] + weight(u, v); at < best {
+					bestParent, bestIndex, best = u, i, at
+				}
+			}
+		}
+		v := remaining[bestIndex]
+		remaining = append(remaining[:bestIndex], remaining[bestIndex+1:]...)
+		children[bestParent] = append(children[bestParent], v)
+		arrival[v] = best
+		inTree = append(inTree, v)
+		cost = math.Max(cost, best)
+	}
+	return children, cost
+}
+
+// planCost is the time for a write to reach the last node of plan with the
+// current measurements.
+func planCost(root SerializableNode, weight func(a, b int) float64) float64 {
+	var cost float64
+	var walk func(n SerializableNode, at float64)
+	walk = func(n SerializableNode, at float64) {
+		cost = math.Max(cost, at)
+		from, _ := strconv.Atoi(n.ID)
+		for _, child := range n.Children {
+			to, _ := strconv.Atoi(child.ID)
+			walk(child, at+weight(from, to))
+		}
+	}
+	walk(root, 0)
+	return cost
+}
+
+// serializePlan turns a planned tree into the form sent with heartbeats.
+func serializePlan(id int, parent string, children map[int][]int, members map[string]*MemberInfo1) SerializableNode {
+	key := strconv.Itoa(id)
+	node := SerializableNode{ID: key, Address: members[key].Address, ParentID: parent}
+	for _, child := range children[id] {
+		node.Children = append(node.Children, serializePlan(child, key, children, members))
+	}
+	return node
+}
+
+// planFor returns the plan in force if it covers exactly members and was made
+// by leaderID, or nil so the tree falls back to the membership layout.
+func planFor(members map[string]*MemberInfo1, leaderID string) *LatencyPlan {
+	if !latencyLayout() {
+		return nil
+	}
+	plan := links.currentPlan()
+	if plan == nil || plan.Leader != leaderID {
+		return nil
+	}
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	if strings.Join(ids, ",") != strings.Join(plan.nodes(), ",") {
+		return nil
+	}
+	return plan
+}
+
+// installPlan adopts a plan received from the leader.
+func installPlan(plan *LatencyPlan) {
+	links.mu.Lock()
+	current := links.plan
+	if current != nil && current.Version == plan.Version && current.Leader == plan.Leader {
+		links.mu.Unlock()
+		return
+	}
+	links.plan = plan
+	links.mu.Unlock()
+
+	GetGlobalTree().Install(plan)
+	fmt.Printf("Installed latency plan %d from leader %s (%.1fms)\n", plan.Version, plan.Leader, plan.CostMs)
+}
+
+// runLatencyTree plans the tree on the leader from the measured links.
+func runLatencyTree(ctx context.Context, node *Node) {
+	if !latencyLayout() {
+		return
+	}
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !node.core.IsLeader() {
+			continue
+		}
+
+		members, err := getMembershipList(node.membershipHost)
+		if err != nil || members[strconv.Itoa(node.ID)] == nil {
+			continue
+		}
+		var others []int
+		for id := range members {
+			if peer, err := strconv.Atoi(id); err == nil && peer != node.ID {
+				others = append(others, peer)
+			}
+		}
+
+		weight := links.weights(node.ID)
+		children, cost := planLatencyTree(node.ID, others, treeFanout(), weight)
+		self := strconv.Itoa(node.ID)
+		candidate := &LatencyPlan{
+			Leader: self,
+			CostMs: cost,
+			Root:   serializePlan(node.ID, "", children, members),
+		}
+
+		stale := planFor(members, self) == nil
+
+		links.mu.Lock()
+		current := links.plan
+		adopt := current == nil || stale
+		if !adopt && time.Since(links.planned) >= latencyRebuildInterval() {
+			currentCost := planCost(current.Root, weight)
+			if cost < currentCost*(1-latencyHysteresis()) {
+				adopt = true
+			} else if cost < currentCost {
+				links.held++
+			}
+		}
+		if adopt {
+			candidate.Version = 1
+			if current != nil {
+				candidate.Version = current.Version + 1
+			}
+			links.plan = candidate
+			links.planned = time.Now()
+			links.applied++
+		}
+		links.mu.Unlock()
+
+		if adopt {
+			GetGlobalTree().Install(candidate)
+			log.Printf("Node %d: Adopted latency plan %d (%.1fms to the last node)", node.ID, candidate.Version, cost)
+		}
+	}
+}
+
+// runLinkProbes measures the links to every active peer once per heartbeat interval.
+func runLinkProbes(ctx context.Context, node *Node) {
+	if !latencyLayout() {
+		return
+	}
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		var wg sync.WaitGroup
+		for peer, active := range node.core.Status().Active {
+			if !active || peer == node.ID {
+				continue
+			}
+			wg.Add(1)
+			go func(peer int) {
+				defer wg.Done()
+				if err := probeLink(node.ID, peer); err != nil {
+					fmt.Printf("Node %d: Failed to probe Node %d: %v\n", node.ID, peer, err)
+				}
+			}(peer)
+		}
+		wg.Wait()
+	}
+}
+
+// probeLink sends an empty probe to peer for the round trip time, then one
+// carrying probePayloadSize bytes; the extra time the second takes gives the
+// link's throughput.
+func probeLink(self, peer int) error {
+	conn, err := dialTCP(fmt.Sprintf("node-%d:%d", peer, basePort+peer), time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+
+	encoder, decoder := json.NewEncoder(conn), json.NewDecoder(conn)
+	roundTrip := func(probe LinkProbe) (time.Duration, error) {
+		start := time.Now()
+		if err := encoder.Encode(Message{Type: "Ping", Ping: probe}); err != nil {
+			return 0, err
+		}
+		var pong struct{}
+		if err := decoder.Decode(&pong); err != nil {
+			return 0, err
+		}
+		return time.Since(start), nil
+	}
+
+	rtt, err := roundTrip(LinkProbe{From: self})
+	if err != nil {
+		return err
+	}
+	loaded, err := roundTrip(LinkProbe{From: self, Payload: strings.Repeat("x", probePayloadSize)})
+	if err != nil {
+		links.observe(peer, rtt, 0)
+		return err
+	}
+
+	var throughput float64
+	if extra := loaded - rtt; extra > 0 {
+		throughput = probePayloadSize / extra.Seconds()
+	}
+	links.observe(peer, rtt, throughput)
+	return nil
+}
+
+// answerProbes replies to the probe already read from decoder and to any
+// that follow on the same connection.
+func answerProbes(conn io.Writer, decoder *json.Decoder, sender int) {
+	encoder := json.NewEncoder(conn)
+	for {
+		if err := encoder.Encode(struct{}{}); err != nil {
+			return
+		}
+		var msg Message
+		if err := decoder.Decode(&msg); err != nil || msg.Type != "Ping" || msg.Ping.From != sender {
+			return
+		}
+	}
+}
+
+// writeLatencyMetrics writes the measured links and the plan in Prometheus text format.
+func writeLatencyMetrics(w io.Writer, nodeID int) {
+	if !latencyLayout() {
+		return
+	}
+	own := links.snapshot()
+	peers := make([]int, 0, len(own))
+	for peer := range own {
+		peers = append(peers, peer)
+	}
+	sort.Ints(peers)
+
+	fmt.Fprintf(w, "# HELP node_link_rtt_seconds Smoothed round trip time to a peer\n")
+	fmt.Fprintf(w, "# TYPE node_link_rtt_seconds gauge\n")
+	for _, peer := range peers {
+		fmt.Fprintf(w, "node_link_rtt_seconds{node_id=\"%d\",peer=\"%d\"} %g\n", nodeID, peer, own[peer].RTTMillis/1000)
+	}
+
+	fmt.Fprintf(w, "# HELP node_link_throughput_bytes Smoothed throughput to a peer in bytes per second\n")
+	fmt.Fprintf(w, "# TYPE node_link_throughput_bytes gauge\n")
+	for _, peer := range peers {
+		fmt.Fprintf(w, "node_link_throughput_bytes{node_id=\"%d\",peer=\"%d\"} %g\n", nodeID, peer, own[peer].Throughput)
+	}
+
+	links.mu.Lock()
+	var version int
+	var cost float64
+	if links.plan != nil {
+		version, cost = links.plan.Version, links.plan.CostMs
+	}
+	applied, held := links.applied, links.held
+	links.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP node_tree_plan_version Version of the latency plan in force\n")
+	fmt.Fprintf(w, "# TYPE node_tree_plan_version gauge\n")
+	fmt.Fprintf(w, "node_tree_plan_version{node_id=\"%d\"} %d\n", nodeID, version)
+
+	fmt.Fprintf(w, "# HELP node_tree_plan_cost_seconds Planned time for a write to reach the last node\n")
+	fmt.Fprintf(w, "# TYPE node_tree_plan_cost_seconds gauge\n")
+	fmt.Fprintf(w, "node_tree_plan_cost_seconds{node_id=\"%d\"} %g\n", nodeID, cost/1000)
+
+	fmt.Fprintf(w, "# HELP node_tree_plans_total Latency plans made as leader, by whether they replaced the tree\n")
+	fmt.Fprintf(w, "# TYPE node_tree_plans_total counter\n")
+	fmt.Fprintf(w, "node_tree_plans_total{node_id=\"%d\",result=\"applied\"} %d\n", nodeID, applied)
+	fmt.Fprintf(w, "node_tree_plans_total{node_id=\"%d\",result=\"held\"} %d\n", nodeID, held)
+}
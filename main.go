@@ -2,16 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
-	"math/rand"
 	"net"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+
+	"mymodule/consensus"
 )
 
 const (
@@ -19,35 +26,57 @@ const (
 	httpPort          = 8080
 	heartbeatInterval = 2 * time.Second
 	leaderTimeout     = 4 * time.Second
+	drainTimeout      = multicastTimeout + 2*time.Second // Upper bound on waiting for in-flight multicasts
+	serverStopTimeout = 5 * time.Second
+)
+
+// NodeRole describes how a node takes part in elections and replication.
+type NodeRole = consensus.Role
+
+const (
+	RoleVoter   = consensus.RoleVoter
+	RoleLearner = consensus.RoleLearner
+	RoleWitness = consensus.RoleWitness
 )
 
+// currentRole returns the role this node was started with.
+func currentRole() NodeRole {
+	return consensus.ParseRole(os.Getenv("NODE_ROLE"))
+}
+
+// storesTable reports whether this node applies writes to the given table.
+// Witnesses keep the cluster configuration and the schema but never user data.
+func storesTable(table string) bool {
+	return currentRole() != RoleWitness || table == configTable || table == schemaTable
+}
+
+// Node wires the election and replication rules in package consensus to
+// this process's TCP listener, HTTP server and Postgres database.
 type Node struct {
-	ID              int
-	Leader          bool
-	lastKnownLeader int
-	mutex           sync.RWMutex
-	activeNodes     map[int]bool
-	votes           map[int]bool
-	term            int
-	address         string
-	membershipHost  string
+	ID             int
+	core           *consensus.Node
+	mutex          sync.RWMutex
+	config         *ClusterConfig // Latest committed voter configuration, nil before bootstrap
+	address        string
+	membershipHost string
 }
 
 type MemberInfo1 struct {
 	ID        string    `json:"id"`
 	Address   string    `json:"address"`
+	Role      string    `json:"role,omitempty"`
+	Region    string    `json:"region,omitempty"`
 	LeaseID   int64     `json:"lease_id"`
 	ExpiresAt time.Time `json:"expires_at"`
 	IsLeader  bool      `json:"is_leader"`
 }
 
 type Message struct {
-	Type        string      // "VoteRequest" or "Heartbeat"
-	VoteRequest VoteRequest // Used if Type is "VoteRequest"
-	Heartbeat   struct {    // Used if Type is "Heartbeat"
-		Term   int
-		Leader int
-	}
+	Type        string                // "VoteRequest", "Heartbeat" or "Ping"
+	VoteRequest consensus.VoteRequest // Used if Type is "VoteRequest"
+	Heartbeat   consensus.Heartbeat   // Used if Type is "Heartbeat"
+	Plan        *LatencyPlan          // The leader's latency plan, sent with heartbeats
+	Ping        LinkProbe             // Used if Type is "Ping"
 }
 
 type SpanningTreeNode struct {
@@ -59,25 +88,25 @@ type SpanningTreeNode struct {
 }
 
 type SpanningTree struct {
-	Root *SpanningTreeNode
-	mu   sync.RWMutex
-}
-
-type VoteRequest struct {
-	CandidateID int
-	Term        int
-}
-
-type VoteResponse struct {
-	VoteGranted bool
-	Term        int
+	Root      *SpanningTreeNode
+	Fanout    int                     // Children per node, see tree.go
+	Regions   map[string]string       // Node ID to region when laid out by region, otherwise nil
+	Plan      int                     // Version of the leader's latency plan the tree follows, 0 otherwise
+	Version   int                     // Bumped on every change to the tree's shape
+	Epoch     int                     // Leader's epoch for this tree, see epoch.go
+	EpochTerm int                     // Leader's term when it published Epoch
+	published int                     // Version last published or adopted under Epoch
+	members   map[string]*MemberInfo1 // Members the tree was derived from, nil if adopted
+	leader    string                  // Leader expected at the root, empty if unknown
+	mu        sync.RWMutex
 }
 
 func InitGlobalTree() {
 	treeOnce.Do(func() {
 		globalTree = &SpanningTree{
-			Root: nil,
-			mu:   sync.RWMutex{},
+			Root:   nil,
+			Fanout: treeFanout(),
+			mu:     sync.RWMutex{},
 		}
 	})
 }
@@ -89,12 +118,9 @@ func GetGlobalTree() *SpanningTree {
 }
 
 var (
-	lastHeartbeat      time.Time
-	heartbeatMutex     sync.RWMutex
-	globalTree         *SpanningTree
-	treeOnce           sync.Once
-	prevMembershipList []string
-	recovery           bool
+	globalTree *SpanningTree
+	treeOnce   sync.Once
+	draining   atomic.Bool // Set once shutdown starts; new writes are refused
 )
 
 func main() {
@@ -103,89 +129,160 @@ func main() {
 
 	node := &Node{
 		ID:             nodeID,
-		activeNodes:    make(map[int]bool),
-		votes:          make(map[int]bool),
-		term:           0,
 		address:        fmt.Sprintf("node-%d:8080", nodeID),
 		membershipHost: membershipHost,
 	}
+	configNode = node
+	node.core = consensus.NewNode(consensus.Options{
+		ID:                nodeID,
+		Role:              currentRole(),
+		Transport:         &nodeTransport{nodeID: nodeID},
+		Clock:             consensus.SystemClock{},
+		Storage:           nodeStorage{},
+		HeartbeatInterval: heartbeatInterval,
+		LeaderTimeout:     leaderTimeout,
+		ReorderTimeout:    reorderTimeout(),
+	})
 
-	err := initDB()
+	var err error
+	store, err = openStore()
 	if err != nil {
-		log.Fatalf("Failed to initialize database: %v", err)
+		log.Fatalf("Failed to open %s store: %v", storeBackend(), err)
 	}
-	defer db.Close()
+	if err := hints.load(); err != nil {
+		log.Fatalf("Failed to load hinted handoff queue: %v", err)
+	}
+	startWriteBatcher(node.core)
 
 	// Register with membership service
 	if err := registerWithMembership(node); err != nil {
 		log.Fatal(err)
 	}
 
-	go listenForHeartbeats(node)
-	go startHTTPServer(node)
+	// stop is cancelled by SIGTERM/SIGINT; ctx is cancelled once draining is done
+	stop, stopSignals := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stopSignals()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	var workers sync.WaitGroup
+	runWorker := func(fn func(context.Context, *Node)) {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			fn(ctx, node)
+		}()
+	}
+
+	runWorker(listenForHeartbeats)
+	runWorker(startHTTPServer)
 
 	// Monitor membership changes and update active nodes list dynamically
-	go monitorMembershipChanges(node)
+	runWorker(monitorMembershipChanges)
+
+	runWorker(sendHeartbeatToMembership)
+
+	// Pull entries missed while no new writes arrive to expose the gap
+	runWorker(runAntiEntropy)
 
-	go sendHeartbeatToMembership(node)
+	// Replay multicasts that children missed while unreachable
+	runWorker(runHandoff)
 
-	time.Sleep(5 * time.Second)
+	// Tell the leader which writes this node applied
+	runWorker(runDeliveryReports)
 
-	if !discoverExistingLeader(node) {
-		startElection(node)
-		recovery = false
-	} else {
-		recovery = true
-		tree := GetGlobalTree()
+	// Measure links and, as leader, plan the tree from them
+	runWorker(runLinkProbes)
+	runWorker(runLatencyTree)
 
-		lastProcessedID, err := getLastProcessedID()
+	// Find failed children in the tree even when no writes flow
+	runWorker(runEdgeHeartbeats)
+
+	select {
+	case <-time.After(5 * time.Second):
+	case <-stop.Done():
+		shutdown(node, cancel, &workers)
+		return
+	}
+
+	if discoverExistingLeader(node) {
+		lastProcessedID, err := store.LastLogID()
 		if err != nil {
 			log.Fatalf("Error reading last processed ID: %v\n", err)
 		}
 
 		fmt.Printf("Node starting with last processed ID %d\n", lastProcessedID)
 
-		mem_list, _ := getMembershipList(membershipHost)
-		leader, _ := GetLeaderNode(mem_list) // Replace with actual leader address
-		fmt.Printf("leader : %d", leader.ID)
-		tError := ConstructSpanningTree(tree, mem_list, leader.ID)
-		if tError != nil {
-			fmt.Printf("Error retrieving tree post recovery")
-		}
-		logs, err := requestMissingLogs(leader.Address, lastProcessedID)
-		if err != nil {
-			log.Fatalf("Error requesting missing logs: %v\n", err)
+		// The tree is computed from membership, so a recovering node needs nothing from the leader for it
+		if members, err := getMembershipList(membershipHost); err == nil {
+			if leader, err := GetLeaderNode(members); err == nil {
+				GetGlobalTree().Rebuild(members, leader.ID)
+			}
 		}
-
-		err = applyLogs(logs)
-		if err != nil {
-			log.Fatalf("Error applying logs: %v\n", err)
+		applied, err := node.core.CatchUp()
+		if err != nil && err != consensus.ErrNoLeader {
+			log.Fatalf("Error catching up with leader: %v\n", err)
 		}
 
-		fmt.Println("Node synchronized successfully.")
+		fmt.Printf("Node synchronized successfully (%d entries applied).\n", applied)
 	}
 
 	for {
-		if !isLeaderActive() {
-			startElection(node)
-		} else {
-			recognizeLeader(node)
+		wait := node.core.Tick()
+
+		if node.core.IsLeader() {
+			node.mutex.RLock()
+			hasConfig := node.config != nil
+			node.mutex.RUnlock()
+			if !hasConfig {
+				go bootstrapClusterConfig(node)
+			}
+			if needsMigration(node) {
+				go migrateCluster(node)
+			}
 		}
 
-		node.mutex.RLock()
-		isLeader := node.Leader
-		node.mutex.RUnlock()
-
-		if isLeader {
-			sendHeartbeats(node)
+		select {
+		case <-time.After(wait):
+		case <-stop.Done():
+			shutdown(node, cancel, &workers)
+			return
 		}
+	}
+}
+
+// shutdown drains the node before it exits. The election loop has already
+// stopped, so a leader cannot win again while it is handing over.
+//  1. Refuse new writes and wait for in-flight multicasts to reach the tree
+//  2. Give up leadership and deregister, so peers elect a new leader
+//  3. Stop the background loops and servers, then close the database
+func shutdown(node *Node, cancel context.CancelFunc, workers *sync.WaitGroup) {
+	log.Printf("Node %d: Shutting down", node.ID)
+	draining.Store(true)
 
-		time.Sleep(heartbeatInterval)
+	if !drainMulticasts(drainTimeout) {
+		log.Printf("Node %d: Gave up waiting for %d in-flight multicasts", node.ID, inflightMulticasts.Load())
 	}
+
+	if node.core.IsLeader() {
+		log.Printf("Node %d: Relinquishing leadership", node.ID)
+	}
+	node.core.StepDown()
+
+	if err := deregisterFromMembership(node); err != nil {
+		log.Printf("Node %d: Failed to deregister: %v", node.ID, err)
+	}
+
+	cancel()
+	workers.Wait()
+
+	if err := store.Close(); err != nil {
+		log.Printf("Node %d: Error closing %s store: %v", node.ID, store.Name(), err)
+	}
+	log.Printf("Node %d: Shutdown complete", node.ID)
 }
 
 func getMembershipList(membershipHost string) (map[string]*MemberInfo1, error) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/members", membershipHost))
+	resp, err := newHTTPClient(0).Get(fmt.Sprintf("%s://%s/members", urlScheme(), membershipHost))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get members: %v", err)
 	}
@@ -211,15 +308,19 @@ func registerWithMembership(node *Node) error {
 	info := struct {
 		ID      string `json:"id"`
 		Address string `json:"address"`
+		Role    string `json:"role"`
+		Region  string `json:"region,omitempty"`
 	}{
 		ID:      strconv.Itoa(node.ID),
 		Address: node.address,
+		Role:    string(node.core.Role()),
+		Region:  os.Getenv("NODE_REGION"),
 	}
 
 	body, _ := json.Marshal(info)
 
-	_, err := http.Post(
-		fmt.Sprintf("http://%s/register", node.membershipHost),
+	_, err := newHTTPClient(0).Post(
+		fmt.Sprintf("%s://%s/register", urlScheme(), node.membershipHost),
 		"application/json",
 		bytes.NewBuffer(body),
 	)
@@ -227,10 +328,38 @@ func registerWithMembership(node *Node) error {
 	return err
 }
 
-func sendHeartbeatToMembership(node *Node) {
+// deregisterFromMembership removes this node from the membership list right
+// away instead of waiting for its lease to expire.
+func deregisterFromMembership(node *Node) error {
+	body, _ := json.Marshal(map[string]string{"id": strconv.Itoa(node.ID)})
+
+	resp, err := newHTTPClient(httpTimeout).Post(
+		fmt.Sprintf("%s://%s/deregister", urlScheme(), node.membershipHost),
+		"application/json",
+		bytes.NewBuffer(body),
+	)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("deregister failed with status: %s", resp.Status)
+	}
+	return nil
+}
+
+func sendHeartbeatToMembership(ctx context.Context, node *Node) {
 	// Send periodic heartbeats to the membership service to indicate this node is alive.
 	ticker := time.NewTicker(heartbeatInterval)
-	for range ticker.C {
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
 		info := struct {
 			ID       string `json:"id"`
 			Address  string `json:"address"`
@@ -238,118 +367,130 @@ func sendHeartbeatToMembership(node *Node) {
 		}{
 			ID:       strconv.Itoa(node.ID),
 			Address:  node.address,
-			IsLeader: node.Leader,
+			IsLeader: node.core.IsLeader(),
 		}
 		body, _ := json.Marshal(info)
-		http.Post(
-			fmt.Sprintf("http://%s/keepalive", node.membershipHost),
+		resp, err := newHTTPClient(0).Post(
+			fmt.Sprintf("%s://%s/keepalive", urlScheme(), node.membershipHost),
 			"application/json",
 			bytes.NewBuffer(body),
 		)
+		if err == nil {
+			resp.Body.Close()
+		}
 	}
 }
 
-func startElection(node *Node) {
-	time.Sleep(time.Duration(150+rand.Intn(150)) * time.Millisecond)
+// nodeTransport carries consensus messages over the node's TCP listener
+// and HTTP endpoints.
+type nodeTransport struct {
+	nodeID int
+}
 
-	node.mutex.Lock()
+// RequestVote asks a peer for its vote over the election port.
+func (t *nodeTransport) RequestVote(to int, req consensus.VoteRequest) (consensus.VoteResponse, error) {
+	var response consensus.VoteResponse
 
-	if node.lastKnownLeader > 0 && node.activeNodes[node.lastKnownLeader] {
-		node.mutex.Unlock()
-		return
+	conn, err := dialTCP(fmt.Sprintf("node-%d:%d", to, basePort+to), time.Second)
+	if err != nil {
+		return response, err
 	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
 
-	if time.Since(lastHeartbeat) < leaderTimeout {
-		node.mutex.Unlock()
-		return
+	msg := Message{
+		Type:        "VoteRequest",
+		VoteRequest: req,
 	}
 
-	for i := 1; i < node.ID; i++ {
-		if node.activeNodes[i] {
-			node.mutex.Unlock()
-			return
-		}
+	if err := json.NewEncoder(conn).Encode(msg); err != nil {
+		return response, err
 	}
-
-	node.term++
-	currentTerm := node.term
-
-	node.votes = make(map[int]bool)
-	node.votes[node.ID] = true
-
-	node.mutex.Unlock()
-
-	votes := 1
-
-	votingComplete := make(chan bool)
-
-	go func() {
-		time.Sleep(2 * time.Second)
-		votingComplete <- true
-	}()
-
-	for id := range node.activeNodes {
-		if id != node.ID {
-			go func(targetID int) {
-				if requestVote(node, targetID, currentTerm) {
-					node.mutex.Lock()
-					node.votes[targetID] = true
-					votes++
-					if votes >= len(node.activeNodes)/2+1 && !node.Leader {
-						node.Leader = true
-						node.lastKnownLeader = node.ID
-						updateLastHeartbeat()
-						votingComplete <- true
-					}
-					node.mutex.Unlock()
-				}
-			}(id)
-		}
+	if err := json.NewDecoder(conn).Decode(&response); err != nil {
+		return response, err
 	}
-
-	<-votingComplete
+	return response, nil
 }
 
-func requestVote(node *Node, targetID, term int) bool {
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("node-%d:%d", targetID, basePort+targetID), time.Second)
+// SendHeartbeat asserts leadership to a peer over the election port and
+// returns the peer's term from its reply.
+func (t *nodeTransport) SendHeartbeat(to int, hb consensus.Heartbeat) (consensus.HeartbeatResponse, error) {
+	var response consensus.HeartbeatResponse
+
+	conn, err := dialTCP(fmt.Sprintf("node-%d:%d", to, basePort+to), time.Second)
 	if err != nil {
-		return false
+		return response, err
 	}
 	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
 
 	msg := Message{
-		Type: "VoteRequest",
-		VoteRequest: VoteRequest{
-			CandidateID: node.ID,
-			Term:        term,
-		},
+		Type:      "Heartbeat",
+		Heartbeat: hb,
+	}
+	if latencyLayout() {
+		msg.Plan = links.currentPlan()
+	}
+	if err := json.NewEncoder(conn).Encode(msg); err != nil {
+		return response, err
 	}
 
-	encoder := json.NewEncoder(conn)
-	if err := encoder.Encode(msg); err != nil {
-		return false
+	fmt.Printf("Node %d: Sent heartbeat to Node %d (Term: %d)\n", t.nodeID, to, hb.Term)
+
+	// Older nodes close the connection without replying
+	var ack HeartbeatAck
+	if err := json.NewDecoder(conn).Decode(&ack); err == nil {
+		links.recordReport(to, ack.Links)
+		response.Term = ack.Term
 	}
+	return response, nil
+}
 
-	var response VoteResponse
-	decoder := json.NewDecoder(conn)
-	if err := decoder.Decode(&response); err != nil {
-		return false
+// FetchEntries pulls a node's log entries after afterID from its /logs endpoint.
+func (t *nodeTransport) FetchEntries(from int, afterID int) ([]consensus.Entry, error) {
+	var logs []map[string]interface{}
+	var err error
+	for i := 0; i < maxRetries; i++ {
+		logs, err = requestMissingLogs(fmt.Sprintf("node-%d:%d", from, httpPort), afterID)
+		if err == nil {
+			return logsToEntries(logs), nil
+		}
+		fmt.Printf("Attempt %d: Failed to request missing logs: %v\n", i+1, err)
+		time.Sleep(retryDelay)
 	}
+	return nil, err
+}
+
+// LogSummary fetches a node's log summary for anti-entropy.
+func (t *nodeTransport) LogSummary(from int, upTo int) (consensus.LogSummary, error) {
+	return requestLogSummary(fmt.Sprintf("node-%d:%d", from, httpPort), upTo)
+}
 
-	return response.VoteGranted
+// Broadcast multicasts an entry down the spanning tree.
+func (t *nodeTransport) Broadcast(entry consensus.Entry) error {
+	_, err := replicate([]consensus.Entry{entry}, strconv.Itoa(t.nodeID), nil)
+	return err
 }
 
-func listenForHeartbeats(node *Node) {
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", basePort+node.ID))
+func listenForHeartbeats(ctx context.Context, node *Node) {
+	listener, err := listenTCP(fmt.Sprintf(":%d", basePort+node.ID))
 	if err != nil {
 		log.Printf("Error starting listener: %v\n", err)
 		return
 	}
-	defer listener.Close()
+
+	// Closing the listener unblocks Accept
+	go func() {
+		<-ctx.Done()
+		listener.Close()
+	}()
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			continue
 		}
 
@@ -366,44 +507,51 @@ func handleConnection(node *Node, conn net.Conn) {
 		return
 	}
 
-	node.mutex.Lock()
-	defer node.mutex.Unlock()
+	// With mutual TLS the sender must hold the certificate of the node it claims to be
+	state := connState(conn)
+	sender := msg.VoteRequest.CandidateID
+	switch msg.Type {
+	case "Heartbeat":
+		sender = msg.Heartbeat.Leader
+	case "Ping":
+		sender = msg.Ping.From
+	}
+	if !peerIsNode(state, strconv.Itoa(sender)) {
+		log.Printf("Node %d: Rejecting %s claiming to be from Node %d", node.ID, msg.Type, sender)
+		return
+	}
 
 	switch msg.Type {
 	case "VoteRequest":
-		response := VoteResponse{
-			VoteGranted: false,
-			Term:        node.term,
-		}
-
-		if msg.VoteRequest.Term > node.term ||
-			(msg.VoteRequest.Term == node.term &&
-				msg.VoteRequest.CandidateID < node.ID) {
-			response.VoteGranted = true
-			node.term = msg.VoteRequest.Term
-			node.Leader = false
-			node.lastKnownLeader = msg.VoteRequest.CandidateID
-			updateLastHeartbeat()
-		}
-
-		encoder := json.NewEncoder(conn)
-		encoder.Encode(response)
+		// Non-voting learners follow the cluster but never take part in elections
+		response := node.core.HandleVoteRequest(msg.VoteRequest)
+		json.NewEncoder(conn).Encode(response)
 
 	case "Heartbeat":
-		// Update term and leader if heartbeat is from current or newer term
-		if msg.Heartbeat.Term >= node.term {
-			node.term = msg.Heartbeat.Term
-			node.Leader = false // This node is definitely not the leader
-			node.lastKnownLeader = msg.Heartbeat.Leader
-			updateLastHeartbeat()
+		response := node.core.HandleHeartbeat(msg.Heartbeat)
+		if msg.Plan != nil && node.core.LeaderID() == msg.Heartbeat.Leader {
+			installPlan(msg.Plan)
 		}
+		// The reply carries this node's term, which deposes a stale leader, and
+		// its link measurements for the leader's plan
+		json.NewEncoder(conn).Encode(HeartbeatAck{Term: response.Term, Links: links.snapshot()})
+
+	case "Ping":
+		answerProbes(conn, decoder, sender)
 	}
 }
 
-func monitorMembershipChanges(node *Node) {
+func monitorMembershipChanges(ctx context.Context, node *Node) {
 	ticker := time.NewTicker(heartbeatInterval)
-	for range ticker.C {
-		resp, err := http.Get(fmt.Sprintf("http://%s/members", node.membershipHost))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		resp, err := newHTTPClient(0).Get(fmt.Sprintf("%s://%s/members", urlScheme(), node.membershipHost))
 		if err != nil {
 			continue
 		}
@@ -417,46 +565,17 @@ func monitorMembershipChanges(node *Node) {
 
 		resp.Body.Close()
 
-		node.mutex.Lock()
-
-		for k := range node.activeNodes {
-			delete(node.activeNodes, k)
-		}
-
+		view := make(map[int]consensus.Member, len(members))
 		for id, member := range members {
 			nodeID, _ := strconv.Atoi(id)
-			node.activeNodes[nodeID] = true
-
-			if member.IsLeader {
-				node.lastKnownLeader = nodeID
+			view[nodeID] = consensus.Member{
+				Role:     consensus.ParseRole(member.Role),
+				IsLeader: member.IsLeader,
 			}
 		}
+		node.core.SetMembers(view)
 
-		node.mutex.Unlock()
-	}
-}
-
-func recognizeLeader(node *Node) {
-	node.mutex.Lock()
-	defer node.mutex.Unlock()
-
-	activeCount := 0
-	for _, active := range node.activeNodes {
-		if active {
-			activeCount++
-		}
-	}
-
-	// Calculate quorum size dynamically
-	quorumSize := (activeCount / 2) + 1
-
-	if activeCount < quorumSize {
-		node.Leader = false
-		return
-	}
-
-	if node.lastKnownLeader > 0 && node.activeNodes[node.lastKnownLeader] {
-		node.Leader = (node.ID == node.lastKnownLeader)
+		refreshClusterConfig(node)
 	}
 }
 
@@ -467,17 +586,16 @@ func boolToInt(b bool) int {
 	return 0
 }
 
-func startHTTPServer(node *Node) {
+func startHTTPServer(ctx context.Context, node *Node) {
 	http.HandleFunc("/leader", func(w http.ResponseWriter, r *http.Request) {
-		node.mutex.RLock()
-		defer node.mutex.RUnlock()
-		fmt.Fprintf(w, "Current leader: Node %d (Term: %d)\n", node.lastKnownLeader, node.term)
+		status := node.core.Status()
+		fmt.Fprintf(w, "Current leader: Node %d (Term: %d)\n", status.LeaderID, status.Term)
 	})
 
 	// Add this handler
 	http.HandleFunc("/log-status", func(w http.ResponseWriter, r *http.Request) {
 		// Call the new function from database.go
-		lastID, lastTimestamp, err := getLatestLogEntry()
+		lastID, lastTimestamp, err := store.LatestLogEntry()
 		if err != nil {
 			log.Printf("Node %d: Error getting latest log entry: %v", node.ID, err)
 			http.Error(w, "Failed to get log status", http.StatusInternalServerError)
@@ -485,6 +603,7 @@ func startHTTPServer(node *Node) {
 		}
 		status := map[string]interface{}{
 			"nodeId":           node.ID,
+			"role":             node.core.Role(),
 			"lastLogId":        lastID,
 			"lastLogTimestamp": lastTimestamp.Format(time.RFC3339Nano), // Format timestamp as ISO 8601 string
 		}
@@ -495,38 +614,52 @@ func startHTTPServer(node *Node) {
 	})
 
 	http.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		core := node.core.Status()
 		node.mutex.RLock()
 		defer node.mutex.RUnlock()
 		status := struct {
 			NodeID        int
+			Role          NodeRole
 			IsLeader      bool
 			Term          int
 			ActiveNodes   map[int]bool
+			MemberRoles   map[int]NodeRole
+			Config        *ClusterConfig
 			CurrentLeader int
 		}{
 			NodeID:        node.ID,
-			IsLeader:      node.Leader,
-			Term:          node.term,
-			ActiveNodes:   node.activeNodes,
-			CurrentLeader: node.lastKnownLeader,
+			Role:          core.Role,
+			IsLeader:      core.IsLeader,
+			Term:          core.Term,
+			ActiveNodes:   core.Active,
+			MemberRoles:   core.Roles,
+			Config:        node.config,
+			CurrentLeader: core.LeaderID,
 		}
 		json.NewEncoder(w).Encode(status)
 	})
 
 	http.HandleFunc("/query", handleQuery)
 
-	http.HandleFunc("/recvMulticast", recvMulticast)
+	http.HandleFunc("/recvMulticast", recvMulticast(node))
 
-	http.HandleFunc("/getTreeFromLeader", GetTreeFromLeader)
+	// Read-only view of this node's tree, as JSON or ?format=dot
+	http.HandleFunc("/tree", handleTree(node))
+	http.HandleFunc("/tree/validate", handleTreeValidate)
+	http.HandleFunc("/tree/suspect", handleTreeSuspect(node))
 
-	http.HandleFunc("/reset", handleReset)
+	http.HandleFunc("/reset", handleReset(node))
 
-	http.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
-		if !node.Leader {
-			http.Error(w, "Only leader can serve logs", http.StatusForbidden)
-			return
-		}
+	http.HandleFunc("/admin/voters", handleVoters(node))
+
+	http.HandleFunc("/log-summary", handleLogSummary(node))
 
+	// Per-write delivery reports, aggregated on the leader
+	http.HandleFunc("/deliveries", handleDeliveries(node))
+	http.HandleFunc("/deliveries/", handleDeliveries(node))
+
+	// Any node serves its log: catch-up asks the leader, anti-entropy may ask a peer
+	http.HandleFunc("/logs", func(w http.ResponseWriter, r *http.Request) {
 		lastIDStr := r.URL.Query().Get("last_id")
 		lastID, err := strconv.Atoi(lastIDStr)
 		if err != nil {
@@ -544,40 +677,37 @@ func startHTTPServer(node *Node) {
 		json.NewEncoder(w).Encode(logs)
 	})
 
-	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+	// Everything this node stores, as a backup or to move it to another backend
+	http.HandleFunc("/snapshot", handleSnapshot)
 
-		node.mutex.RLock()
-		defer node.mutex.RUnlock()
+	// Schema migrations applied here and the log positions they ran at
+	http.HandleFunc("/schema", handleSchema(node))
+
+	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		status := node.core.Status()
 
 		// Node status metrics
 		fmt.Fprintf(w, "# HELP node_status Node status (1 for leader, 0 for follower)\n")
 		fmt.Fprintf(w, "# TYPE node_status gauge\n")
-		fmt.Fprintf(w, "node_status{node_id=\"%d\"} %d\n", node.ID, boolToInt(node.Leader))
+		fmt.Fprintf(w, "node_status{node_id=\"%d\"} %d\n", node.ID, boolToInt(status.IsLeader))
 
-		if db != nil {
-			query := `SELECT email, R1, R2, R3, R4 FROM users`
-			rows, err := db.Query(query)
+		if store != nil {
+			users, err := store.Users()
 			if err != nil {
 				log.Printf("Database query error: %v", err)
 				return
 			}
-			defer rows.Close()
 
 			fmt.Fprintf(w, "# HELP user_roles User role assignments by role\n")
 			fmt.Fprintf(w, "# TYPE user_roles gauge\n")
 
-			for rows.Next() {
-				var email string
-				var r1, r2, r3, r4 bool
-				if err := rows.Scan(&email, &r1, &r2, &r3, &r4); err == nil {
-					roles := fmt.Sprintf("r1=%d,r2=%d,r3=%d,r4=%d", boolToInt(r1), boolToInt(r2), boolToInt(r3), boolToInt(r4))
-					fmt.Fprintf(w, "user_roles{node_id=\"%d\",email=\"%s\",roles=\"%s\"} 1\n", node.ID, email, roles)
-				} else {
-					log.Printf("Error scanning row: %v", err)
-				}
+			for _, u := range users {
+				r := u.Roles
+				roles := fmt.Sprintf("r1=%d,r2=%d,r3=%d,r4=%d", boolToInt(r["R1"]), boolToInt(r["R2"]), boolToInt(r["R3"]), boolToInt(r["R4"]))
+				fmt.Fprintf(w, "user_roles{node_id=\"%d\",email=\"%s\",roles=\"%s\"} 1\n", node.ID, u.Email, roles)
 			}
 		} else {
-			log.Println("Database connection is nil, skipping user metrics")
+			log.Println("Store is not open, skipping user metrics")
 		}
 
 		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
@@ -585,38 +715,77 @@ func startHTTPServer(node *Node) {
 		// Term metric
 		fmt.Fprintf(w, "# HELP node_term Current term number (used in leader election)\n")
 		fmt.Fprintf(w, "# TYPE node_term gauge\n")
-		fmt.Fprintf(w, "node_term{node_id=\"%d\"} %d\n", node.ID, node.term)
+		fmt.Fprintf(w, "node_term{node_id=\"%d\"} %d\n", node.ID, status.Term)
 
 		// Active nodes metric
 		fmt.Fprintf(w, "# HELP active_nodes Number of active nodes in the cluster\n")
 		fmt.Fprintf(w, "# TYPE active_nodes gauge\n")
-		fmt.Fprintf(w, "active_nodes{node_id=\"%d\"} %d\n", node.ID, len(node.activeNodes))
+		fmt.Fprintf(w, "active_nodes{node_id=\"%d\"} %d\n", node.ID, len(status.Active))
 
 		// Current leader metric
 		fmt.Fprintf(w, "# HELP current_leader The ID of the current leader node\n")
 		fmt.Fprintf(w, "# TYPE current_leader gauge\n")
-		fmt.Fprintf(w, "current_leader{node_id=\"%d\"} %d\n", node.ID, node.lastKnownLeader)
+		fmt.Fprintf(w, "current_leader{node_id=\"%d\"} %d\n", node.ID, status.LeaderID)
+
+		// Reorder buffer metrics
+		buffered, fallbacks := node.core.ReorderStatus()
+		fmt.Fprintf(w, "# HELP node_reorder_buffered_entries Entries that arrived early and wait for a gap to fill\n")
+		fmt.Fprintf(w, "# TYPE node_reorder_buffered_entries gauge\n")
+		fmt.Fprintf(w, "node_reorder_buffered_entries{node_id=\"%d\"} %d\n", node.ID, buffered)
+		fmt.Fprintf(w, "# HELP node_reorder_fallbacks_total Gaps that were not filled in time and were fetched from the leader\n")
+		fmt.Fprintf(w, "# TYPE node_reorder_fallbacks_total counter\n")
+		fmt.Fprintf(w, "node_reorder_fallbacks_total{node_id=\"%d\"} %d\n", node.ID, fallbacks)
+		fmt.Fprintf(w, "# HELP node_log_truncations_total Times entries from a newer term replaced the end of the log\n")
+		fmt.Fprintf(w, "# TYPE node_log_truncations_total counter\n")
+		fmt.Fprintf(w, "node_log_truncations_total{node_id=\"%d\"} %d\n", node.ID, node.core.Truncations())
+
+		// Group commit metrics
+		writeBatchMetrics(w, node.ID)
+
+		// Anti-entropy metrics
+		writeAntiEntropyMetrics(w, node.ID)
+
+		// Hinted handoff metrics
+		writeHandoffMetrics(w, node.ID)
+
+		// Dissemination strategy metrics
+		writeDisseminationMetrics(w, node.ID)
+
+		// Spanning tree shape
+		writeTreeMetrics(w, node.ID)
+		writeLatencyMetrics(w, node.ID)
+		writeTreeValidationMetrics(w, node.ID)
+		writeOrphanMetrics(w, node.ID)
+		writeSchemaMetrics(w, node.ID)
 	})
 
 	fmt.Printf("Starting HTTP server on port %d\n", httpPort)
-	if err := http.ListenAndServe(fmt.Sprintf(":%d", httpPort), nil); err != nil {
+	server := &http.Server{Addr: fmt.Sprintf(":%d", httpPort)}
+
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), serverStopTimeout)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			fmt.Printf("Error stopping HTTP server: %v\n", err)
+		}
+	}()
+
+	if err := serveHTTP(server, tls.RequireAndVerifyClientCert); err != nil && !errors.Is(err, http.ErrServerClosed) {
 		fmt.Printf("Error starting HTTP server: %v\n", err)
+		return
 	}
+	<-stopped
 }
 
 func discoverExistingLeader(node *Node) bool {
-	for i := range node.activeNodes {
+	for i := range node.core.Status().Active {
 		if pingNode(i) {
 			leader, term, err := askForLeader(i)
 			if err == nil && leader > 0 {
-				node.mutex.Lock()
-				if term >= node.term {
-					node.term = term
-					node.Leader = (node.ID == leader)
-					node.lastKnownLeader = leader
-					updateLastHeartbeat()
-				}
-				node.mutex.Unlock()
+				node.core.ObserveLeader(leader, term)
 				fmt.Printf("Node %d: Discovered existing leader: Node %d (Term: %d)\n", node.ID, leader, term)
 				return true
 			}
@@ -626,7 +795,7 @@ func discoverExistingLeader(node *Node) bool {
 }
 
 func askForLeader(nodeID int) (int, int, error) {
-	resp, err := http.Get(fmt.Sprintf("http://node-%d:%d/leader", nodeID, httpPort))
+	resp, err := newHTTPClient(0).Get(fmt.Sprintf("%s://node-%d:%d/leader", urlScheme(), nodeID, httpPort))
 	if err != nil {
 		return 0, 0, err
 	}
@@ -637,20 +806,8 @@ func askForLeader(nodeID int) (int, int, error) {
 	return leader, term, err
 }
 
-func isLeaderActive() bool {
-	heartbeatMutex.RLock()
-	defer heartbeatMutex.RUnlock()
-	return time.Since(lastHeartbeat) < leaderTimeout
-}
-
-func updateLastHeartbeat() {
-	heartbeatMutex.Lock()
-	lastHeartbeat = time.Now()
-	heartbeatMutex.Unlock()
-}
-
 func pingNode(id int) bool {
-	conn, err := net.DialTimeout("tcp", fmt.Sprintf("node-%d:%d", id, basePort+id), time.Second)
+	conn, err := dialTCP(fmt.Sprintf("node-%d:%d", id, basePort+id), time.Second)
 	if err != nil {
 		return false
 	}
@@ -658,98 +815,34 @@ func pingNode(id int) bool {
 	return true
 }
 
-func sendHeartbeats(node *Node) {
-	node.mutex.RLock()
-	if !node.Leader {
-		node.mutex.RUnlock()
-		return // Early return if not leader
-	}
-	currentTerm := node.term
-	nodeID := node.ID
-	node.mutex.RUnlock()
-
-	msg := Message{
-		Type: "Heartbeat",
-		Heartbeat: struct {
-			Term   int
-			Leader int
-		}{
-			Term:   currentTerm,
-			Leader: nodeID,
-		},
-	}
-
-	for i := range node.activeNodes {
-		if i != nodeID {
-			go func(targetID int) {
-				conn, err := net.DialTimeout("tcp", fmt.Sprintf("node-%d:%d", targetID, basePort+targetID), time.Second)
-				if err != nil {
-					return
-				}
-				defer conn.Close()
-
-				encoder := json.NewEncoder(conn)
-				if err := encoder.Encode(msg); err != nil {
-					return
-				}
-
-				fmt.Printf("Node %d: Sent heartbeat to Node %d (Term: %d)\n", nodeID, targetID, currentTerm)
-			}(i)
-		}
-	}
-}
-
 // Add this to your import list if not already there
 // "io/ioutil"
 
 // Add this new handler function to multicast.go or main.go
-func handleReset(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
-
-	// Start a transaction
-	tx, err := db.Begin()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error starting transaction: %v", err), http.StatusInternalServerError)
-		return
-	}
-	defer tx.Rollback()
-
-	// Delete all users
-	_, err = tx.Exec("DELETE FROM users")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error deleting users: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	// Delete all transaction logs
-	_, err = tx.Exec("DELETE FROM transaction_log")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error deleting transaction logs: %v", err), http.StatusInternalServerError)
-		return
-	}
-
-	// Reset sequence for transaction_log table
-	// (This line is crucial for resetting the last log ID)
-	_, err = tx.Exec("ALTER SEQUENCE transaction_log_id_seq RESTART WITH 1")
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error resetting sequence: %v", err), http.StatusInternalServerError)
-		return
-	}
+func handleReset(node *Node) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	// Commit transaction
-	err = tx.Commit()
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Error committing transaction: %v", err), http.StatusInternalServerError)
-		return
+		if err := store.Reset(); err != nil {
+			http.Error(w, fmt.Sprintf("Error resetting store: %v", err), http.StatusInternalServerError)
+			return
+		}
+		// Positions are reused once the log starts over
+		appliedPositions.Clear()
+		node.core.ForgetLog()
+		refreshClusterConfig(node)
+		hints.reset()
+		// The replicated migrations were forgotten, so the leader logs them again
+		migratedTerm.Store(0)
+
+		// Send success response
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"status":  "success",
+			"message": "System reset successfully",
+		})
 	}
-
-	// Send success response
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]string{
-		"status":  "success",
-		"message": "System reset successfully",
-	})
 }
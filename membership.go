@@ -1,6 +1,7 @@
 package main
 
 import (
+	"crypto/tls"
 	"encoding/json"
 	"log"
 	"net/http"
@@ -18,6 +19,8 @@ type MembershipManager struct {
 type MemberInfo struct {
 	ID        string    `json:"id"`
 	Address   string    `json:"address"`
+	Role      string    `json:"role,omitempty"`   // "voter", "learner" or "witness"
+	Region    string    `json:"region,omitempty"` // Groups nodes in the spanning tree
 	LeaseID   int64     `json:"lease_id"`
 	ExpiresAt time.Time `json:"expires_at"`
 	IsLeader  bool      `json:"is_leader"`
@@ -41,7 +44,7 @@ func main() {
 	log.Printf("Membership service started on port 7946")
 
 	// Wait for server shutdown
-	if err := mm.httpServer.ListenAndServe(); err != nil {
+	if err := serveHTTP(mm.httpServer, tls.RequireAndVerifyClientCert); err != nil {
 		log.Fatalf("HTTP server error: %v", err)
 	}
 }
@@ -56,6 +59,7 @@ func NewMembershipManager() *MembershipManager {
 	mux.HandleFunc("/members", mm.handleMembers)
 	mux.HandleFunc("/register", mm.handleRegister)
 	mux.HandleFunc("/keepalive", mm.handleKeepAlive)
+	mux.HandleFunc("/deregister", mm.handleDeregister)
 	mux.HandleFunc("/leader", mm.handleLeader)
 
 	mm.httpServer = &http.Server{
@@ -115,6 +119,21 @@ func (mm *MembershipManager) handleRegister(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
+	// With mutual TLS a node may only register under its own certificate identity
+	if !peerIsNode(r.TLS, info.ID) {
+		http.Error(w, "Peer certificate does not match node ID", http.StatusForbidden)
+		return
+	}
+
+	switch info.Role {
+	case "":
+		info.Role = "voter"
+	case "voter", "learner", "witness":
+	default:
+		http.Error(w, "Invalid role (use 'voter', 'learner' or 'witness')", http.StatusBadRequest)
+		return
+	}
+
 	mm.mu.Lock()
 	info.LeaseID = time.Now().UnixNano()
 	info.ExpiresAt = time.Now().Add(2 * time.Second)
@@ -127,7 +146,7 @@ func (mm *MembershipManager) handleRegister(w http.ResponseWriter, r *http.Reque
 	}
 	mm.mu.Unlock()
 
-	log.Printf("Node %s registered", info.ID)
+	log.Printf("Node %s registered as %s", info.ID, info.Role)
 
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(map[string]int64{"lease_id": info.LeaseID})
@@ -145,6 +164,11 @@ func (mm *MembershipManager) handleKeepAlive(w http.ResponseWriter, r *http.Requ
 		return
 	}
 
+	if !peerIsNode(r.TLS, info.ID) {
+		http.Error(w, "Peer certificate does not match node ID", http.StatusForbidden)
+		return
+	}
+
 	mm.mu.Lock()
 	if member, exists := mm.members[info.ID]; exists {
 		member.ExpiresAt = time.Now().Add(2 * time.Second)
@@ -156,6 +180,39 @@ func (mm *MembershipManager) handleKeepAlive(w http.ResponseWriter, r *http.Requ
 	w.WriteHeader(http.StatusOK)
 }
 
+// handleDeregister removes a node that is shutting down gracefully,
+// without waiting for its lease to expire.
+func (mm *MembershipManager) handleDeregister(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var info MemberInfo
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if !peerIsNode(r.TLS, info.ID) {
+		http.Error(w, "Peer certificate does not match node ID", http.StatusForbidden)
+		return
+	}
+
+	mm.mu.Lock()
+	if _, exists := mm.members[info.ID]; exists {
+		delete(mm.members, info.ID)
+		mm.watchChan <- MembershipEvent{
+			Type:   NodeLeft,
+			NodeID: info.ID,
+		}
+		log.Printf("Node %s deregistered", info.ID)
+	}
+	mm.mu.Unlock()
+
+	w.WriteHeader(http.StatusOK)
+}
+
 func (mm *MembershipManager) handleLeader(w http.ResponseWriter, r *http.Request) {
 	mm.mu.RLock()
 	defer mm.mu.RUnlock()
@@ -0,0 +1,715 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// memoryStore keeps the node's data in memory. Every write is a storeChange
+// applied under the store's lock with a way to undo it, which is what
+// transactions and savepoints roll back. The file store persists the changes
+// of each committed transaction and replays them on start.
+type memoryStore struct {
+	mu    sync.RWMutex // Held for writing by the open transaction
+	state memoryState
+	name  string
+	// persist is called with the changes of a transaction before it commits;
+	// an error rolls the transaction back.
+	persist func(changes []storeChange) error
+}
+
+// memoryState is the contents of a memory store.
+type memoryState struct {
+	users      map[string]UserRecord
+	log        []LogRecord // Ordered by ID
+	configs    []ConfigRecord
+	hints      []HintRecord       // Ordered by ID
+	migrations []AppliedMigration // Ordered by version
+	nextConfig int
+	nextHint   int
+}
+
+// Kinds of storeChange.
+const (
+	changePutUser     = "put_user"
+	changeDeleteUser  = "delete_user"
+	changeDeleteUsers = "delete_users"
+	changeAppendLog   = "append_log"
+	changeAddConfig   = "add_config"
+	changeAddHint     = "add_hint"
+	changeRemoveHint  = "remove_hint"
+	changeMigration   = "migration"
+	changeReset       = "reset"
+	changeTruncate    = "truncate"
+	changeRestore     = "restore"
+	changeLoad        = "load" // Like restore, but keeps nothing of the current state
+)
+
+// storeChange is one write to a memory store. Generated IDs and times are
+// filled in when it is applied, so replaying it gives the same result.
+type storeChange struct {
+	Kind      string            `json:"kind"`
+	User      *UserRecord       `json:"user,omitempty"`
+	Email     string            `json:"email,omitempty"`
+	Log       *LogRecord        `json:"log,omitempty"`
+	Config    *ConfigRecord     `json:"config,omitempty"`
+	Hint      *HintRecord       `json:"hint,omitempty"`
+	ID        int               `json:"id,omitempty"`
+	Migration *AppliedMigration `json:"migration,omitempty"`
+	Snapshot  *Snapshot         `json:"snapshot,omitempty"`
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{name: "memory", state: newMemoryState()}
+}
+
+func newMemoryState() memoryState {
+	return memoryState{users: make(map[string]UserRecord), nextConfig: 1, nextHint: 1}
+}
+
+// apply performs change on the state and returns how to undo it.
+func (m *memoryState) apply(change storeChange) (func(), error) {
+	switch change.Kind {
+	case changePutUser:
+		u := *change.User
+		previous, existed := m.users[u.Email]
+		m.users[u.Email] = u
+		return func() {
+			if existed {
+				m.users[u.Email] = previous
+			} else {
+				delete(m.users, u.Email)
+			}
+		}, nil
+
+	case changeDeleteUser:
+		previous, existed := m.users[change.Email]
+		if !existed {
+			return func() {}, nil
+		}
+		delete(m.users, change.Email)
+		return func() { m.users[change.Email] = previous }, nil
+
+	case changeDeleteUsers:
+		previous := m.users
+		m.users = make(map[string]UserRecord)
+		return func() { m.users = previous }, nil
+
+	case changeAppendLog:
+		r := *change.Log
+		i := sort.Search(len(m.log), func(i int) bool { return m.log[i].ID >= r.ID })
+		if i < len(m.log) && m.log[i].ID == r.ID {
+			return nil, errLogPositionTaken
+		}
+		m.log = append(m.log, LogRecord{})
+		copy(m.log[i+1:], m.log[i:])
+		m.log[i] = r
+		return func() {
+			i := sort.Search(len(m.log), func(i int) bool { return m.log[i].ID >= r.ID })
+			m.log = append(m.log[:i], m.log[i+1:]...)
+		}, nil
+
+	case changeAddConfig:
+		c := *change.Config
+		next := m.nextConfig
+		m.configs = append(m.configs, c)
+		if c.ID >= m.nextConfig {
+			m.nextConfig = c.ID + 1
+		}
+		return func() {
+			m.configs = m.configs[:len(m.configs)-1]
+			m.nextConfig = next
+		}, nil
+
+	case changeAddHint:
+		h := *change.Hint
+		next := m.nextHint
+		m.hints = append(m.hints, h)
+		if h.ID >= m.nextHint {
+			m.nextHint = h.ID + 1
+		}
+		return func() {
+			m.hints = m.hints[:len(m.hints)-1]
+			m.nextHint = next
+		}, nil
+
+	case changeRemoveHint:
+		for i, h := range m.hints {
+			if h.ID == change.ID {
+				m.hints = append(m.hints[:i:i], m.hints[i+1:]...)
+				return func() {
+					m.hints = append(m.hints[:i:i], append([]HintRecord{h}, m.hints[i:]...)...)
+				}, nil
+			}
+		}
+		return func() {}, nil
+
+	case changeMigration:
+		a := *change.Migration
+		for _, applied := range m.migrations {
+			if applied.Version == a.Version {
+				return nil, fmt.Errorf("migration %d has already been applied", a.Version)
+			}
+		}
+		previous := m.migrations
+		m.migrations = append(append([]AppliedMigration(nil), m.migrations...), a)
+		sort.Slice(m.migrations, func(i, j int) bool { return m.migrations[i].Version < m.migrations[j].Version })
+		return func() { m.migrations = previous }, nil
+
+	case changeReset:
+		previous := *m
+		m.users = make(map[string]UserRecord)
+		m.log = nil
+		m.configs = nil
+		m.hints = nil
+		m.migrations = startupMigrations(m.migrations, true)
+		return func() { *m = previous }, nil
+
+	case changeTruncate:
+		previous := *m
+		i := sort.Search(len(m.log), func(i int) bool { return m.log[i].ID >= change.ID })
+		m.users = make(map[string]UserRecord)
+		m.log = m.log[:i:i]
+		m.configs = nil
+		m.migrations = startupMigrations(m.migrations, true)
+		return func() { *m = previous }, nil
+
+	case changeRestore:
+		previous := *m
+		*m = stateFromSnapshot(change.Snapshot)
+		m.migrations = append(startupMigrations(previous.migrations, true), startupMigrations(change.Snapshot.Migrations, false)...)
+		sort.Slice(m.migrations, func(i, j int) bool { return m.migrations[i].Version < m.migrations[j].Version })
+		return func() { *m = previous }, nil
+
+	case changeLoad:
+		previous := *m
+		*m = stateFromSnapshot(change.Snapshot)
+		return func() { *m = previous }, nil
+	}
+	return nil, fmt.Errorf("unknown store change %q", change.Kind)
+}
+
+// stateFromSnapshot builds the state a snapshot describes.
+func stateFromSnapshot(snapshot *Snapshot) memoryState {
+	m := newMemoryState()
+	for _, u := range snapshot.Users {
+		m.users[u.Email] = copyUser(u)
+	}
+	m.log = append([]LogRecord(nil), snapshot.Log...)
+	sort.Slice(m.log, func(i, j int) bool { return m.log[i].ID < m.log[j].ID })
+	for _, c := range snapshot.Configs {
+		c.Voters = append([]int(nil), c.Voters...)
+		m.configs = append(m.configs, c)
+		if c.ID >= m.nextConfig {
+			m.nextConfig = c.ID + 1
+		}
+	}
+	for _, h := range snapshot.Hints {
+		h.Descendants = append([]string(nil), h.Descendants...)
+		m.hints = append(m.hints, h)
+		if h.ID >= m.nextHint {
+			m.nextHint = h.ID + 1
+		}
+	}
+	sort.Slice(m.hints, func(i, j int) bool { return m.hints[i].ID < m.hints[j].ID })
+	m.migrations = append([]AppliedMigration(nil), snapshot.Migrations...)
+	sort.Slice(m.migrations, func(i, j int) bool { return m.migrations[i].Version < m.migrations[j].Version })
+	return m
+}
+
+// startupMigrations returns the migrations that ran at startup, or the
+// replicated ones if startup is false.
+func startupMigrations(applied []AppliedMigration, startup bool) []AppliedMigration {
+	var selected []AppliedMigration
+	for _, a := range applied {
+		if a.Startup == startup {
+			selected = append(selected, a)
+		}
+	}
+	return selected
+}
+
+func copyUser(u UserRecord) UserRecord {
+	roles := make(map[string]bool, len(u.Roles))
+	for role, value := range u.Roles {
+		roles[role] = value
+	}
+	u.Roles = roles
+	return u
+}
+
+func (s *memoryStore) Name() string { return s.name }
+
+// Select filters a table's rows the way the equivalent Postgres query would,
+// comparing each where value against the column's type.
+func (s *memoryStore) Select(table string, fields []string, where map[string]string) ([]map[string]interface{}, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	columns, rows, err := s.state.table(table)
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(columns))
+	for _, column := range columns {
+		known[column] = true
+	}
+
+	var selected []string
+	for _, field := range fields {
+		if field == "*" {
+			selected = append(selected, columns...)
+			continue
+		}
+		name := strings.ToLower(field)
+		if !known[name] {
+			return nil, fmt.Errorf("column %q does not exist", field)
+		}
+		selected = append(selected, name)
+	}
+	for column := range where {
+		if !known[strings.ToLower(column)] {
+			return nil, fmt.Errorf("column %q does not exist", column)
+		}
+	}
+
+	var results []map[string]interface{}
+	for _, row := range rows {
+		matches := true
+		for column, value := range where {
+			matches = matches && columnEquals(row[strings.ToLower(column)], value)
+		}
+		if !matches {
+			continue
+		}
+		result := make(map[string]interface{}, len(selected))
+		for _, column := range selected {
+			result[column] = row[column]
+		}
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// table returns the columns and rows of a table, typed as Postgres scans them.
+func (m *memoryState) table(name string) ([]string, []map[string]interface{}, error) {
+	var rows []map[string]interface{}
+	switch strings.ToLower(name) {
+	case "users":
+		emails := make([]string, 0, len(m.users))
+		for email := range m.users {
+			emails = append(emails, email)
+		}
+		sort.Strings(emails)
+		for _, email := range emails {
+			u := m.users[email]
+			row := map[string]interface{}{"email": u.Email, "password_hash": u.PasswordHash}
+			for _, role := range userRoles {
+				value, ok := u.Roles[role]
+				if ok {
+					row[strings.ToLower(role)] = value
+				} else {
+					row[strings.ToLower(role)] = nil
+				}
+			}
+			rows = append(rows, row)
+		}
+		return []string{"email", "password_hash", "r1", "r2", "r3", "r4"}, rows, nil
+	case "transaction_log":
+		for _, r := range m.log {
+			row := logRow(r)
+			row["timestamp"] = r.Timestamp
+			rows = append(rows, row)
+		}
+		return []string{"id", "term", "type", "table_name", "query", "operation", "timestamp"}, rows, nil
+	case "cluster_config":
+		for _, c := range m.configs {
+			rows = append(rows, map[string]interface{}{"id": int64(c.ID), "voters": formatVoters(c.Voters), "created_at": c.CreatedAt})
+		}
+		return []string{"id", "voters", "created_at"}, rows, nil
+	case "hinted_handoff":
+		for _, h := range m.hints {
+			rows = append(rows, map[string]interface{}{
+				"id":          int64(h.ID),
+				"destination": h.Destination,
+				"descendants": strings.Join(h.Descendants, ","),
+				"message":     h.Message,
+				"created_at":  h.CreatedAt,
+			})
+		}
+		return []string{"id", "destination", "descendants", "message", "created_at"}, rows, nil
+	}
+	return nil, nil, fmt.Errorf("relation %q does not exist", name)
+}
+
+// columnEquals compares a column value with a where value as Postgres casts it.
+func columnEquals(value interface{}, want string) bool {
+	switch v := value.(type) {
+	case nil:
+		return false // NULL equals nothing
+	case bool:
+		b, err := strconv.ParseBool(want)
+		return err == nil && b == v
+	case int64:
+		n, err := strconv.ParseInt(want, 10, 64)
+		return err == nil && n == v
+	case time.Time:
+		t, err := time.Parse(time.RFC3339Nano, want)
+		return err == nil && t.Equal(v)
+	}
+	return fmt.Sprint(value) == want
+}
+
+// Users returns every user, ordered by email.
+func (s *memoryStore) Users() ([]UserRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	users := make([]UserRecord, 0, len(s.state.users))
+	for _, u := range s.state.users {
+		users = append(users, copyUser(u))
+	}
+	sort.Slice(users, func(i, j int) bool { return users[i].Email < users[j].Email })
+	return users, nil
+}
+
+func (s *memoryStore) LastLogID() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state.lastLogID(), nil
+}
+
+func (m *memoryState) lastLogID() int {
+	if len(m.log) == 0 {
+		return 0
+	}
+	return m.log[len(m.log)-1].ID
+}
+
+func (s *memoryStore) LatestLogEntry() (int, time.Time, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.state.log) == 0 {
+		return 0, time.Time{}, nil
+	}
+	last := s.state.log[len(s.state.log)-1]
+	return last.ID, last.Timestamp, nil
+}
+
+func (s *memoryStore) LogsAfter(id int) ([]LogRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	i := sort.Search(len(s.state.log), func(i int) bool { return s.state.log[i].ID > id })
+	return append([]LogRecord(nil), s.state.log[i:]...), nil
+}
+
+func (s *memoryStore) LatestConfig() (*ClusterConfig, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if len(s.state.configs) == 0 {
+		return nil, errNoClusterConfig
+	}
+	last := s.state.configs[len(s.state.configs)-1]
+	return &ClusterConfig{ID: last.ID, Voters: append([]int(nil), last.Voters...)}, nil
+}
+
+func (s *memoryStore) HintCounts() (map[string]int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	counts := make(map[string]int)
+	for _, h := range s.state.hints {
+		counts[h.Destination]++
+	}
+	return counts, nil
+}
+
+func (s *memoryStore) Hints(destination string) ([]HintRecord, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var queued []HintRecord
+	for _, h := range s.state.hints {
+		if h.Destination == destination {
+			queued = append(queued, h)
+		}
+	}
+	return queued, nil
+}
+
+func (s *memoryStore) AddHint(destination string, descendants []string, message string) error {
+	return s.write(func(t *memoryTx) error {
+		hint := &HintRecord{ID: s.state.nextHint, Destination: destination, Descendants: descendants, Message: message, CreatedAt: time.Now().UTC()}
+		return t.apply(storeChange{Kind: changeAddHint, Hint: hint})
+	})
+}
+
+func (s *memoryStore) RemoveHint(id int) (bool, error) {
+	removed := false
+	err := s.write(func(t *memoryTx) error {
+		for _, h := range s.state.hints {
+			if h.ID == id {
+				removed = true
+				return t.apply(storeChange{Kind: changeRemoveHint, ID: id})
+			}
+		}
+		return nil
+	})
+	return removed && err == nil, err
+}
+
+func (s *memoryStore) TrimHints(destination string, keep int) (int, error) {
+	removed := 0
+	err := s.write(func(t *memoryTx) error {
+		var ids []int
+		for _, h := range s.state.hints {
+			if h.Destination == destination {
+				ids = append(ids, h.ID)
+			}
+		}
+		if len(ids) <= keep {
+			return nil
+		}
+		for _, id := range ids[:len(ids)-keep] {
+			if err := t.apply(storeChange{Kind: changeRemoveHint, ID: id}); err != nil {
+				return err
+			}
+		}
+		removed = len(ids) - keep
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return removed, nil
+}
+
+func (s *memoryStore) Migrations() ([]AppliedMigration, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]AppliedMigration(nil), s.state.migrations...), nil
+}
+
+// Snapshot copies the state.
+func (s *memoryStore) Snapshot() (*Snapshot, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	snapshot := &Snapshot{Store: s.name, Position: s.state.lastLogID(), Taken: time.Now()}
+	emails := make([]string, 0, len(s.state.users))
+	for email := range s.state.users {
+		emails = append(emails, email)
+	}
+	sort.Strings(emails)
+	for _, email := range emails {
+		snapshot.Users = append(snapshot.Users, copyUser(s.state.users[email]))
+	}
+	snapshot.Log = append([]LogRecord(nil), s.state.log...)
+	for _, c := range s.state.configs {
+		c.Voters = append([]int(nil), c.Voters...)
+		snapshot.Configs = append(snapshot.Configs, c)
+	}
+	for _, h := range s.state.hints {
+		h.Descendants = append([]string(nil), h.Descendants...)
+		snapshot.Hints = append(snapshot.Hints, h)
+	}
+	snapshot.Migrations = append([]AppliedMigration(nil), s.state.migrations...)
+	return snapshot, nil
+}
+
+func (s *memoryStore) Restore(snapshot *Snapshot) error {
+	return s.write(func(t *memoryTx) error {
+		return t.apply(storeChange{Kind: changeRestore, Snapshot: snapshot})
+	})
+}
+
+func (s *memoryStore) Reset() error {
+	return s.write(func(t *memoryTx) error {
+		return t.apply(storeChange{Kind: changeReset})
+	})
+}
+
+func (s *memoryStore) Close() error { return nil }
+
+// Begin locks the store for the transaction.
+func (s *memoryStore) Begin() (StoreTx, error) {
+	s.mu.Lock()
+	return &memoryTx{s: s}, nil
+}
+
+// write runs fn in a transaction of its own.
+func (s *memoryStore) write(fn func(t *memoryTx) error) error {
+	tx, _ := s.Begin()
+	defer tx.Rollback()
+	if err := fn(tx.(*memoryTx)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// memoryTx is a transaction on a memory store. It holds the store's lock
+// until it commits or rolls back.
+type memoryTx struct {
+	s          *memoryStore
+	changes    []storeChange
+	undo       []func()
+	savepoints []int
+	done       bool
+}
+
+// apply performs change and records it.
+func (t *memoryTx) apply(change storeChange) error {
+	if t.done {
+		return fmt.Errorf("transaction has already been committed or rolled back")
+	}
+	undo, err := t.s.state.apply(change)
+	if err != nil {
+		return err
+	}
+	t.changes = append(t.changes, change)
+	t.undo = append(t.undo, undo)
+	return nil
+}
+
+// undoTo undoes the changes after the first n.
+func (t *memoryTx) undoTo(n int) {
+	for i := len(t.undo) - 1; i >= n; i-- {
+		t.undo[i]()
+	}
+	t.changes = t.changes[:n]
+	t.undo = t.undo[:n]
+}
+
+// LastLogID returns the end of the log, which the transaction already holds.
+func (t *memoryTx) LastLogID() (int, error) {
+	return t.s.state.lastLogID(), nil
+}
+
+func (t *memoryTx) AppendLog(r LogRecord) error {
+	if r.Timestamp.IsZero() {
+		r.Timestamp = time.Now().UTC()
+	}
+	return t.apply(storeChange{Kind: changeAppendLog, Log: &r})
+}
+
+func (t *memoryTx) TruncateLog(from int) error {
+	return t.apply(storeChange{Kind: changeTruncate, ID: from})
+}
+
+func (t *memoryTx) UserExists(email string) (bool, error) {
+	_, ok := t.s.state.users[email]
+	return ok, nil
+}
+
+// UpsertUser inserts the user, or updates it if it exists. Without a
+// password hash only existing users are updated.
+func (t *memoryTx) UpsertUser(u *UpsertUser) (int64, error) {
+	existing, ok := t.s.state.users[u.Email]
+	if !ok && u.PasswordHash == "" {
+		return 0, nil
+	}
+	user := UserRecord{Email: u.Email, PasswordHash: u.PasswordHash}
+	if ok {
+		user = copyUser(existing)
+		if u.PasswordHash != "" {
+			user.PasswordHash = u.PasswordHash
+		}
+	}
+	if user.Roles == nil {
+		user.Roles = make(map[string]bool)
+	}
+	for role, value := range u.Roles {
+		user.Roles[role] = value
+	}
+	if err := t.apply(storeChange{Kind: changePutUser, User: &user}); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (t *memoryTx) DeleteUser(email string) (int64, error) {
+	if _, ok := t.s.state.users[email]; !ok {
+		return 0, nil
+	}
+	if err := t.apply(storeChange{Kind: changeDeleteUser, Email: email}); err != nil {
+		return 0, err
+	}
+	return 1, nil
+}
+
+func (t *memoryTx) DeleteAllUsers() (int64, error) {
+	n := int64(len(t.s.state.users))
+	if err := t.apply(storeChange{Kind: changeDeleteUsers}); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+func (t *memoryTx) AddConfig(voters []int) error {
+	config := &ConfigRecord{ID: t.s.state.nextConfig, Voters: append([]int(nil), voters...), CreatedAt: time.Now().UTC()}
+	return t.apply(storeChange{Kind: changeAddConfig, Config: config})
+}
+
+// ApplyMigration does nothing: the memory layout always matches the latest
+// schema, and only the record of the migration is kept.
+func (t *memoryTx) ApplyMigration(m Migration) error {
+	return nil
+}
+
+func (t *memoryTx) RecordMigration(a AppliedMigration) error {
+	if a.AppliedAt.IsZero() {
+		a.AppliedAt = time.Now().UTC()
+	}
+	return t.apply(storeChange{Kind: changeMigration, Migration: &a})
+}
+
+func (t *memoryTx) Savepoint() error {
+	t.savepoints = append(t.savepoints, len(t.changes))
+	return nil
+}
+
+// RollbackToSavepoint undoes the changes since the last savepoint, which
+// stays in place.
+func (t *memoryTx) RollbackToSavepoint() error {
+	if len(t.savepoints) == 0 {
+		return fmt.Errorf("no savepoint to roll back to")
+	}
+	t.undoTo(t.savepoints[len(t.savepoints)-1])
+	return nil
+}
+
+func (t *memoryTx) ReleaseSavepoint() error {
+	if len(t.savepoints) == 0 {
+		return fmt.Errorf("no savepoint to release")
+	}
+	t.savepoints = t.savepoints[:len(t.savepoints)-1]
+	return nil
+}
+
+// Commit persists the changes, if the store does, and releases the lock.
+func (t *memoryTx) Commit() error {
+	if t.done {
+		return fmt.Errorf("transaction has already been committed or rolled back")
+	}
+	if t.s.persist != nil && len(t.changes) > 0 {
+		if err := t.s.persist(t.changes); err != nil {
+			t.Rollback()
+			return err
+		}
+	}
+	t.done = true
+	t.s.mu.Unlock()
+	return nil
+}
+
+func (t *memoryTx) Rollback() error {
+	if t.done {
+		return nil
+	}
+	t.undoTo(0)
+	t.done = true
+	t.s.mu.Unlock()
+	return nil
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json" // Added for JSON handling
 	"fmt"
 	"io/ioutil" // Added for reading response bodies
@@ -12,9 +13,11 @@ import (
 	"net/url"
 	"os"
 	"os/exec"
+	"sort"
 	"strconv" // Added for converting int to string
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/rs/cors" // Assuming you added this earlier for CORS
@@ -29,9 +32,22 @@ const (
 )
 
 const (
-	operationRateLimit = 1 * time.Second // 1 operation per second
+	operationRateLimit = 1 * time.Millisecond // Override with OPERATION_INTERVAL
 )
 
+// operationInterval is how often a queued operation is forwarded to the leader.
+// The leader coalesces writes that arrive within its BATCH_WINDOW (5ms by
+// default), so the interval stays well under it and a burst shares a batch.
+func operationInterval() time.Duration {
+	if value := os.Getenv("OPERATION_INTERVAL"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Invalid OPERATION_INTERVAL %q, using %v", value, operationRateLimit)
+	}
+	return operationRateLimit
+}
+
 // Request holds the details for a queued request.
 type Request struct {
 	w    http.ResponseWriter
@@ -41,6 +57,7 @@ type Request struct {
 
 // OperationRecord holds information about operations for tracking
 type OperationRecord struct {
+	ID         string    `json:"id"`         // Assigned when the operation is recorded
 	Type       string    `json:"type"`       // "start", "stop", "reset", "insert", "update", "delete"
 	NodeID     int       `json:"nodeId"`     // Node ID for node operations
 	Timestamp  time.Time `json:"timestamp"`  // When the operation was received
@@ -51,21 +68,31 @@ type OperationRecord struct {
 	QueryType  string    `json:"queryType"`  // Type of query for database operations
 	Forwarded  bool      `json:"forwarded"`  // Whether this was forwarded to a node
 	TargetNode int       `json:"targetNode"` // Target node for forwarded operations
+	Position   int       `json:"position"`   // Log position the leader assigned to a write, 0 if none
+}
+
+// OperationDetail is an operation with the delivery state of its write, as
+// served by /operations/{id}.
+type OperationDetail struct {
+	OperationRecord
+	Delivery      json.RawMessage `json:"delivery,omitempty"`      // The leader's /deliveries/{position}
+	DeliveryError string          `json:"deliveryError,omitempty"` // Why the delivery state is unavailable
 }
 
 // Track operations queue and provide thread safety
 var (
 	operationsQueue      = make([]OperationRecord, 0, 50)
 	operationsQueueMutex sync.RWMutex
+	operationSeq         atomic.Int64
 )
 
 // In startOperationProcessor function around line 75
 func (m *Middleware) startOperationProcessor() {
-	ticker := time.NewTicker(operationRateLimit)
+	ticker := time.NewTicker(operationInterval())
 	defer ticker.Stop()
 
 	for {
-		<-ticker.C // Wait for ticker (1 second)
+		<-ticker.C // Wait for ticker
 
 		// Process one operation from queue
 		m.mutex.RLock()
@@ -77,6 +104,10 @@ func (m *Middleware) startOperationProcessor() {
 			// Skip this tick if leader is down
 			continue
 		}
+		if len(m.requestQueue) == 0 {
+			// Nothing to forward, so spare the membership service a lookup
+			continue
+		}
 
 		// ADD THIS SECTION: Verify the leader is actually in the membership list
 		membershipHost := os.Getenv("MEMBERSHIP_HOST")
@@ -105,31 +136,38 @@ func (m *Middleware) startOperationProcessor() {
 		select {
 		case req := <-m.requestQueue:
 			// Process this request now
-			targetURL, _ := url.Parse(fmt.Sprintf("http://node-%d:%d", leader, nodeBasePort))
+			targetURL, _ := url.Parse(fmt.Sprintf("%s://node-%d:%d", urlScheme(), leader, nodeBasePort))
 			proxy := httputil.NewSingleHostReverseProxy(targetURL)
-
-			// Use timeout context
-			ctx, cancel := context.WithTimeout(req.r.Context(), 15*time.Second)
-			defer cancel()
-
-			// Forward the request
-			err := m.forwardRequest(proxy, req.w, req.r.WithContext(ctx))
-			select {
-			case req.done <- err:
-			default:
-				log.Printf("Done channel receiver gone for rate-limited request")
-			}
+			proxy.Transport = sharedTransport()
+
+			// Forward without blocking the ticker, so the next operation can
+			// reach the leader while this one is still in flight
+			go func(req Request) {
+				// Use timeout context
+				ctx, cancel := context.WithTimeout(req.r.Context(), 15*time.Second)
+				defer cancel()
+
+				// Forward the request
+				err := m.forwardRequest(proxy, req.w, req.r.WithContext(ctx))
+				select {
+				case req.done <- err:
+				default:
+					log.Printf("Done channel receiver gone for rate-limited request")
+				}
+			}(req)
 		default:
 			// No operations in queue, do nothing this tick
 		}
 	}
 }
 
-// addOperation adds an operation to the queue
-func addOperation(op OperationRecord) {
+// addOperation adds an operation to the queue and returns its ID
+func addOperation(op OperationRecord) string {
 	operationsQueueMutex.Lock()
 	defer operationsQueueMutex.Unlock()
 
+	op.ID = fmt.Sprintf("op-%d", operationSeq.Add(1))
+
 	// Prepend the new operation (newest first)
 	operationsQueue = append([]OperationRecord{op}, operationsQueue...)
 
@@ -137,6 +175,33 @@ func addOperation(op OperationRecord) {
 	if len(operationsQueue) > 50 {
 		operationsQueue = operationsQueue[:50]
 	}
+	return op.ID
+}
+
+// setOperationPosition records the log position the leader gave a write
+func setOperationPosition(id string, position int) {
+	operationsQueueMutex.Lock()
+	defer operationsQueueMutex.Unlock()
+
+	for i, op := range operationsQueue {
+		if op.ID == id {
+			operationsQueue[i].Position = position
+			break
+		}
+	}
+}
+
+// getOperation returns the operation with the given ID
+func getOperation(id string) (OperationRecord, bool) {
+	operationsQueueMutex.RLock()
+	defer operationsQueueMutex.RUnlock()
+
+	for _, op := range operationsQueue {
+		if op.ID == id {
+			return op, true
+		}
+	}
+	return OperationRecord{}, false
 }
 
 // updateOperationStatus updates the status and message of an operation
@@ -168,7 +233,7 @@ func getOperationsQueue() []OperationRecord {
 
 // Add this function definition to middleware.go
 func getMembershipList(membershipHost string) (map[string]*MemberInfo1, error) {
-	resp, err := http.Get(fmt.Sprintf("http://%s/members", membershipHost))
+	resp, err := newHTTPClient(0).Get(fmt.Sprintf("%s://%s/members", urlScheme(), membershipHost))
 	if err != nil {
 		return nil, fmt.Errorf("failed to get members: %v", err)
 	}
@@ -185,6 +250,7 @@ func getMembershipList(membershipHost string) (map[string]*MemberInfo1, error) {
 type MemberInfo1 struct {
 	ID        string    `json:"id"`
 	Address   string    `json:"address"`
+	Role      string    `json:"role,omitempty"`
 	LeaseID   int64     `json:"lease_id"`
 	ExpiresAt time.Time `json:"expires_at"`
 	IsLeader  bool      `json:"is_leader"`
@@ -218,11 +284,11 @@ func NewMiddleware() *Middleware {
 
 // pollForLeader periodically polls nodes to find the current leader. (Improved version)
 func (m *Middleware) pollForLeader() {
-	client := &http.Client{Timeout: 2 * time.Second}
+	client := newHTTPClient(2 * time.Second)
 	for {
 		leaderFound := false
 		for i := 1; i <= max_Nodes; i++ {
-			address := fmt.Sprintf("http://node-%d:%d/leader", i, nodeBasePort)
+			address := fmt.Sprintf("%s://node-%d:%d/leader", urlScheme(), i, nodeBasePort)
 			resp, err := client.Get(address)
 			if err != nil {
 				// Node might be down, continue checking others
@@ -418,10 +484,15 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 				}
 
 				// Record the operation
-				addOperation(operation)
+				operationID := addOperation(operation)
+				w.Header().Set("X-Operation-ID", operationID)
 
 				// Update the status when the request is processed
 				defer func(opTime time.Time) {
+					// Remember where the leader logged the write to follow its delivery
+					if position, err := strconv.Atoi(w.Header().Get("X-Log-Position")); err == nil && position > 0 {
+						setOperationPosition(operationID, position)
+					}
 					// Check if the headers contain a status code indicating success
 					if w.Header().Get("X-Response-Status") == "success" {
 						updateOperationStatus(opTime, "completed", "")
@@ -496,6 +567,7 @@ func (m *Middleware) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 // NodeStatus holds the last log ID and timestamp for a node.
 type NodeStatus struct {
 	NodeId           int    `json:"nodeId"`
+	Role             string `json:"role,omitempty"` // "voter", "learner" or "witness"
 	LastLogId        int    `json:"lastLogId"`
 	LastLogTimestamp string `json:"lastLogTimestamp,omitempty"` // Expect string from node
 	Error            string `json:"error,omitempty"`
@@ -508,8 +580,8 @@ type ReplicationSummaryResponse struct {
 
 // fetchLogStatus queries a single node's /log-status endpoint.
 func fetchLogStatus(nodeId int, nodeAddress string) NodeStatus {
-	client := &http.Client{Timeout: 2 * time.Second} // Short timeout for status check
-	url := fmt.Sprintf("http://%s/log-status", nodeAddress)
+	client := newHTTPClient(2 * time.Second) // Short timeout for status check
+	url := fmt.Sprintf("%s://%s/log-status", urlScheme(), nodeAddress)
 	status := NodeStatus{NodeId: nodeId} // Initialize with the expected nodeId
 
 	resp, err := client.Get(url)
@@ -534,7 +606,7 @@ func fetchLogStatus(nodeId int, nodeAddress string) NodeStatus {
 		return status
 	}
 
-	// Decode the response: expected { "nodeId": X, "lastLogId": Y, "lastLogTimestamp": "..." }
+	// Decode the response: expected { "nodeId": X, "role": "...", "lastLogId": Y, "lastLogTimestamp": "..." }
 	var receivedStatus NodeStatus
 	if err := json.Unmarshal(body, &receivedStatus); err != nil {
 		log.Printf("Error decoding status from %s (Node %d): %v", nodeAddress, nodeId, err)
@@ -675,6 +747,31 @@ func (m *Middleware) handleGetCurrentLeader(w http.ResponseWriter, r *http.Reque
 
 // --- End Current Leader Handler ---
 
+// handleVoters proxies cluster configuration requests to the current leader.
+// Configuration changes bypass the rate-limited write queue.
+func (m *Middleware) handleVoters(w http.ResponseWriter, r *http.Request) {
+	m.mutex.RLock()
+	leader := m.currentLeader
+	isLeaderUp := m.isLeaderUp
+	m.mutex.RUnlock()
+
+	if !isLeaderUp || leader <= 0 {
+		http.Error(w, "No leader available", http.StatusServiceUnavailable)
+		return
+	}
+
+	targetURL, _ := url.Parse(fmt.Sprintf("%s://node-%d:%d", urlScheme(), leader, nodeBasePort))
+	proxy := httputil.NewSingleHostReverseProxy(targetURL)
+	proxy.Transport = sharedTransport()
+
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+
+	if err := m.forwardRequest(proxy, w, r.WithContext(ctx)); err != nil {
+		log.Printf("Error forwarding voter configuration request: %v", err)
+	}
+}
+
 func handleMiddlewareReset(w http.ResponseWriter, r *http.Request) {
 	if r.Method != http.MethodPost {
 		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
@@ -725,10 +822,10 @@ func handleMiddlewareReset(w http.ResponseWriter, r *http.Request) {
 		wg.Add(1)
 		go func(address string) {
 			defer wg.Done()
-			client := &http.Client{Timeout: 10 * time.Second}
+			client := newHTTPClient(10 * time.Second)
 
 			log.Printf("Sending reset request to %s", address)
-			resp, err := client.Post(fmt.Sprintf("http://%s/reset", address), "application/json", nil)
+			resp, err := client.Post(fmt.Sprintf("%s://%s/reset", urlScheme(), address), "application/json", nil)
 			if err != nil {
 				log.Printf("Error resetting node at %s: %v", address, err)
 				errors <- fmt.Sprintf("Failed to reset node at %s: %v", address, err)
@@ -832,6 +929,243 @@ func handleOperations(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// handleOperationDetail serves /operations/{id}: the operation and, for a
+// write, which nodes have applied it according to the leader.
+func (m *Middleware) handleOperationDetail(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	op, ok := getOperation(strings.TrimPrefix(r.URL.Path, "/operations/"))
+	if !ok {
+		http.Error(w, "Operation not found", http.StatusNotFound)
+		return
+	}
+	detail := OperationDetail{OperationRecord: op}
+
+	if op.Position > 0 {
+		m.mutex.RLock()
+		leader := m.currentLeader
+		m.mutex.RUnlock()
+
+		delivery, err := fetchDelivery(leader, op.Position)
+		if err != nil {
+			detail.DeliveryError = err.Error()
+		} else {
+			detail.Delivery = delivery
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(detail)
+}
+
+// fetchDelivery asks the leader which nodes have applied position.
+func fetchDelivery(leader int, position int) (json.RawMessage, error) {
+	if leader <= 0 {
+		return nil, fmt.Errorf("no leader available")
+	}
+
+	resp, err := newHTTPClient(2 * time.Second).Get(fmt.Sprintf("%s://node-%d:%d/deliveries/%d", urlScheme(), leader, nodeBasePort, position))
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach leader Node %d: %v", leader, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read delivery state: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("leader Node %d: %s", leader, strings.TrimSpace(string(body)))
+	}
+	return json.RawMessage(body), nil
+}
+
+// NodeTreeSummary is one node's view of the spanning tree in /cluster/tree.
+type NodeTreeSummary struct {
+	Epoch   int      `json:"epoch,omitempty"`
+	Version int      `json:"version,omitempty"`
+	Root    string   `json:"root,omitempty"`
+	Edges   []string `json:"edges,omitempty"` // "parent->child"
+	Error   string   `json:"error,omitempty"`
+}
+
+// TreeDisagreement is an edge that only some nodes have in their tree.
+type TreeDisagreement struct {
+	Edge    string   `json:"edge"`
+	Present []string `json:"present"`
+	Missing []string `json:"missing"`
+}
+
+// ClusterTree compares the nodes' views of the spanning tree.
+type ClusterTree struct {
+	Consistent    bool                        `json:"consistent"`
+	Roots         map[string][]string         `json:"roots"` // Root to the nodes that see it
+	Views         map[string]*NodeTreeSummary `json:"views"`
+	Disagreements []TreeDisagreement          `json:"disagreements"`
+}
+
+// fetchTreeView reads a node's GET /tree. Only the fields compared here are decoded.
+func fetchTreeView(nodeID int) (*NodeTreeSummary, error) {
+	resp, err := newHTTPClient(2 * time.Second).Get(fmt.Sprintf("%s://node-%d:%d/tree", urlScheme(), nodeID, nodeBasePort))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("tree request failed with status: %s", resp.Status)
+	}
+
+	var view struct {
+		Epoch   int `json:"epoch"`
+		Version int `json:"version"`
+		Root    *struct {
+			ID string `json:"id"`
+		} `json:"root"`
+		Edges []struct {
+			Parent string `json:"parent"`
+			Child  string `json:"child"`
+		} `json:"edges"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&view); err != nil {
+		return nil, fmt.Errorf("failed to decode tree: %v", err)
+	}
+
+	summary := &NodeTreeSummary{Epoch: view.Epoch, Version: view.Version}
+	if view.Root != nil {
+		summary.Root = view.Root.ID
+	}
+	for _, edge := range view.Edges {
+		summary.Edges = append(summary.Edges, edge.Parent+"->"+edge.Child)
+	}
+	sort.Strings(summary.Edges)
+	return summary, nil
+}
+
+// compareTrees collects every node's view of the tree and lists the edges
+// the reachable nodes disagree on.
+func compareTrees() ClusterTree {
+	report := ClusterTree{
+		Roots:         make(map[string][]string),
+		Views:         make(map[string]*NodeTreeSummary),
+		Disagreements: []TreeDisagreement{},
+	}
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	for i := 1; i <= max_Nodes; i++ {
+		wg.Add(1)
+		go func(nodeID int) {
+			defer wg.Done()
+			summary, err := fetchTreeView(nodeID)
+			if err != nil {
+				summary = &NodeTreeSummary{Error: err.Error()}
+			}
+			mu.Lock()
+			report.Views[strconv.Itoa(nodeID)] = summary
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+
+	var reachable []string
+	holders := make(map[string]map[string]bool) // Edge to the nodes that have it
+	for node, summary := range report.Views {
+		if summary.Error != "" {
+			continue
+		}
+		reachable = append(reachable, node)
+		report.Roots[summary.Root] = append(report.Roots[summary.Root], node)
+		for _, edge := range summary.Edges {
+			if holders[edge] == nil {
+				holders[edge] = make(map[string]bool)
+			}
+			holders[edge][node] = true
+		}
+	}
+	sort.Strings(reachable)
+	for root := range report.Roots {
+		sort.Strings(report.Roots[root])
+	}
+
+	for edge, nodes := range holders {
+		if len(nodes) == len(reachable) {
+			continue
+		}
+		disagreement := TreeDisagreement{Edge: edge, Present: []string{}, Missing: []string{}}
+		for _, node := range reachable {
+			if nodes[node] {
+				disagreement.Present = append(disagreement.Present, node)
+			} else {
+				disagreement.Missing = append(disagreement.Missing, node)
+			}
+		}
+		report.Disagreements = append(report.Disagreements, disagreement)
+	}
+	sort.Slice(report.Disagreements, func(i, j int) bool {
+		return report.Disagreements[i].Edge < report.Disagreements[j].Edge
+	})
+
+	report.Consistent = len(reachable) > 0 && len(report.Roots) == 1 && len(report.Disagreements) == 0
+	return report
+}
+
+// handleClusterTree serves /cluster/tree: every node's view of the spanning
+// tree and the edges they disagree on, as JSON or, with ?format=dot, as one
+// Graphviz graph with the disputed edges in red.
+func handleClusterTree(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	report := compareTrees()
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(report)
+
+	case "dot":
+		disputed := make(map[string]TreeDisagreement)
+		for _, d := range report.Disagreements {
+			disputed[d.Edge] = d
+		}
+		edges := make(map[string]bool)
+		for _, summary := range report.Views {
+			for _, edge := range summary.Edges {
+				edges[edge] = true
+			}
+		}
+		sorted := make([]string, 0, len(edges))
+		for edge := range edges {
+			sorted = append(sorted, edge)
+		}
+		sort.Strings(sorted)
+
+		w.Header().Set("Content-Type", "text/vnd.graphviz")
+		fmt.Fprintf(w, "digraph cluster_tree {\n")
+		fmt.Fprintf(w, "  label=\"Spanning tree across the cluster (consistent: %v)\";\n", report.Consistent)
+		fmt.Fprintf(w, "  node [shape=circle];\n")
+		for root, nodes := range report.Roots {
+			fmt.Fprintf(w, "  \"%s\" [shape=doublecircle,xlabel=\"root for %s\"];\n", root, strings.Join(nodes, ","))
+		}
+		for _, edge := range sorted {
+			parts := strings.SplitN(edge, "->", 2)
+			if d, ok := disputed[edge]; ok {
+				fmt.Fprintf(w, "  \"%s\" -> \"%s\" [color=red,style=dashed,label=\"only %s\"];\n", parts[0], parts[1], strings.Join(d.Present, ","))
+			} else {
+				fmt.Fprintf(w, "  \"%s\" -> \"%s\";\n", parts[0], parts[1])
+			}
+		}
+		fmt.Fprintf(w, "}\n")
+
+	default:
+		http.Error(w, "Invalid format (use 'json' or 'dot')", http.StatusBadRequest)
+	}
+}
+
 // main function updated to use ServeMux and apply CORS correctly.
 func main() {
 	middleware := NewMiddleware()
@@ -850,6 +1184,12 @@ func main() {
 	mux.HandleFunc("/reset", handleMiddlewareReset)
 
 	mux.HandleFunc("/operations", handleOperations)
+	mux.HandleFunc("/operations/", middleware.handleOperationDetail)
+
+	mux.HandleFunc("/admin/voters", middleware.handleVoters)
+
+	// Every node's view of the spanning tree, with disagreements highlighted
+	mux.HandleFunc("/cluster/tree", handleClusterTree)
 	// Register the main middleware handler for all other paths (e.g., /asia/query)
 	// The Middleware struct itself implements ServeHTTP for this purpose.
 	mux.Handle("/", middleware)
@@ -876,5 +1216,6 @@ func main() {
 	}
 
 	log.Printf("Middleware listening on :%d", middlewarePort)
-	log.Fatal(server.ListenAndServe())
+	// Browsers cannot present cluster certificates, so client certs are optional here
+	log.Fatal(serveHTTP(server, tls.VerifyClientCertIfGiven))
 }
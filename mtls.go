@@ -0,0 +1,290 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// Mutual TLS is shared by the node, membership and middleware binaries.
+// It is enabled when TLS_CA_FILE, TLS_CERT_FILE and TLS_KEY_FILE are all set.
+// Certificates are bound to identities through their DNS SANs (or common name):
+// nodes use "node-<id>", the other services "membership" and "middleware".
+// The files are watched and reloaded when they change on disk.
+
+const certReloadInterval = 30 * time.Second
+
+// certStore holds the current TLS material and reloads it when the files change.
+type certStore struct {
+	caFile   string
+	certFile string
+	keyFile  string
+
+	mu      sync.RWMutex
+	cert    *tls.Certificate
+	pool    *x509.CertPool
+	modTime time.Time
+}
+
+var (
+	certs         *certStore
+	certsOnce     sync.Once
+	transport     *http.Transport
+	transportOnce sync.Once
+)
+
+// tlsStore returns the process wide certificate store, or nil when TLS is off.
+func tlsStore() *certStore {
+	certsOnce.Do(func() {
+		caFile := os.Getenv("TLS_CA_FILE")
+		certFile := os.Getenv("TLS_CERT_FILE")
+		keyFile := os.Getenv("TLS_KEY_FILE")
+		if caFile == "" || certFile == "" || keyFile == "" {
+			return
+		}
+
+		store := &certStore{caFile: caFile, certFile: certFile, keyFile: keyFile}
+		if err := store.reload(); err != nil {
+			log.Fatalf("Failed to load TLS material: %v", err)
+		}
+		go store.watch()
+		certs = store
+		log.Printf("Mutual TLS enabled (cert %s, CA %s)", certFile, caFile)
+	})
+	return certs
+}
+
+// tlsEnabled reports whether inter-service traffic uses mutual TLS.
+func tlsEnabled() bool {
+	return tlsStore() != nil
+}
+
+// urlScheme returns the scheme to use for inter-service HTTP requests.
+func urlScheme() string {
+	if tlsEnabled() {
+		return "https"
+	}
+	return "http"
+}
+
+func (s *certStore) latestModTime() (time.Time, error) {
+	var latest time.Time
+	for _, file := range []string{s.caFile, s.certFile, s.keyFile} {
+		info, err := os.Stat(file)
+		if err != nil {
+			return time.Time{}, err
+		}
+		if info.ModTime().After(latest) {
+			latest = info.ModTime()
+		}
+	}
+	return latest, nil
+}
+
+// reload reads the CA bundle and key pair from disk.
+// On failure the previously loaded material stays in use.
+func (s *certStore) reload() error {
+	modTime, err := s.latestModTime()
+	if err != nil {
+		return fmt.Errorf("error reading TLS files: %v", err)
+	}
+
+	cert, err := tls.LoadX509KeyPair(s.certFile, s.keyFile)
+	if err != nil {
+		return fmt.Errorf("error loading key pair: %v", err)
+	}
+
+	caPEM, err := os.ReadFile(s.caFile)
+	if err != nil {
+		return fmt.Errorf("error reading CA file: %v", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(caPEM) {
+		return fmt.Errorf("no CA certificates found in %s", s.caFile)
+	}
+
+	s.mu.Lock()
+	s.cert = &cert
+	s.pool = pool
+	s.modTime = modTime
+	s.mu.Unlock()
+	return nil
+}
+
+// watch polls the TLS files and hot-reloads them after rotation.
+func (s *certStore) watch() {
+	ticker := time.NewTicker(certReloadInterval)
+	for range ticker.C {
+		modTime, err := s.latestModTime()
+		if err != nil {
+			log.Printf("Error checking TLS files: %v", err)
+			continue
+		}
+
+		s.mu.RLock()
+		changed := modTime.After(s.modTime)
+		s.mu.RUnlock()
+
+		if changed {
+			if err := s.reload(); err != nil {
+				log.Printf("Error reloading TLS material, keeping previous certificates: %v", err)
+				continue
+			}
+			log.Printf("Reloaded TLS certificates")
+		}
+	}
+}
+
+func (s *certStore) current() (*tls.Certificate, *x509.CertPool) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.cert, s.pool
+}
+
+// serverTLSConfig builds a listener config that always serves the latest
+// certificate and verifies clients against the latest CA bundle.
+func serverTLSConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	store := tlsStore()
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			cert, _ := store.current()
+			return cert, nil
+		},
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			cert, pool := store.current()
+			return &tls.Config{
+				MinVersion:   tls.VersionTLS12,
+				Certificates: []tls.Certificate{*cert},
+				ClientCAs:    pool,
+				ClientAuth:   clientAuth,
+			}, nil
+		},
+	}
+}
+
+// clientTLSConfig builds a dialer config that presents the latest certificate.
+// Chain and hostname verification is done by hand so that a reloaded CA
+// bundle takes effect without rebuilding clients.
+func clientTLSConfig() *tls.Config {
+	store := tlsStore()
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: true, // Verified in VerifyConnection against the current CA pool
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			cert, _ := store.current()
+			return cert, nil
+		},
+		VerifyConnection: func(state tls.ConnectionState) error {
+			if len(state.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+			// ServerName is only set for host names, so peers must be addressed by name
+			if state.ServerName == "" {
+				return errors.New("peers must be addressed by host name when mutual TLS is enabled")
+			}
+			_, pool := store.current()
+			intermediates := x509.NewCertPool()
+			for _, cert := range state.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+			_, err := state.PeerCertificates[0].Verify(x509.VerifyOptions{
+				Roots:         pool,
+				Intermediates: intermediates,
+				DNSName:       state.ServerName,
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+			})
+			return err
+		},
+	}
+}
+
+// newHTTPClient returns a client for inter-service requests, using mutual
+// TLS when it is enabled. A zero timeout means no timeout.
+func newHTTPClient(timeout time.Duration) *http.Client {
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: sharedTransport(),
+	}
+}
+
+// sharedTransport returns the transport used by every inter-service client.
+func sharedTransport() http.RoundTripper {
+	if !tlsEnabled() {
+		return http.DefaultTransport
+	}
+	transportOnce.Do(func() {
+		transport = http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = clientTLSConfig()
+	})
+	return transport
+}
+
+// serveHTTP starts an HTTP server, over TLS when it is enabled.
+func serveHTTP(server *http.Server, clientAuth tls.ClientAuthType) error {
+	if !tlsEnabled() {
+		return server.ListenAndServe()
+	}
+	server.TLSConfig = serverTLSConfig(clientAuth)
+	return server.ListenAndServeTLS("", "")
+}
+
+// listenTCP opens a raw TCP listener, wrapped in mutual TLS when it is enabled.
+func listenTCP(address string) (net.Listener, error) {
+	if !tlsEnabled() {
+		return net.Listen("tcp", address)
+	}
+	return tls.Listen("tcp", address, serverTLSConfig(tls.RequireAndVerifyClientCert))
+}
+
+// dialTCP connects to a raw TCP listener opened with listenTCP.
+func dialTCP(address string, timeout time.Duration) (net.Conn, error) {
+	if !tlsEnabled() {
+		return net.DialTimeout("tcp", address, timeout)
+	}
+	return tls.DialWithDialer(&net.Dialer{Timeout: timeout}, "tcp", address, clientTLSConfig())
+}
+
+// connState returns the TLS state of a connection, completing the handshake
+// if needed. It returns nil for plaintext connections.
+func connState(conn net.Conn) *tls.ConnectionState {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil
+	}
+	if err := tlsConn.Handshake(); err != nil {
+		return nil
+	}
+	state := tlsConn.ConnectionState()
+	return &state
+}
+
+// peerHasIdentity reports whether the verified peer certificate is bound to
+// identity (for example "node-3"). It always succeeds when TLS is disabled.
+func peerHasIdentity(state *tls.ConnectionState, identity string) bool {
+	if !tlsEnabled() {
+		return true
+	}
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return false
+	}
+	leaf := state.PeerCertificates[0]
+	for _, name := range leaf.DNSNames {
+		if name == identity {
+			return true
+		}
+	}
+	return leaf.Subject.CommonName == identity
+}
+
+// peerIsNode reports whether the peer holds the certificate of the given node ID.
+func peerIsNode(state *tls.ConnectionState, nodeID string) bool {
+	return peerHasIdentity(state, "node-"+nodeID)
+}
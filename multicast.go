@@ -2,28 +2,191 @@ package main
 
 import (
 	"bytes"
+	"container/list"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"log"
 	"net/http"
 	"os"
-	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
+
+	"mymodule/consensus"
 )
 
+// MulticastMessage carries consecutive log entries committed together on the
+// leader. Entries hold typed operations, never SQL.
+// The sequence numbers, term and message ID are assigned by the leader and
+// passed on unchanged by every hop; only SourceNode names the sender.
 type MulticastMessage struct {
-	Query      string        `json:"query"`
-	Args       []interface{} `json:"args"`
-	PID        int           `json:"pid"`
-	QueryType  QueryType     `json:"queryType"`
-	Table      string        `json:"table"`
-	SourceNode string        `json:"sourceNode"` // Add source tracking
-	MessageID  string        `json:"messageId"`  // Add message ID for deduplication
+	PID        int               `json:"pid"`                // Sequence number of the last entry in the batch
+	Term       int               `json:"term"`               // Leader's term when the batch committed
+	SourceNode string            `json:"sourceNode"`         // Node that sent this hop
+	MessageID  string            `json:"messageId"`          // Identifies the batch across hops, for tracing
+	WantAcks   bool              `json:"wantAcks,omitempty"` // Forward synchronously and report which nodes applied
+	Batch      []consensus.Entry `json:"batch"`
+
+	Strategy    string    `json:"strategy,omitempty"` // Dissemination strategy every hop follows, see disseminate.go
+	TTL         int       `json:"ttl,omitempty"`      // Gossip rounds left
+	Fanout      int       `json:"fanout,omitempty"`   // Leader's tree fan-out, which every hop adopts
+	Epoch       int       `json:"epoch,omitempty"`    // Tree epoch the leader routed the batch with
+	CommittedAt time.Time `json:"committedAt"`        // When the leader committed the batch, for latency metrics
+
+	acked func(ids []string) // On the leader, receives each child's acks as they arrive
+}
+
+// ack passes a child's acks to the leader's collector, if this node has one.
+func (m MulticastMessage) ack(ids []string) {
+	if m.acked != nil && len(ids) > 0 {
+		m.acked(ids)
+	}
+}
+
+// validate checks that the batch is consecutive, ends at PID and was
+// committed in a single term, and that its strategy is known.
+func (m MulticastMessage) validate() error {
+	if _, err := disseminatorFor(m.Strategy); err != nil {
+		return err
+	}
+	for i, entry := range m.Batch {
+		if i > 0 && entry.ID != m.Batch[i-1].ID+1 {
+			return fmt.Errorf("batch is not consecutive at entry %d", entry.ID)
+		}
+		if entry.Term != m.Term {
+			return fmt.Errorf("entry %d has term %d, message has term %d", entry.ID, entry.Term, m.Term)
+		}
+	}
+	if last := m.Batch[len(m.Batch)-1].ID; last != m.PID {
+		return fmt.Errorf("batch ends at entry %d, message has pid %d", last, m.PID)
+	}
+	return nil
+}
+
+// storesData reports whether this node keeps any of the data the message writes.
+func (m MulticastMessage) storesData() bool {
+	for _, entry := range m.Batch {
+		if storesTable(entry.Table) {
+			return true
+		}
+	}
+	return false
+}
+
+// MulticastAck is the body of a /recvMulticast response when acks were requested.
+type MulticastAck struct {
+	Acks []string `json:"acks"` // IDs of the nodes in the receiver's subtree that applied the entry
+}
+
+// Deduplication is keyed on the log position (PID) and the term it was written
+// in, since a position a deposed leader wrote is replaced by the next leader's
+// entry. The transaction log is the durable record of applied positions;
+// appliedPositions only saves a database round trip for recent duplicates.
+const (
+	dedupCacheSize = 10000
+	dedupCacheTTL  = 10 * time.Minute
+)
+
+var appliedPositions = newDedupCache(dedupCacheSize, dedupCacheTTL)
+
+// reorderTimeout reads REORDER_TIMEOUT, how long a batch that arrives ahead of
+// a gap waits for the earlier batches before they are fetched from /logs.
+func reorderTimeout() time.Duration {
+	if value := os.Getenv("REORDER_TIMEOUT"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Invalid REORDER_TIMEOUT %q, using %v", value, consensus.DefaultReorderTimeout)
+	}
+	return consensus.DefaultReorderTimeout
+}
+
+// dedupCache is a bounded set of recently applied log positions. The least
+// recently used position is evicted when it is full, and positions expire
+// after the TTL.
+type dedupCache struct {
+	mu      sync.Mutex
+	size    int
+	ttl     time.Duration
+	order   *list.List // Front is most recently used
+	entries map[logPosition]*list.Element
+}
+
+// logPosition is an entry's position with the term it was written in.
+type logPosition struct {
+	term int
+	id   int
+}
+
+type dedupEntry struct {
+	position logPosition
+	addedAt  time.Time
+}
+
+func newDedupCache(size int, ttl time.Duration) *dedupCache {
+	return &dedupCache{
+		size:    size,
+		ttl:     ttl,
+		order:   list.New(),
+		entries: make(map[logPosition]*list.Element),
+	}
+}
+
+// Contains reports whether the entry at id was applied in term recently.
+func (c *dedupCache) Contains(term, id int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	position := logPosition{term: term, id: id}
+	elem, ok := c.entries[position]
+	if !ok {
+		return false
+	}
+	if time.Since(elem.Value.(*dedupEntry).addedAt) > c.ttl {
+		c.order.Remove(elem)
+		delete(c.entries, position)
+		return false
+	}
+	c.order.MoveToFront(elem)
+	return true
+}
+
+// Add records the entry at id, written in term, as applied.
+func (c *dedupCache) Add(term, id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	position := logPosition{term: term, id: id}
+	if elem, ok := c.entries[position]; ok {
+		elem.Value.(*dedupEntry).addedAt = time.Now()
+		c.order.MoveToFront(elem)
+		return
+	}
+
+	c.entries[position] = c.order.PushFront(&dedupEntry{position: position, addedAt: time.Now()})
+	for c.order.Len() > c.size {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*dedupEntry).position)
+	}
 }
 
-// For tracking processed messages to avoid duplicates
-var processedMessages sync.Map
+// Clear forgets every position, for when the log is reset and positions are
+// reused.
+func (c *dedupCache) Clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.order.Init()
+	c.entries = make(map[logPosition]*list.Element)
+}
+
+// inflightMulticasts counts multicasts still being delivered, so that
+// shutdown can wait for them
+var inflightMulticasts atomic.Int64
 
 // Constants for reliability
 const (
@@ -33,10 +196,66 @@ const (
 	multicastTimeout = 10 * time.Second
 )
 
-func multicast(query string, args []interface{}, nodeId string, table string, queryType QueryType) error {
+// replicate sends a batch of consecutive entries from the leader as a single
+// message, using the cluster's dissemination strategy. Forwarders pass the
+// batch on unchanged. With a collector, replicas are asked for acks, which
+// reach it as they arrive.
+func replicate(entries []consensus.Entry, nodeId string, collector *ackCollector) ([]string, error) {
+	if len(entries) == 0 {
+		return nil, nil
+	}
+
+	first, last := entries[0], entries[len(entries)-1]
+	msg := MulticastMessage{
+		PID:         last.ID,
+		Term:        last.Term,
+		SourceNode:  nodeId,
+		MessageID:   fmt.Sprintf("t%d-%d-%d", last.Term, first.ID, last.ID),
+		WantAcks:    collector != nil,
+		Batch:       entries,
+		Strategy:    disseminationStrategy(),
+		Fanout:      treeFanout(),
+		CommittedAt: time.Now(),
+	}
+	if collector != nil {
+		msg.acked = collector.add
+	}
+
+	fmt.Printf("Multicasting batch of %d entries (%d-%d, term %d) from node %s by %s\n", len(entries), first.ID, last.ID, last.Term, nodeId, msg.Strategy)
+	disseminationStats.recordOriginated(msg.Strategy)
+	return disseminators[msg.Strategy].Originate(msg, nodeId)
+}
+
+// forwardMulticast passes a received message on exactly as the leader
+// numbered it, following the strategy the leader chose.
+func forwardMulticast(msg MulticastMessage, nodeId string) ([]string, error) {
+	d, err := disseminatorFor(msg.Strategy)
+	if err != nil {
+		return nil, err
+	}
+	return d.Forward(msg, nodeId)
+}
+
+// sendToChildren delivers msg to nodeId's children in the spanning tree.
+func sendToChildren(msg MulticastMessage, nodeId string) ([]string, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), multicastTimeout)
 	defer cancel()
 
+	multicastNode, err := routeFor(msg, nodeId)
+	if err != nil {
+		return nil, err
+	}
+	// Every node must compute the same children, so follow the leader's fan-out
+	if msg.Fanout > 0 {
+		GetGlobalTree().SetFanout(msg.Fanout)
+	}
+	msg.SourceNode = nodeId
+	return multicastToChildrenWithRetry(ctx, multicastNode, msg)
+}
+
+// treeNodeFor brings the spanning tree up to date with the membership list
+// and returns nodeId's position in it.
+func treeNodeFor(nodeId string) (*SpanningTreeNode, error) {
 	// Get membership list with retries
 	var members map[string]*MemberInfo1
 	var e error
@@ -49,7 +268,7 @@ func multicast(query string, args []interface{}, nodeId string, table string, qu
 		time.Sleep(retryDelay)
 	}
 	if e != nil {
-		return fmt.Errorf("failed to query membership list after %d attempts: %v", maxRetries, e)
+		return nil, fmt.Errorf("failed to query membership list after %d attempts: %v", maxRetries, e)
 	}
 
 	membersList := make([]string, 0, len(members))
@@ -68,99 +287,46 @@ func multicast(query string, args []interface{}, nodeId string, table string, qu
 		time.Sleep(retryDelay)
 	}
 	if e != nil {
-		return fmt.Errorf("failed to get leader after %d attempts: %v", maxRetries, e)
+		return nil, fmt.Errorf("failed to get leader after %d attempts: %v", maxRetries, e)
 	}
 
-	fmt.Printf("prev list %v \n", prevMembershipList)
 	fmt.Printf("curr list %v \n", membersList)
 
-	// Get tree with proper locking
+	// The tree follows the leader's latency plan if there is one, otherwise
+	// it is derived from membership alone
 	tree := GetGlobalTree()
-
-	// Initialize or update tree
-	if tree.Root == nil {
-		fmt.Println("Constructing new spanning tree")
-		err := ConstructSpanningTree(tree, members, leader.ID)
-		if err != nil {
-			return fmt.Errorf("failed to construct spanning tree: %v", err)
-		}
+	members = suspects.filter(members, leader.ID)
+	if plan := planFor(members, leader.ID); plan != nil {
+		tree.Install(plan)
 	} else {
-		// Handle nodes leaving
-		for _, prevMember := range prevMembershipList {
-			if members[prevMember] == nil {
-				// Delete all the nodes that have died or left the cluster
-				fmt.Printf("Remove node : %s\n", prevMember)
-				tree.RemoveNode(prevMember, leader.ID)
-			}
-		}
-
-		sort.Strings(prevMembershipList)
-		// Handle nodes joining
-		for member := range members {
-			index := sort.SearchStrings(prevMembershipList, member)
-			found := index < len(prevMembershipList) && prevMembershipList[index] == member
-			fmt.Printf("found : %v , %s", found, member)
-			if found != true {
-				fmt.Printf("Add node : %s\n", member)
-				tree.AddNode(member, members[member].Address, leader.ID)
-			}
-		}
+		tree.Rebuild(members, leader.ID)
 	}
-
-	// Print the tree
 	tree.PrintTree()
 
-	// Update membership list for next time
-	prevMembershipList = membersList
-	fmt.Printf("Inside Multicast\n")
-
-	// Get last processed ID with retries
-	var lastProcessedId int
-	var err error
-	for i := 0; i < maxRetries; i++ {
-		lastProcessedId, err = getLastProcessedID()
-		if err == nil {
-			break
-		}
-		fmt.Printf("Attempt %d: Failed to get last processed ID: %v\n", i+1, err)
-		time.Sleep(retryDelay)
-	}
-	if err != nil {
-		fmt.Printf("Failed to retrieve last processed Transaction after %d attempts\n", maxRetries)
-		return fmt.Errorf("failed to get last processed ID: %v", err)
-	}
-
-	// Create unique message ID to prevent loops
-	messageID := fmt.Sprintf("%s-%d-%s-%d", nodeId, lastProcessedId, table, time.Now().UnixNano())
-
-	// Mark this message as processed by us
-	processedMessages.Store(messageID, true)
-
-	// Create message with source tracking
-	msg := MulticastMessage{
-		Query:      query,
-		Args:       args,
-		PID:        lastProcessedId,
-		QueryType:  queryType,
-		Table:      table,
-		SourceNode: nodeId,
-		MessageID:  messageID,
-	}
-
-	fmt.Printf("Multicasting node : %s\n", nodeId)
-	multicastNode := tree.Root.FindNodeDFS(nodeId)
+	multicastNode := tree.Find(nodeId)
 	if multicastNode == nil {
-		return fmt.Errorf("node %s not found in tree", nodeId)
+		return nil, fmt.Errorf("node %s not found in tree", nodeId)
 	}
-
-	return multicastToChildrenWithRetry(ctx, multicastNode, msg)
+	return multicastNode, nil
 }
 
-func multicastToChildrenWithRetry(ctx context.Context, node *SpanningTreeNode, msg MulticastMessage) error {
-	var wg sync.WaitGroup
-	var mu sync.Mutex
-	failCount := 0
+// drainMulticasts waits for in-flight multicasts to finish. It returns false
+// if some were still running when the timeout expired.
+func drainMulticasts(timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for inflightMulticasts.Load() > 0 {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return true
+}
 
+// multicastToChildrenWithRetry delivers msg to every child of node and returns
+// the acks reported by their subtrees. A child that cannot be reached gets the
+// message later through hinted handoff.
+func multicastToChildrenWithRetry(ctx context.Context, node *SpanningTreeNode, msg MulticastMessage) ([]string, error) {
 	// Safe children access
 	node.mu.RLock()
 	children := make([]*SpanningTreeNode, 0, len(node.Children))
@@ -171,9 +337,21 @@ func multicastToChildrenWithRetry(ctx context.Context, node *SpanningTreeNode, m
 	}
 	node.mu.RUnlock()
 
+	return deliverWithRetry(ctx, children, msg, subtreeIDs)
+}
+
+// deliverWithRetry sends msg to each of children with retries and returns
+// their acks. A child that cannot be reached is handed off together with the
+// nodes descendants returns for it, which relied on it to pass msg on.
+func deliverWithRetry(ctx context.Context, children []*SpanningTreeNode, msg MulticastMessage, descendants func(*SpanningTreeNode) []string) ([]string, error) {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	failCount := 0
+	var acks []string
+
 	// No children - nothing to do
 	if len(children) == 0 {
-		return nil
+		return nil, nil
 	}
 
 	// Multicast to each child with retries
@@ -182,21 +360,51 @@ func multicastToChildrenWithRetry(ctx context.Context, node *SpanningTreeNode, m
 		go func(childNode *SpanningTreeNode) {
 			defer wg.Done()
 
+			// Keep the child's messages in order behind those already queued for it
+			if pending := hints.Pending(childNode.ID); pending > 0 {
+				fmt.Printf("Queueing multicast for node %s behind %d hinted messages\n", childNode.ID, pending)
+				handOff(childNode, descendants(childNode), msg)
+				if suspects.contains(childNode.ID) {
+					adoptOrphans(childNode, msg, "still suspected")
+				}
+				mu.Lock()
+				failCount++
+				mu.Unlock()
+				return
+			}
+
 			// Try multiple times with backoff
 			var err error
 			for i := 0; i < maxRetries; i++ {
 				select {
 				case <-ctx.Done():
 					// Context timeout or cancellation
+					handOff(childNode, descendants(childNode), msg)
 					mu.Lock()
 					failCount++
 					mu.Unlock()
 					return
 				default:
-					err = sendMulticast(childNode.address, msg)
+					var childAcks []string
+					childAcks, err = sendMulticast(childNode.address, msg)
 					if err == nil {
+						edgeHealth.record(childNode.ID, nil)
+						msg.ack(childAcks)
+						mu.Lock()
+						acks = append(acks, childAcks...)
+						mu.Unlock()
 						return // Success
 					}
+					var rejected *multicastRejected
+					if errors.As(err, &rejected) {
+						// Queueing it would hold every later message for the child behind it
+						edgeHealth.record(childNode.ID, nil)
+						reject(childNode, descendants(childNode), msg, rejected)
+						mu.Lock()
+						failCount++
+						mu.Unlock()
+						return
+					}
 					fmt.Printf("Retry %d: Failed to multicast to %s: %v\n", i+1, childNode.ID, err)
 					time.Sleep(retryDelay)
 				}
@@ -204,6 +412,9 @@ func multicastToChildrenWithRetry(ctx context.Context, node *SpanningTreeNode, m
 
 			// All retries failed
 			if err != nil {
+				edgeHealth.record(childNode.ID, err)
+				handOff(childNode, descendants(childNode), msg)
+				adoptOrphans(childNode, msg, fmt.Sprintf("delivery failed after %d attempts", maxRetries))
 				mu.Lock()
 				failCount++
 				fmt.Printf("All retries failed for node %s: %v\n", childNode.ID, err)
@@ -217,187 +428,229 @@ func multicastToChildrenWithRetry(ctx context.Context, node *SpanningTreeNode, m
 
 	// Continue if at least one child succeeded
 	if failCount == len(children) && len(children) > 0 {
-		return fmt.Errorf("multicast failed to all %d children", len(children))
+		return acks, fmt.Errorf("multicast failed to all %d children", len(children))
 	} else if failCount > 0 {
 		fmt.Printf("Warning: multicast partially failed (%d of %d nodes unreachable)\n",
 			failCount, len(children))
 	}
 
-	return nil
+	return acks, nil
+}
+
+// handOff queues msg for a child that did not receive it, recording the
+// nodes below it in case the child leaves the tree.
+func handOff(child *SpanningTreeNode, descendants []string, msg MulticastMessage) {
+	reportUndelivered(child, descendants, msg, "Unreachable, queued for hinted handoff")
+	if err := hints.Enqueue(child.ID, descendants, msg); err != nil {
+		fmt.Printf("Dropping multicast for node %s: %v\n", child.ID, err)
+	}
+}
+
+// multicastRejected is a delivery the receiver refused outright, such as
+// entries from a stale term or an invalid batch. Sending it again cannot
+// succeed.
+type multicastRejected struct {
+	status string
+}
+
+func (e *multicastRejected) Error() string {
+	return "multicast rejected with status: " + e.status
 }
 
-func sendMulticast(address string, msg MulticastMessage) error {
+// reject records that child refused msg, so neither it nor the descendants
+// it would have forwarded to received it. The message is not queued for it.
+func reject(child *SpanningTreeNode, descendants []string, msg MulticastMessage, rejected *multicastRejected) {
+	fmt.Printf("Node %s rejected multicast %s: %v\n", child.ID, msg.MessageID, rejected)
+	reportUndelivered(child, descendants, msg, fmt.Sprintf("Rejected with status %s", rejected.status))
+}
+
+// reportUndelivered reports msg as failed for child and for the descendants
+// that depended on it to forward it. Descendants that applied the entries
+// some other way keep that report.
+func reportUndelivered(child *SpanningTreeNode, descendants []string, msg MulticastMessage, reason string) {
+	if len(msg.Batch) == 0 {
+		return
+	}
+	for i, id := range append([]string{child.ID}, descendants...) {
+		message := reason
+		if i > 0 {
+			message = fmt.Sprintf("Parent %s: %s", child.ID, reason)
+		}
+		reportDelivery(deliveryReport{
+			Node:    id,
+			From:    msg.Batch[0].ID,
+			To:      msg.PID,
+			Status:  DeliveryFailed,
+			At:      time.Now(),
+			Message: message,
+		})
+	}
+}
+
+// sendMulticast posts msg to a child. When msg.WantAcks is set it returns the
+// acks from the child's subtree. A 4xx answer is a *multicastRejected.
+func sendMulticast(address string, msg MulticastMessage) ([]string, error) {
 	fmt.Println("Send Multicast")
 	jsonData, err := json.Marshal(msg)
 	if err != nil {
-		return fmt.Errorf("failed to marshal multicast message: %v", err)
+		return nil, fmt.Errorf("failed to marshal multicast message: %v", err)
 	}
 
-	fmt.Printf("http://%s/recvMulticast", address)
+	fmt.Printf("%s://%s/recvMulticast", urlScheme(), address)
 	fmt.Println(bytes.NewBuffer(jsonData))
 
-	client := &http.Client{
-		Timeout: httpTimeout,
-	}
+	client := newHTTPClient(httpTimeout)
 
-	resp, err := client.Post(fmt.Sprintf("http://%s/recvMulticast", address),
+	resp, err := client.Post(fmt.Sprintf("%s://%s/recvMulticast", urlScheme(), address),
 		"application/json", bytes.NewBuffer(jsonData))
 	if err != nil {
-		return fmt.Errorf("failed to send multicast: %v", err)
+		disseminationStats.recordSend(msg.Strategy, len(jsonData), err)
+		return nil, fmt.Errorf("failed to send multicast: %v", err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("multicast failed with status: %s", resp.Status)
+		var err error = fmt.Errorf("multicast failed with status: %s", resp.Status)
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			err = &multicastRejected{status: resp.Status}
+		}
+		disseminationStats.recordSend(msg.Strategy, len(jsonData), err)
+		return nil, err
 	}
+	disseminationStats.recordSend(msg.Strategy, len(jsonData), nil)
 
-	return nil
-}
-
-func recvMulticast(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("Received Multicast\n")
-	var msg MulticastMessage
-
-	err := json.NewDecoder(r.Body).Decode(&msg)
-	if err != nil {
-		fmt.Printf("Error decoding multicast message: %v\n", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
-		return
+	if !msg.WantAcks {
+		return nil, nil
 	}
-
-	// Check for duplicate messages
-	if _, seen := processedMessages.LoadOrStore(msg.MessageID, true); seen {
-		fmt.Printf("Ignoring duplicate message: %s\n", msg.MessageID)
-		w.WriteHeader(http.StatusOK) // Still return OK
-		return
+	var ack MulticastAck
+	if err := json.NewDecoder(resp.Body).Decode(&ack); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to decode multicast acks: %v", err)
 	}
+	return ack.Acks, nil
+}
 
-	// Don't process messages from ourselves
-	nodeID := os.Getenv("NODE_ID")
-	if msg.SourceNode == nodeID {
-		fmt.Printf("Ignoring message from self\n")
+// writeAcks answers a delivery, listing this node if it applied the entries and
+// its subtree's acks when the sender asked for them.
+func writeAcks(w http.ResponseWriter, msg MulticastMessage, applied bool, subtree []string) {
+	if !msg.WantAcks {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
 
-	lastProcessedId, err := getLastProcessedID()
-	if err != nil {
-		fmt.Printf("Error getting last processed ID: %v\n", err)
-		http.Error(w, "Server error", http.StatusInternalServerError)
-		return
+	acks := []string{}
+	// Witnesses apply only the cluster configuration, so they never ack user data
+	if applied && msg.storesData() {
+		acks = append(acks, os.Getenv("NODE_ID"))
 	}
+	acks = append(acks, subtree...)
 
-	fmt.Printf("Last Processed id : %d msg.PID : %d\n", lastProcessedId, msg.PID)
-	if lastProcessedId+1 != msg.PID {
-		fmt.Printf("Multicast missed -> Syncing data\n")
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(MulticastAck{Acks: acks})
+}
 
-		// Get membership list with retry
-		var mem_list map[string]*MemberInfo1
-		var leaderErr error
-		for i := 0; i < maxRetries; i++ {
-			mem_list, err = getMembershipList(os.Getenv("MEMBERSHIP_HOST"))
-			if err == nil {
-				break
-			}
-			fmt.Printf("Attempt %d: Failed to get membership list for sync: %v\n", i+1, err)
-			time.Sleep(retryDelay)
-		}
-		if err != nil {
-			fmt.Printf("Failed to get membership list after %d attempts\n", maxRetries)
-			http.Error(w, "Failed to sync: cannot get membership list", http.StatusInternalServerError)
+// recvMulticast applies a write delivered down the spanning tree and forwards it
+// to this node's children. Entries are applied strictly in log order.
+func recvMulticast(node *Node) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		fmt.Printf("Received Multicast\n")
+		var msg MulticastMessage
+
+		err := json.NewDecoder(r.Body).Decode(&msg)
+		if err != nil || len(msg.Batch) == 0 {
+			fmt.Printf("Error decoding multicast message: %v\n", err)
+			http.Error(w, "Bad request", http.StatusBadRequest)
 			return
 		}
-
-		// Get leader with retry
-		var leader *MemberInfo1
-		for i := 0; i < maxRetries; i++ {
-			leader, leaderErr = GetLeaderNode(mem_list)
-			if leaderErr == nil {
-				break
-			}
-			fmt.Printf("Attempt %d: Failed to get leader for sync: %v\n", i+1, leaderErr)
-			time.Sleep(retryDelay)
-		}
-		if leaderErr != nil {
-			fmt.Printf("Failed to get leader after %d attempts\n", maxRetries)
-			http.Error(w, "Failed to sync: cannot determine leader", http.StatusInternalServerError)
+		// Ordering relies only on the leader's numbering, so it must be consistent
+		if err := msg.validate(); err != nil {
+			fmt.Printf("Rejecting multicast %s: %v\n", msg.MessageID, err)
+			http.Error(w, fmt.Sprintf("Invalid multicast: %v", err), http.StatusBadRequest)
 			return
 		}
 
-		// Request missing logs with retry - Using correct type []map[string]interface{}
-		var logs []map[string]interface{}
-		for i := 0; i < maxRetries; i++ {
-			logs, err = requestMissingLogs(leader.Address, lastProcessedId)
-			if err == nil {
-				break
-			}
-			fmt.Printf("Attempt %d: Failed to request missing logs: %v\n", i+1, err)
-			time.Sleep(retryDelay)
-		}
-		if err != nil {
-			fmt.Printf("Error requesting missing logs after %d attempts: %v\n", maxRetries, err)
-			http.Error(w, "Failed to request logs", http.StatusInternalServerError)
+		// With mutual TLS only the node named as the source may deliver the message
+		if !peerIsNode(r.TLS, msg.SourceNode) {
+			fmt.Printf("Rejecting multicast claiming to be from node %s\n", msg.SourceNode)
+			http.Error(w, "Peer certificate does not match source node", http.StatusForbidden)
 			return
 		}
 
-		// Apply logs with retry
-		for i := 0; i < maxRetries; i++ {
-			err = applyLogs(logs)
-			if err == nil {
-				break
-			}
-			fmt.Printf("Attempt %d: Failed to apply logs: %v\n", i+1, err)
-			time.Sleep(retryDelay)
-		}
-		if err != nil {
-			fmt.Printf("Error applying logs after %d attempts: %v\n", maxRetries, err)
-			http.Error(w, "Failed to apply logs", http.StatusInternalServerError)
+		// Retried or re-parented deliveries of a position we already applied
+		if appliedPositions.Contains(msg.Term, msg.PID) {
+			fmt.Printf("Ignoring duplicate of entry %d (message %s)\n", msg.PID, msg.MessageID)
+			disseminationStats.recordReceived(msg, true)
+			writeAcks(w, msg, true, nil) // Still return OK
 			return
 		}
 
-		fmt.Println("Node synchronized successfully.")
-
-		// Verify synchronization
-		lastProcessedId, err = getLastProcessedID()
-		if err != nil {
-			fmt.Printf("Error verifying sync: %v\n", err)
-			http.Error(w, "Failed to verify sync", http.StatusInternalServerError)
+		// Don't process messages from ourselves
+		nodeID := os.Getenv("NODE_ID")
+		if msg.SourceNode == nodeID {
+			fmt.Printf("Ignoring message from self\n")
+			w.WriteHeader(http.StatusOK)
 			return
 		}
 
-		// If still out of sync after sync attempt, reject the message
-		if lastProcessedId+1 != msg.PID {
-			fmt.Printf("Node still out of sync after recovery: %d vs %d\n", lastProcessedId, msg.PID)
+		// Batches that overtook earlier ones wait in the reorder buffer
+		err = node.core.HandleEntries(msg.Batch...)
+		applied := err == nil
+		switch {
+		case errors.Is(err, consensus.ErrBuffered):
+			// Our children may be missing the earlier batches too, so forward anyway
+			fmt.Printf("Entries %d-%d arrived early, holding until the gap fills\n", msg.Batch[0].ID, msg.PID)
+		case errors.Is(err, consensus.ErrAlreadyApplied):
+			// Catch-up, the reorder buffer's fallback and anti-entropy apply
+			// entries without passing them on, so forward anyway; children
+			// that have the batch drop it as a duplicate
+			fmt.Printf("Entry %d already applied\n", msg.PID)
+			applied = true
+		case errors.Is(err, consensus.ErrStaleTerm):
+			// Sent by a leader that has since been deposed
+			fmt.Printf("Refusing entries %d-%d from an older term\n", msg.Batch[0].ID, msg.PID)
+			http.Error(w, "Entries are from an older term", http.StatusConflict)
+			return
+		case errors.Is(err, consensus.ErrNoLeader):
+			fmt.Printf("Multicast missed and no leader to sync from\n")
+			http.Error(w, "Failed to sync: cannot determine leader", http.StatusInternalServerError)
+			return
+		case errors.Is(err, consensus.ErrOutOfSync):
+			fmt.Printf("Node still out of sync after recovery: entry %d\n", msg.PID)
 			http.Error(w, "Node still out of sync after recovery", http.StatusInternalServerError)
 			return
+		case err != nil:
+			fmt.Printf("Error applying entry %d: %v\n", msg.PID, err)
+			http.Error(w, fmt.Sprintf("Error executing query: %v", err), http.StatusInternalServerError)
+			return
 		}
-	}
 
-	// Execute the query with proper error handling
-	rows, err := db.Query(msg.Query, msg.Args...)
-	if err != nil {
-		fmt.Printf("Error executing query: %v\n", err)
-		http.Error(w, fmt.Sprintf("Error executing query: %v", err), http.StatusInternalServerError)
-		return
-	}
-	defer rows.Close()
-
-	// Log the transaction
-	err = logTransaction(msg.QueryType, msg.Table, msg.Query, msg.Args...)
-	if err != nil {
-		fmt.Printf("Error logging transaction: %v\n", err)
-		// Continue despite logging error
-	}
+		disseminationStats.recordReceived(msg, errors.Is(err, consensus.ErrAlreadyApplied))
+		if applied {
+			appliedPositions.Add(msg.Term, msg.PID)
+			fmt.Printf("Received Multicast Message: entries %d-%d\n", msg.Batch[0].ID, msg.PID)
+		}
 
-	fmt.Printf("Received Multicast Message: Query = %s, Args = %v\n", msg.Query, msg.Args)
+		if msg.WantAcks {
+			// The leader is waiting on a write concern, so forward before answering
+			inflightMulticasts.Add(1)
+			subtree, err := forwardMulticast(msg, nodeID)
+			inflightMulticasts.Add(-1)
+			if err != nil {
+				fmt.Printf("Error forwarding multicast: %v\n", err)
+			}
+			writeAcks(w, msg, applied, subtree)
+			return
+		}
 
-	// Send success response first
-	w.WriteHeader(http.StatusOK)
+		// Send success response first
+		w.WriteHeader(http.StatusOK)
 
-	// Forward multicast in background to avoid blocking
-	go func() {
-		if err := multicast(msg.Query, msg.Args, nodeID, msg.Table, msg.QueryType); err != nil {
-			fmt.Printf("Error forwarding multicast: %v\n", err)
-		}
-	}()
+		// Forward multicast in background to avoid blocking
+		inflightMulticasts.Add(1)
+		go func() {
+			defer inflightMulticasts.Add(-1)
+			if _, err := forwardMulticast(msg, nodeID); err != nil {
+				fmt.Printf("Error forwarding multicast: %v\n", err)
+			}
+		}()
+	}
 }
@@ -0,0 +1,275 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Replicated writes are typed operations rather than SQL. The leader turns a
+// validated request into an Operation and logs its JSON encoding, and every
+// node, the leader included, applies it through applyOperation. Replicas
+// never execute SQL they were sent.
+const operationVersion = 1
+
+// OperationKind names the write an Operation performs.
+type OperationKind string
+
+const (
+	OpUpsertUser     OperationKind = "UpsertUser"
+	OpDeleteUser     OperationKind = "DeleteUser"
+	OpDeleteAllUsers OperationKind = "DeleteAllUsers"
+	OpSetVoters      OperationKind = "SetVoters"
+	OpMigrate        OperationKind = "Migrate"
+)
+
+// userRoles are the role columns of the users table, in apply order.
+var userRoles = []string{"R1", "R2", "R3", "R4"}
+
+// Operation is the versioned envelope stored in the transaction log. Exactly
+// the field matching Kind is set.
+type Operation struct {
+	Version    int           `json:"v"`
+	Kind       OperationKind `json:"kind"`
+	UpsertUser *UpsertUser   `json:"upsert_user,omitempty"`
+	DeleteUser *DeleteUser   `json:"delete_user,omitempty"`
+	SetVoters  *SetVoters    `json:"set_voters,omitempty"`
+	Migrate    *Migrate      `json:"migrate,omitempty"`
+}
+
+// UpsertUser creates a user or changes an existing one. PasswordHash is set
+// when the user is created, and only the roles present are written.
+type UpsertUser struct {
+	Email        string          `json:"email"`
+	PasswordHash string          `json:"password_hash,omitempty"`
+	Roles        map[string]bool `json:"roles,omitempty"` // Keyed R1..R4
+}
+
+// DeleteUser removes a user.
+type DeleteUser struct {
+	Email string `json:"email"`
+}
+
+// SetVoters commits a new voter configuration.
+type SetVoters struct {
+	Voters []int `json:"voters"`
+}
+
+// encodeOperation validates op and returns its log encoding.
+func encodeOperation(op Operation) (json.RawMessage, error) {
+	op.Version = operationVersion
+	if err := op.validate(); err != nil {
+		return nil, err
+	}
+	return json.Marshal(op)
+}
+
+// decodeOperation parses and validates a logged operation.
+func decodeOperation(data []byte) (Operation, error) {
+	var op Operation
+	if len(data) == 0 {
+		return op, fmt.Errorf("entry has no operation")
+	}
+	if err := json.Unmarshal(data, &op); err != nil {
+		return op, fmt.Errorf("error decoding operation: %v", err)
+	}
+	if op.Version != operationVersion {
+		return op, fmt.Errorf("unsupported operation version %d", op.Version)
+	}
+	if err := op.validate(); err != nil {
+		return op, err
+	}
+	return op, nil
+}
+
+// validate checks that op is well formed, so a bad entry is refused before
+// anything is applied.
+func (op Operation) validate() error {
+	switch op.Kind {
+	case OpUpsertUser:
+		if op.UpsertUser == nil || op.UpsertUser.Email == "" {
+			return fmt.Errorf("%s requires an email", op.Kind)
+		}
+		for role := range op.UpsertUser.Roles {
+			if !isUserRole(role) {
+				return fmt.Errorf("unknown role %s", role)
+			}
+		}
+		if op.UpsertUser.PasswordHash == "" && len(op.UpsertUser.Roles) == 0 {
+			return fmt.Errorf("%s changes nothing", op.Kind)
+		}
+	case OpDeleteUser:
+		if op.DeleteUser == nil || op.DeleteUser.Email == "" {
+			return fmt.Errorf("%s requires an email", op.Kind)
+		}
+	case OpDeleteAllUsers:
+	case OpSetVoters:
+		if op.SetVoters == nil || len(op.SetVoters.Voters) == 0 {
+			return fmt.Errorf("%s requires at least one voter", op.Kind)
+		}
+	case OpMigrate:
+		if op.Migrate == nil || op.Migrate.Version <= 0 || op.Migrate.Checksum == "" {
+			return fmt.Errorf("%s requires a version and checksum", op.Kind)
+		}
+	default:
+		return fmt.Errorf("unknown operation %q", op.Kind)
+	}
+	return nil
+}
+
+// table returns the table op writes to.
+func (op Operation) table() string {
+	switch op.Kind {
+	case OpSetVoters:
+		return configTable
+	case OpMigrate:
+		return schemaTable
+	}
+	return "users"
+}
+
+// String describes op for the transaction log's query column.
+func (op Operation) String() string {
+	switch op.Kind {
+	case OpUpsertUser:
+		parts := []string{string(op.Kind), op.UpsertUser.Email}
+		if op.UpsertUser.PasswordHash != "" {
+			parts = append(parts, "password=<hash>")
+		}
+		for _, role := range userRoles {
+			if value, ok := op.UpsertUser.Roles[role]; ok {
+				parts = append(parts, fmt.Sprintf("%s=%t", role, value))
+			}
+		}
+		return strings.Join(parts, " ")
+	case OpDeleteUser:
+		return fmt.Sprintf("%s %s", op.Kind, op.DeleteUser.Email)
+	case OpSetVoters:
+		return fmt.Sprintf("%s %s", op.Kind, formatVoters(op.SetVoters.Voters))
+	case OpMigrate:
+		return fmt.Sprintf("%s %d %s", op.Kind, op.Migrate.Version, op.Migrate.Name)
+	}
+	return string(op.Kind)
+}
+
+func isUserRole(name string) bool {
+	for _, role := range userRoles {
+		if role == name {
+			return true
+		}
+	}
+	return false
+}
+
+// applyOperation performs op, logged at position, within tx. It is the only
+// way replicated writes reach the store, on the leader and on every replica.
+func applyOperation(tx StoreTx, op Operation, position int) (int64, error) {
+	var rowsAffected int64
+	var err error
+
+	switch op.Kind {
+	case OpUpsertUser:
+		rowsAffected, err = tx.UpsertUser(op.UpsertUser)
+	case OpDeleteUser:
+		rowsAffected, err = tx.DeleteUser(op.DeleteUser.Email)
+	case OpDeleteAllUsers:
+		rowsAffected, err = tx.DeleteAllUsers()
+	case OpSetVoters:
+		err = tx.AddConfig(op.SetVoters.Voters)
+		rowsAffected = 1
+	case OpMigrate:
+		err = applyMigration(tx, op.Migrate, position)
+	default:
+		return 0, fmt.Errorf("unknown operation %q", op.Kind)
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error applying %s: %v", op.Kind, err)
+	}
+	return rowsAffected, nil
+}
+
+// operationFromRequest maps a write request from the middleware onto a typed
+// operation. Writes are limited to the users table, selected by email.
+func operationFromRequest(req QueryRequest) (Operation, error) {
+	if req.Table != "users" {
+		return Operation{}, fmt.Errorf("writes are only supported on the users table")
+	}
+
+	switch req.Type {
+	case QueryTypeInsert:
+		email := req.Values["email"]
+		if email == "" {
+			return Operation{}, fmt.Errorf("email is required for user creation")
+		}
+		roles, err := parseRoles(req.Values, "email", "password_hash")
+		if err != nil {
+			return Operation{}, err
+		}
+		return Operation{Kind: OpUpsertUser, UpsertUser: &UpsertUser{
+			Email:        email,
+			PasswordHash: req.Values["password_hash"],
+			Roles:        roles,
+		}}, nil
+	case QueryTypeUpdate:
+		email, err := emailFromWhere(req.Where)
+		if err != nil {
+			return Operation{}, err
+		}
+		roles, err := parseRoles(req.Values)
+		if err != nil {
+			return Operation{}, err
+		}
+		return Operation{Kind: OpUpsertUser, UpsertUser: &UpsertUser{Email: email, Roles: roles}}, nil
+	case QueryTypeDelete:
+		if req.DeleteAll && len(req.Where) == 0 {
+			return Operation{Kind: OpDeleteAllUsers}, nil
+		}
+		email, err := emailFromWhere(req.Where)
+		if err != nil {
+			return Operation{}, err
+		}
+		return Operation{Kind: OpDeleteUser, DeleteUser: &DeleteUser{Email: email}}, nil
+	}
+	return Operation{}, fmt.Errorf("invalid query type: %s", req.Type)
+}
+
+// parseRoles reads the role columns from values. Any other column that is
+// not listed in allowed is rejected.
+func parseRoles(values map[string]string, allowed ...string) (map[string]bool, error) {
+	roles := make(map[string]bool)
+	columns := make([]string, 0, len(values))
+	for column := range values {
+		columns = append(columns, column)
+	}
+	sort.Strings(columns)
+
+	for _, column := range columns {
+		name := strings.ToUpper(column)
+		if !isUserRole(name) {
+			known := false
+			for _, a := range allowed {
+				known = known || a == column
+			}
+			if !known {
+				return nil, fmt.Errorf("column %s cannot be written", column)
+			}
+			continue
+		}
+		value, err := strconv.ParseBool(values[column])
+		if err != nil {
+			return nil, fmt.Errorf("invalid value for %s: %q", column, values[column])
+		}
+		roles[name] = value
+	}
+	return roles, nil
+}
+
+// emailFromWhere returns the email a write is restricted to.
+func emailFromWhere(where map[string]string) (string, error) {
+	if len(where) != 1 || where["email"] == "" {
+		return "", fmt.Errorf("writes must select a single user by email")
+	}
+	return where["email"], nil
+}
@@ -0,0 +1,354 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Orphan repair: a parent that cannot reach a child, because a multicast to
+// it failed after every retry or it missed EDGE_HEARTBEAT_MISSES edge
+// heartbeats in a row, suspects the child of having failed. It takes the
+// child's children as its own straight away, redelivers to them the messages
+// queued for the child, which they missed, and reports the suspect to the
+// leader. The leader leaves suspects out of the tree it publishes until
+// TREE_SUSPECT_TTL passes, so every node converges on the repaired tree at the
+// next epoch. Messages the failed node accepted but never forwarded show up as
+// a gap at its orphans, which fetch them through the reorder buffer's fallback.
+const (
+	defaultSuspectTTL        = 30 * time.Second
+	defaultEdgeHeartbeatMiss = 3
+	edgeHeartbeatTimeout     = time.Second
+)
+
+// suspectSet holds the nodes suspected of having failed, until their
+// suspicion expires.
+type suspectSet struct {
+	mu    sync.Mutex
+	until map[string]time.Time
+}
+
+var (
+	suspects = &suspectSet{until: make(map[string]time.Time)}
+
+	orphansAdopted   atomic.Int64 // Children taken over from a failed parent
+	orphanRedelivery atomic.Int64 // Messages redelivered to them
+)
+
+// suspectTTL reads TREE_SUSPECT_TTL, how long a suspected node stays out of
+// the tree before it is tried again.
+func suspectTTL() time.Duration {
+	if value := os.Getenv("TREE_SUSPECT_TTL"); value != "" {
+		if d, err := time.ParseDuration(value); err == nil && d > 0 {
+			return d
+		}
+		log.Printf("Invalid TREE_SUSPECT_TTL %q, using %v", value, defaultSuspectTTL)
+	}
+	return defaultSuspectTTL
+}
+
+// edgeHeartbeatMisses reads EDGE_HEARTBEAT_MISSES, the missed edge heartbeats
+// after which a child is suspected.
+func edgeHeartbeatMisses() int {
+	if value := os.Getenv("EDGE_HEARTBEAT_MISSES"); value != "" {
+		if n, err := strconv.Atoi(value); err == nil && n > 0 {
+			return n
+		}
+		log.Printf("Invalid EDGE_HEARTBEAT_MISSES %q, using %d", value, defaultEdgeHeartbeatMiss)
+	}
+	return defaultEdgeHeartbeatMiss
+}
+
+// add suspects node, returning false if it already was.
+func (s *suspectSet) add(node string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	already := time.Now().Before(s.until[node])
+	s.until[node] = time.Now().Add(suspectTTL())
+	return !already
+}
+
+// contains reports whether node is suspected.
+func (s *suspectSet) contains(node string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return time.Now().Before(s.until[node])
+}
+
+// filter returns members without the suspected nodes. The leader is never
+// left out, since the tree is rooted at it.
+func (s *suspectSet) filter(members map[string]*MemberInfo1, leader string) map[string]*MemberInfo1 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	filtered := make(map[string]*MemberInfo1, len(members))
+	for id, member := range members {
+		if until, ok := s.until[id]; ok && now.Before(until) && id != leader {
+			continue
+		}
+		filtered[id] = member
+	}
+	for id, until := range s.until {
+		if !now.Before(until) {
+			delete(s.until, id)
+		}
+	}
+	return filtered
+}
+
+// count returns the number of suspected nodes.
+func (s *suspectSet) count() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	for _, until := range s.until {
+		if time.Now().Before(until) {
+			n++
+		}
+	}
+	return n
+}
+
+// Reparent removes failed from the tree and hands its children to its parent,
+// returning them. The parent may exceed the fan-out until the leader
+// publishes a tree without failed. The root cannot be reparented. A repaired
+// tree adopted from the leader still counts as that epoch's, so it is kept
+// until a newer epoch arrives rather than fetched over with the unrepaired one.
+func (s *SpanningTree) Reparent(failed string) []*SpanningTreeNode {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node := s.Root.FindNodeDFS(failed)
+	if node == nil || node.Parent == nil {
+		return nil
+	}
+	parent := node.Parent
+	adopted := s.members == nil && s.Version == s.published
+
+	node.mu.Lock()
+	orphans := append([]*SpanningTreeNode(nil), node.Children...)
+	node.Children = nil
+	node.mu.Unlock()
+
+	parent.mu.Lock()
+	for i, child := range parent.Children {
+		if child == node {
+			parent.Children = append(parent.Children[:i], parent.Children[i+1:]...)
+			break
+		}
+	}
+	parent.Children = append(parent.Children, orphans...)
+	parent.mu.Unlock()
+	for _, orphan := range orphans {
+		orphan.Parent = parent
+	}
+	node.Parent = nil
+
+	if s.members != nil {
+		members := make(map[string]*MemberInfo1, len(s.members))
+		for id, member := range s.members {
+			if id != failed {
+				members[id] = member
+			}
+		}
+		s.members = members
+	}
+	s.Version++
+	if adopted {
+		s.published = s.Version
+	}
+	return orphans
+}
+
+// adoptOrphans handles the failure of child on the forwarding path: its
+// children are reparented to this node, get the messages queued for child and
+// the leader is told to leave child out of the tree.
+func adoptOrphans(child *SpanningTreeNode, msg MulticastMessage, reason string) {
+	// Only the tree routes through children; other strategies have no orphans
+	if msg.Strategy != StrategyTree {
+		return
+	}
+	if suspects.add(child.ID) {
+		log.Printf("Suspecting node %s: %s", child.ID, reason)
+		go func() {
+			if err := reportSuspect(child.ID); err != nil {
+				log.Printf("Failed to report suspected node %s to the leader: %v", child.ID, err)
+			}
+		}()
+	}
+
+	orphans := GetGlobalTree().Reparent(child.ID)
+	if len(orphans) == 0 {
+		return
+	}
+	orphansAdopted.Add(int64(len(orphans)))
+	fmt.Printf("Adopted %d orphans of node %s\n", len(orphans), child.ID)
+	hints.redeliver(child.ID, orphans)
+}
+
+// suspectReport is the body of a POST to /tree/suspect.
+type suspectReport struct {
+	Node     string `json:"node"`
+	Reporter string `json:"reporter"`
+}
+
+// reportSuspect tells the leader that node seems to have failed.
+func reportSuspect(node string) error {
+	members, err := getMembershipList(os.Getenv("MEMBERSHIP_HOST"))
+	if err != nil {
+		return err
+	}
+	leader, err := GetLeaderNode(members)
+	if err != nil {
+		return err
+	}
+	self := os.Getenv("NODE_ID")
+	if leader.ID == self {
+		return nil
+	}
+
+	data, err := json.Marshal(suspectReport{Node: node, Reporter: self})
+	if err != nil {
+		return fmt.Errorf("failed to marshal suspect report: %v", err)
+	}
+	resp, err := newHTTPClient(httpTimeout).Post(fmt.Sprintf("%s://%s/tree/suspect", urlScheme(), leader.Address), "application/json", bytes.NewBuffer(data))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("error response (%s): %s", resp.Status, string(body))
+	}
+	return nil
+}
+
+// handleTreeSuspect accepts a suspected node on the leader, which leaves it
+// out of the next tree it publishes.
+func handleTreeSuspect(node *Node) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var report suspectReport
+		if err := json.NewDecoder(r.Body).Decode(&report); err != nil || report.Node == "" {
+			http.Error(w, "Invalid suspect report", http.StatusBadRequest)
+			return
+		}
+		if !peerIsNode(r.TLS, report.Reporter) {
+			http.Error(w, "Peer certificate does not match reporter", http.StatusForbidden)
+			return
+		}
+		if !node.core.IsLeader() {
+			http.Error(w, "Node is not the leader", http.StatusServiceUnavailable)
+			return
+		}
+		if report.Node == strconv.Itoa(node.ID) {
+			http.Error(w, "The leader cannot be left out of the tree", http.StatusConflict)
+			return
+		}
+		if suspects.add(report.Node) {
+			log.Printf("Node %d: Node %s reported node %s as failed, leaving it out of the tree", node.ID, report.Reporter, report.Node)
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// probeEdge sends one probe to peer on the election port.
+func probeEdge(self, peer int) error {
+	conn, err := dialTCP(fmt.Sprintf("node-%d:%d", peer, basePort+peer), edgeHeartbeatTimeout)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(edgeHeartbeatTimeout))
+
+	if err := json.NewEncoder(conn).Encode(Message{Type: "Ping", Ping: LinkProbe{From: self}}); err != nil {
+		return err
+	}
+	var pong struct{}
+	return json.NewDecoder(conn).Decode(&pong)
+}
+
+// runEdgeHeartbeats pings this node's children in the tree every heartbeat
+// interval and treats a child that misses EDGE_HEARTBEAT_MISSES in a row as
+// failed, so a dead interior node is found even when no writes flow.
+func runEdgeHeartbeats(ctx context.Context, node *Node) {
+	if disseminationStrategy() != StrategyTree {
+		return
+	}
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	self := strconv.Itoa(node.ID)
+	misses := make(map[string]int)
+	limit := edgeHeartbeatMisses()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		tree := GetGlobalTree()
+		position := tree.Find(self)
+		if position == nil {
+			continue
+		}
+		position.mu.RLock()
+		children := append([]*SpanningTreeNode(nil), position.Children...)
+		position.mu.RUnlock()
+
+		var mu sync.Mutex
+		var wg sync.WaitGroup
+		for _, child := range children {
+			peer, err := strconv.Atoi(child.ID)
+			if err != nil {
+				continue
+			}
+			wg.Add(1)
+			go func(child *SpanningTreeNode, peer int) {
+				defer wg.Done()
+				err := probeEdge(node.ID, peer)
+
+				mu.Lock()
+				defer mu.Unlock()
+				if err == nil {
+					delete(misses, child.ID)
+					return
+				}
+				if misses[child.ID]++; misses[child.ID] >= limit {
+					delete(misses, child.ID)
+					adoptOrphans(child, MulticastMessage{Strategy: StrategyTree}, fmt.Sprintf("missed %d edge heartbeats", limit))
+				}
+			}(child, peer)
+		}
+		wg.Wait()
+	}
+}
+
+// writeOrphanMetrics writes the orphan repair metrics in Prometheus text format.
+func writeOrphanMetrics(w io.Writer, nodeID int) {
+	fmt.Fprintf(w, "# HELP node_tree_suspects Nodes left out of the tree as suspected failures\n")
+	fmt.Fprintf(w, "# TYPE node_tree_suspects gauge\n")
+	fmt.Fprintf(w, "node_tree_suspects{node_id=\"%d\"} %d\n", nodeID, suspects.count())
+
+	fmt.Fprintf(w, "# HELP node_tree_orphans_adopted_total Children taken over from a failed parent\n")
+	fmt.Fprintf(w, "# TYPE node_tree_orphans_adopted_total counter\n")
+	fmt.Fprintf(w, "node_tree_orphans_adopted_total{node_id=\"%d\"} %d\n", nodeID, orphansAdopted.Load())
+
+	fmt.Fprintf(w, "# HELP node_tree_orphan_redeliveries_total Messages redelivered to adopted orphans\n")
+	fmt.Fprintf(w, "# TYPE node_tree_orphan_redeliveries_total counter\n")
+	fmt.Fprintf(w, "node_tree_orphan_redeliveries_total{node_id=\"%d\"} %d\n", nodeID, orphanRedelivery.Load())
+}
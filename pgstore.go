@@ -0,0 +1,674 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq" // PostgreSQL driver
+)
+
+// postgresStore keeps the node's data in the Postgres server at DB_HOST.
+type postgresStore struct {
+	db *sql.DB
+}
+
+// postgresConnString builds the connection string from DB_HOST, DB_USER,
+// DB_PASSWORD, DB_NAME and DB_SSLMODE. Anything left unset falls back to the
+// driver's PG* environment variables.
+func postgresConnString() (string, error) {
+	dbHost := os.Getenv("DB_HOST") // Use DB_HOST set in docker-compose
+	if dbHost == "" {
+		return "", fmt.Errorf("DB_HOST environment variable not set")
+	}
+	params := []string{"host=" + dbHost}
+	for _, setting := range []struct{ env, key, fallback string }{
+		{"DB_USER", "user", "postgres"},
+		{"DB_PASSWORD", "password", ""},
+		{"DB_NAME", "dbname", "nodedb"},
+		{"DB_SSLMODE", "sslmode", "disable"},
+	} {
+		value := os.Getenv(setting.env)
+		if value == "" {
+			value = setting.fallback
+		}
+		if value != "" {
+			params = append(params, fmt.Sprintf("%s='%s'", setting.key, strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value)))
+		}
+	}
+	return strings.Join(params, " "), nil
+}
+
+// openPostgresStore connects to the database. Its tables are created by the
+// startup migrations.
+func openPostgresStore() (*postgresStore, error) {
+	connStr, err := postgresConnString()
+	if err != nil {
+		return nil, err
+	}
+	db, err := sql.Open("postgres", connStr)
+	if err != nil {
+		return nil, fmt.Errorf("error connecting to database: %v", err)
+	}
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("error pinging database: %v", err)
+	}
+	log.Printf("Node %s successfully connected to database on host %s\n", os.Getenv("NODE_ID"), os.Getenv("DB_HOST"))
+
+	s := &postgresStore{db: db}
+	if err := s.createMigrationsTable(); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+// createMigrationsTable creates schema_migrations, the one table that is
+// not created by a migration.
+func (s *postgresStore) createMigrationsTable() error {
+	_, err := s.db.Exec(`
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version INTEGER PRIMARY KEY,
+			name TEXT NOT NULL,
+			checksum TEXT NOT NULL, -- SHA-256 of the migration, verified on every start
+			log_position INTEGER NOT NULL, -- Log position it ran at
+			startup BOOLEAN NOT NULL, -- Ran when the store opened rather than from the log
+			applied_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+		)
+	`)
+	if err != nil {
+		return fmt.Errorf("error creating schema_migrations table: %v", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) Name() string { return "postgres" }
+
+// Select runs the SELECT built from the request.
+func (s *postgresStore) Select(table string, fields []string, where map[string]string) ([]map[string]interface{}, error) {
+	query, args := buildSelectQuery(QueryRequest{Type: QueryTypeSelect, Table: table, Fields: fields, Where: where})
+
+	// Debug logging
+	log.Printf("Executing query: %s\nWith args: %v\n", query, args)
+
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return scanRowsToMap(rows)
+}
+
+// Users returns every user, ordered by email.
+func (s *postgresStore) Users() ([]UserRecord, error) {
+	return queryUsers(s.db)
+}
+
+// LastLogID retrieves the ID of the most recent entry in the transaction log.
+func (s *postgresStore) LastLogID() (int, error) {
+	var lastID int
+	// Use COALESCE to handle the case where the table is empty
+	if err := s.db.QueryRow("SELECT COALESCE(MAX(id), 0) FROM transaction_log").Scan(&lastID); err != nil {
+		return 0, fmt.Errorf("error retrieving last processed ID: %v", err)
+	}
+	return lastID, nil
+}
+
+// LatestLogEntry returns the ID and time of the most recent entry.
+func (s *postgresStore) LatestLogEntry() (int, time.Time, error) {
+	var lastID int
+	var lastTimestamp time.Time
+
+	err := s.db.QueryRow("SELECT id, timestamp FROM transaction_log ORDER BY id DESC LIMIT 1").Scan(&lastID, &lastTimestamp)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// Table is empty, return 0 and zero time, not an error
+			return 0, time.Time{}, nil
+		}
+		return 0, time.Time{}, fmt.Errorf("error retrieving latest log entry: %v", err)
+	}
+	return lastID, lastTimestamp, nil
+}
+
+// LogsAfter retrieves the entries after lastID.
+func (s *postgresStore) LogsAfter(lastID int) ([]LogRecord, error) {
+	return queryLogs(s.db, "WHERE id > $1", lastID)
+}
+
+// LatestConfig returns the latest voter configuration.
+func (s *postgresStore) LatestConfig() (*ClusterConfig, error) {
+	var config ClusterConfig
+	var voters string
+	err := s.db.QueryRow("SELECT id, voters FROM cluster_config ORDER BY id DESC LIMIT 1").Scan(&config.ID, &voters)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, errNoClusterConfig
+		}
+		return nil, fmt.Errorf("error loading cluster configuration: %v", err)
+	}
+	config.Voters, err = parseVoters(voters)
+	if err != nil {
+		return nil, err
+	}
+	return &config, nil
+}
+
+// HintCounts counts the queued hints by destination.
+func (s *postgresStore) HintCounts() (map[string]int, error) {
+	rows, err := s.db.Query("SELECT destination, COUNT(*) FROM hinted_handoff GROUP BY destination")
+	if err != nil {
+		return nil, fmt.Errorf("error loading hinted handoff queue: %v", err)
+	}
+	defer rows.Close()
+
+	counts := make(map[string]int)
+	for rows.Next() {
+		var destination string
+		var count int
+		if err := rows.Scan(&destination, &count); err != nil {
+			return nil, fmt.Errorf("error scanning hinted handoff queue: %v", err)
+		}
+		counts[destination] = count
+	}
+	return counts, rows.Err()
+}
+
+// Hints returns destination's hints in the order they were stored.
+func (s *postgresStore) Hints(destination string) ([]HintRecord, error) {
+	return queryHints(s.db, "WHERE destination = $1", destination)
+}
+
+func (s *postgresStore) AddHint(destination string, descendants []string, message string) error {
+	_, err := s.db.Exec("INSERT INTO hinted_handoff (destination, descendants, message) VALUES ($1, $2, $3)",
+		destination, strings.Join(descendants, ","), message)
+	return err
+}
+
+func (s *postgresStore) RemoveHint(id int) (bool, error) {
+	n, err := rowsAffected(s.db.Exec("DELETE FROM hinted_handoff WHERE id = $1", id))
+	return n > 0, err
+}
+
+func (s *postgresStore) TrimHints(destination string, keep int) (int, error) {
+	n, err := rowsAffected(s.db.Exec(`DELETE FROM hinted_handoff WHERE id IN (
+		SELECT id FROM hinted_handoff WHERE destination = $1 ORDER BY id DESC OFFSET $2)`, destination, keep))
+	return int(n), err
+}
+
+// Migrations reads schema_migrations.
+func (s *postgresStore) Migrations() ([]AppliedMigration, error) {
+	return queryMigrations(s.db)
+}
+
+// Begin starts a database transaction.
+func (s *postgresStore) Begin() (StoreTx, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	return &postgresTx{tx: tx}, nil
+}
+
+// Snapshot reads every table within one repeatable read transaction.
+func (s *postgresStore) Snapshot() (*Snapshot, error) {
+	tx, err := s.db.BeginTx(context.Background(), &sql.TxOptions{Isolation: sql.LevelRepeatableRead, ReadOnly: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin snapshot transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	snapshot := &Snapshot{Store: s.Name(), Taken: time.Now()}
+	if snapshot.Users, err = queryUsers(tx); err != nil {
+		return nil, err
+	}
+	if snapshot.Log, err = queryLogs(tx, ""); err != nil {
+		return nil, err
+	}
+	if len(snapshot.Log) > 0 {
+		snapshot.Position = snapshot.Log[len(snapshot.Log)-1].ID
+	}
+	if snapshot.Configs, err = queryConfigs(tx); err != nil {
+		return nil, err
+	}
+	if snapshot.Hints, err = queryHints(tx, ""); err != nil {
+		return nil, err
+	}
+	if snapshot.Migrations, err = queryMigrations(tx); err != nil {
+		return nil, err
+	}
+	return snapshot, nil
+}
+
+// Restore replaces the contents of every table with snapshot.
+func (s *postgresStore) Restore(snapshot *Snapshot) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin restore transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	for _, table := range []string{"users", "transaction_log", "cluster_config", "hinted_handoff"} {
+		if _, err := tx.Exec("DELETE FROM " + table); err != nil {
+			return fmt.Errorf("error clearing %s: %v", table, err)
+		}
+	}
+	for _, u := range snapshot.Users {
+		args := []interface{}{u.Email, u.PasswordHash}
+		for _, role := range userRoles {
+			if value, ok := u.Roles[role]; ok {
+				args = append(args, value)
+			} else {
+				args = append(args, nil)
+			}
+		}
+		if _, err := tx.Exec("INSERT INTO users (email, password_hash, R1, R2, R3, R4) VALUES ($1, $2, $3, $4, $5, $6)", args...); err != nil {
+			return fmt.Errorf("error restoring user %s: %v", u.Email, err)
+		}
+	}
+	for _, r := range snapshot.Log {
+		if _, err := tx.Exec("INSERT INTO transaction_log (id, term, type, table_name, query, operation, timestamp) VALUES ($1, $2, $3, $4, $5, $6, $7)",
+			r.ID, r.Term, r.Type, r.Table, r.Query, nullString(r.Operation), r.Timestamp); err != nil {
+			return fmt.Errorf("error restoring log entry %d: %v", r.ID, err)
+		}
+	}
+	for _, c := range snapshot.Configs {
+		if _, err := tx.Exec("INSERT INTO cluster_config (id, voters, created_at) VALUES ($1, $2, $3)", c.ID, formatVoters(c.Voters), c.CreatedAt); err != nil {
+			return fmt.Errorf("error restoring configuration %d: %v", c.ID, err)
+		}
+	}
+	for _, h := range snapshot.Hints {
+		if _, err := tx.Exec("INSERT INTO hinted_handoff (id, destination, descendants, message, created_at) VALUES ($1, $2, $3, $4, $5)",
+			h.ID, h.Destination, strings.Join(h.Descendants, ","), h.Message, h.CreatedAt); err != nil {
+			return fmt.Errorf("error restoring hinted message %d: %v", h.ID, err)
+		}
+	}
+
+	// The replicated migrations are the snapshot's; run the ones this database has not
+	local, err := queryMigrations(tx)
+	if err != nil {
+		return err
+	}
+	done := make(map[int]bool)
+	for _, a := range local {
+		done[a.Version] = true
+	}
+	if _, err := tx.Exec("DELETE FROM schema_migrations WHERE NOT startup"); err != nil {
+		return fmt.Errorf("error clearing schema_migrations: %v", err)
+	}
+	pt := &postgresTx{tx: tx}
+	for _, a := range snapshot.Migrations {
+		if a.Startup {
+			continue
+		}
+		if !done[a.Version] {
+			m, ok := findMigration(a.Version)
+			if !ok || m.Checksum() != a.Checksum {
+				return fmt.Errorf("snapshot has migration %d (%s), which this build does not know", a.Version, a.Name)
+			}
+			if err := pt.ApplyMigration(m); err != nil {
+				return fmt.Errorf("error applying migration %d: %v", a.Version, err)
+			}
+		}
+		if err := pt.RecordMigration(a); err != nil {
+			return fmt.Errorf("error restoring migration %d: %v", a.Version, err)
+		}
+	}
+
+	// Explicit ids leave the sequences behind the restored rows
+	for _, table := range []string{"transaction_log", "cluster_config", "hinted_handoff"} {
+		query := fmt.Sprintf("SELECT setval('%s_id_seq', COALESCE((SELECT MAX(id) FROM %s), 0) + 1, false)", table, table)
+		if _, err := tx.Exec(query); err != nil {
+			return fmt.Errorf("error advancing %s sequence: %v", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// Reset deletes the users, the log, the voter configuration and the hint
+// queue, and restarts the log's sequence.
+func (s *postgresStore) Reset() error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Delete all users
+	if _, err := tx.Exec("DELETE FROM users"); err != nil {
+		return fmt.Errorf("error deleting users: %v", err)
+	}
+	// Delete all transaction logs
+	if _, err := tx.Exec("DELETE FROM transaction_log"); err != nil {
+		return fmt.Errorf("error deleting transaction logs: %v", err)
+	}
+	// Delete the voter configuration so the next leader bootstraps a fresh one
+	if _, err := tx.Exec("DELETE FROM cluster_config"); err != nil {
+		return fmt.Errorf("error deleting cluster configuration: %v", err)
+	}
+	// Queued messages belong to the log that is gone
+	if _, err := tx.Exec("DELETE FROM hinted_handoff"); err != nil {
+		return fmt.Errorf("error deleting hinted handoff queue: %v", err)
+	}
+	// The replicated migrations run again when the next leader logs them
+	if _, err := tx.Exec("DELETE FROM schema_migrations WHERE NOT startup"); err != nil {
+		return fmt.Errorf("error deleting replicated migrations: %v", err)
+	}
+	// Reset sequence for transaction_log table
+	// (This line is crucial for resetting the last log ID)
+	if _, err := tx.Exec("ALTER SEQUENCE transaction_log_id_seq RESTART WITH 1"); err != nil {
+		return fmt.Errorf("error resetting sequence: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error committing transaction: %v", err)
+	}
+	return nil
+}
+
+func (s *postgresStore) Close() error {
+	return s.db.Close()
+}
+
+// postgresTx is a write transaction on the database.
+type postgresTx struct {
+	tx      *sql.Tx
+	lastLog int // Highest position logged, to advance the sequence at commit
+}
+
+// LastLogID locks the transaction log and reads its end.
+func (t *postgresTx) LastLogID() (int, error) {
+	// Hold the log while reading its end and appending after it
+	if _, err := t.tx.Exec("LOCK TABLE transaction_log IN EXCLUSIVE MODE"); err != nil {
+		return 0, fmt.Errorf("failed to lock transaction log: %v", err)
+	}
+	var last int
+	if err := t.tx.QueryRow("SELECT COALESCE(MAX(id), 0) FROM transaction_log").Scan(&last); err != nil {
+		return 0, fmt.Errorf("error retrieving last processed ID: %v", err)
+	}
+	return last, nil
+}
+
+func (t *postgresTx) AppendLog(r LogRecord) error {
+	_, err := t.tx.Exec("INSERT INTO transaction_log (id, term, type, table_name, query, operation) VALUES ($1, $2, $3, $4, $5, $6)",
+		r.ID, r.Term, r.Type, r.Table, r.Query, nullString(r.Operation))
+	if err != nil {
+		if isUniqueViolation(err) {
+			return errLogPositionTaken
+		}
+		return err
+	}
+	if r.ID > t.lastLog {
+		t.lastLog = r.ID
+	}
+	return nil
+}
+
+func (t *postgresTx) TruncateLog(from int) error {
+	if _, err := t.tx.Exec("DELETE FROM transaction_log WHERE id >= $1", from); err != nil {
+		return fmt.Errorf("error deleting log entries: %v", err)
+	}
+	for _, query := range []string{"DELETE FROM users", "DELETE FROM cluster_config", "DELETE FROM schema_migrations WHERE NOT startup"} {
+		if _, err := t.tx.Exec(query); err != nil {
+			return fmt.Errorf("error clearing applied data: %v", err)
+		}
+	}
+	// The entries kept are applied again, and the sequence follows the log
+	t.lastLog = from - 1
+	return nil
+}
+
+func (t *postgresTx) UserExists(email string) (bool, error) {
+	var exists bool
+	err := t.tx.QueryRow("SELECT EXISTS (SELECT 1 FROM users WHERE email = $1)", email).Scan(&exists)
+	return exists, err
+}
+
+// UpsertUser inserts the user, or updates it if it exists. Without a
+// password hash only existing users are updated.
+func (t *postgresTx) UpsertUser(u *UpsertUser) (int64, error) {
+	args := []interface{}{u.Email}
+	var columns, updates []string
+	for _, role := range userRoles {
+		if value, ok := u.Roles[role]; ok {
+			args = append(args, value)
+			columns = append(columns, role)
+			updates = append(updates, fmt.Sprintf("%s = $%d", role, len(args)))
+		}
+	}
+
+	if u.PasswordHash == "" {
+		return rowsAffected(t.tx.Exec(fmt.Sprintf("UPDATE users SET %s WHERE email = $1", strings.Join(updates, ", ")), args...))
+	}
+
+	args = append(args, u.PasswordHash)
+	columns = append(columns, "password_hash")
+	updates = append(updates, fmt.Sprintf("password_hash = $%d", len(args)))
+
+	placeholders := make([]string, len(args))
+	for i := range args {
+		placeholders[i] = fmt.Sprintf("$%d", i+1)
+	}
+	query := fmt.Sprintf("INSERT INTO users (email, %s) VALUES (%s) ON CONFLICT (email) DO UPDATE SET %s",
+		strings.Join(columns, ", "), strings.Join(placeholders, ", "), strings.Join(updates, ", "))
+	return rowsAffected(t.tx.Exec(query, args...))
+}
+
+func (t *postgresTx) DeleteUser(email string) (int64, error) {
+	return rowsAffected(t.tx.Exec("DELETE FROM users WHERE email = $1", email))
+}
+
+func (t *postgresTx) DeleteAllUsers() (int64, error) {
+	return rowsAffected(t.tx.Exec("DELETE FROM users"))
+}
+
+func (t *postgresTx) AddConfig(voters []int) error {
+	_, err := t.tx.Exec("INSERT INTO cluster_config (voters) VALUES ($1)", formatVoters(voters))
+	return err
+}
+
+func (t *postgresTx) ApplyMigration(m Migration) error {
+	_, err := t.tx.Exec(m.SQL)
+	return err
+}
+
+func (t *postgresTx) RecordMigration(a AppliedMigration) error {
+	var err error
+	if a.AppliedAt.IsZero() {
+		_, err = t.tx.Exec("INSERT INTO schema_migrations (version, name, checksum, log_position, startup) VALUES ($1, $2, $3, $4, $5)",
+			a.Version, a.Name, a.Checksum, a.LogPosition, a.Startup)
+	} else {
+		_, err = t.tx.Exec("INSERT INTO schema_migrations (version, name, checksum, log_position, startup, applied_at) VALUES ($1, $2, $3, $4, $5, $6)",
+			a.Version, a.Name, a.Checksum, a.LogPosition, a.Startup, a.AppliedAt)
+	}
+	if isUniqueViolation(err) {
+		return fmt.Errorf("migration %d has already been applied", a.Version)
+	}
+	return err
+}
+
+func (t *postgresTx) Savepoint() error {
+	_, err := t.tx.Exec("SAVEPOINT store_write")
+	return err
+}
+
+func (t *postgresTx) RollbackToSavepoint() error {
+	_, err := t.tx.Exec("ROLLBACK TO SAVEPOINT store_write")
+	return err
+}
+
+func (t *postgresTx) ReleaseSavepoint() error {
+	_, err := t.tx.Exec("RELEASE SAVEPOINT store_write")
+	return err
+}
+
+// Commit keeps the id sequence ahead of the log, in case this node becomes
+// leader, and commits.
+func (t *postgresTx) Commit() error {
+	if t.lastLog > 0 {
+		if _, err := t.tx.Exec("SELECT setval('transaction_log_id_seq', (SELECT MAX(id) FROM transaction_log))"); err != nil {
+			return fmt.Errorf("error advancing transaction log sequence: %v", err)
+		}
+	}
+	return t.tx.Commit()
+}
+
+func (t *postgresTx) Rollback() error {
+	err := t.tx.Rollback()
+	if errors.Is(err, sql.ErrTxDone) {
+		return nil
+	}
+	return err
+}
+
+// queryer is a *sql.DB or *sql.Tx.
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// queryUsers reads the users table.
+func queryUsers(q queryer) ([]UserRecord, error) {
+	rows, err := q.Query("SELECT email, password_hash, R1, R2, R3, R4 FROM users ORDER BY email")
+	if err != nil {
+		return nil, fmt.Errorf("error reading users: %v", err)
+	}
+	defer rows.Close()
+
+	var users []UserRecord
+	for rows.Next() {
+		var u UserRecord
+		roles := make([]sql.NullBool, len(userRoles))
+		if err := rows.Scan(&u.Email, &u.PasswordHash, &roles[0], &roles[1], &roles[2], &roles[3]); err != nil {
+			return nil, fmt.Errorf("error scanning user: %v", err)
+		}
+		u.Roles = make(map[string]bool)
+		for i, role := range userRoles {
+			if roles[i].Valid {
+				u.Roles[role] = roles[i].Bool
+			}
+		}
+		users = append(users, u)
+	}
+	return users, rows.Err()
+}
+
+// queryLogs reads the transaction log entries matching where, in order.
+func queryLogs(q queryer, where string, args ...interface{}) ([]LogRecord, error) {
+	rows, err := q.Query("SELECT id, term, type, table_name, query, operation, timestamp FROM transaction_log "+where+" ORDER BY id ASC", args...)
+	if err != nil {
+		return nil, fmt.Errorf("error querying transaction logs: %v", err)
+	}
+	defer rows.Close()
+
+	var records []LogRecord
+	for rows.Next() {
+		var r LogRecord
+		var logType, table, query, operation sql.NullString
+		var timestamp sql.NullTime
+		if err := rows.Scan(&r.ID, &r.Term, &logType, &table, &query, &operation, &timestamp); err != nil {
+			return nil, fmt.Errorf("error scanning log entry: %v", err)
+		}
+		r.Type, r.Table, r.Query, r.Operation, r.Timestamp = logType.String, table.String, query.String, operation.String, timestamp.Time
+		records = append(records, r)
+	}
+	return records, rows.Err()
+}
+
+// queryConfigs reads the cluster_config table.
+func queryConfigs(q queryer) ([]ConfigRecord, error) {
+	rows, err := q.Query("SELECT id, voters, created_at FROM cluster_config ORDER BY id ASC")
+	if err != nil {
+		return nil, fmt.Errorf("error reading cluster configuration: %v", err)
+	}
+	defer rows.Close()
+
+	var configs []ConfigRecord
+	for rows.Next() {
+		var c ConfigRecord
+		var voters string
+		var created sql.NullTime
+		if err := rows.Scan(&c.ID, &voters, &created); err != nil {
+			return nil, fmt.Errorf("error scanning cluster configuration: %v", err)
+		}
+		if c.Voters, err = parseVoters(voters); err != nil {
+			return nil, err
+		}
+		c.CreatedAt = created.Time
+		configs = append(configs, c)
+	}
+	return configs, rows.Err()
+}
+
+// queryHints reads the hinted_handoff rows matching where, in order.
+func queryHints(q queryer, where string, args ...interface{}) ([]HintRecord, error) {
+	rows, err := q.Query("SELECT id, destination, descendants, message, created_at FROM hinted_handoff "+where+" ORDER BY id ASC", args...)
+	if err != nil {
+		return nil, fmt.Errorf("error reading hinted messages: %v", err)
+	}
+	defer rows.Close()
+
+	var hinted []HintRecord
+	for rows.Next() {
+		var h HintRecord
+		var descendants string
+		var created sql.NullTime
+		if err := rows.Scan(&h.ID, &h.Destination, &descendants, &h.Message, &created); err != nil {
+			return nil, fmt.Errorf("error scanning hinted message: %v", err)
+		}
+		if descendants != "" {
+			h.Descendants = strings.Split(descendants, ",")
+		}
+		h.CreatedAt = created.Time
+		hinted = append(hinted, h)
+	}
+	return hinted, rows.Err()
+}
+
+// queryMigrations reads schema_migrations, by version.
+func queryMigrations(q queryer) ([]AppliedMigration, error) {
+	rows, err := q.Query("SELECT version, name, checksum, log_position, startup, applied_at FROM schema_migrations ORDER BY version ASC")
+	if err != nil {
+		return nil, fmt.Errorf("error reading schema migrations: %v", err)
+	}
+	defer rows.Close()
+
+	var applied []AppliedMigration
+	for rows.Next() {
+		var a AppliedMigration
+		var at sql.NullTime
+		if err := rows.Scan(&a.Version, &a.Name, &a.Checksum, &a.LogPosition, &a.Startup, &at); err != nil {
+			return nil, fmt.Errorf("error scanning schema migration: %v", err)
+		}
+		a.AppliedAt = at.Time
+		applied = append(applied, a)
+	}
+	return applied, rows.Err()
+}
+
+// rowsAffected returns the rows a statement changed.
+func rowsAffected(result sql.Result, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	n, err := result.RowsAffected()
+	if err != nil {
+		return 0, nil // Indicate uncertainty or zero rows affected
+	}
+	return n, nil
+}
+
+// nullString stores an empty string as NULL.
+func nullString(value string) sql.NullString {
+	return sql.NullString{String: value, Valid: value != ""}
+}
+
+// isUniqueViolation reports whether err is a Postgres unique constraint violation.
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
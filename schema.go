@@ -0,0 +1,363 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Schema migrations: the store's schema changes through numbered migrations,
+// each recorded with a checksum in schema_migrations. Startup migrations run
+// in order when the store opens, before the log can be read, and record the
+// end of the log as their position. Every later migration is replicated: the
+// leader logs a Migrate operation for each one its build knows and the log
+// has not seen, and every node runs it when it applies that entry, in the
+// same transaction. So each replica changes its schema at the same log
+// position, and a node whose build does not know a migration stops there
+// instead of applying writes that need it. A replicated migration may run
+// again after /reset, so it must be idempotent.
+const schemaTable = "schema_migrations"
+
+// Migration is a numbered change to the store's schema.
+type Migration struct {
+	Version int
+	Name    string
+	Startup bool   // Runs when the store opens rather than at a log position
+	SQL     string // Run on Postgres; the other backends have no schema to change
+}
+
+// migrations are the schema changes in the order they apply. Startup
+// migrations come first. A migration must never change once released: its
+// checksum is verified on every start.
+var migrations = []Migration{
+	{
+		Version: 1,
+		Name:    "create tables",
+		Startup: true,
+		SQL: `
+			CREATE TABLE IF NOT EXISTS users (
+				email VARCHAR(255) PRIMARY KEY,
+				password_hash TEXT NOT NULL, -- Store bcrypt hash (includes salt)
+				R1 BOOLEAN,
+				R2 BOOLEAN,
+				R3 BOOLEAN,
+				R4 BOOLEAN
+			);
+			CREATE TABLE IF NOT EXISTS transaction_log (
+				id SERIAL PRIMARY KEY, -- Sequence number assigned by the leader
+				type VARCHAR(10),
+				table_name VARCHAR(255),
+				query TEXT, -- Human-readable description of the operation
+				timestamp TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE TABLE IF NOT EXISTS cluster_config (
+				id SERIAL PRIMARY KEY,
+				voters TEXT NOT NULL, -- Comma separated voter node IDs
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			);
+			CREATE TABLE IF NOT EXISTS hinted_handoff (
+				id SERIAL PRIMARY KEY,
+				destination VARCHAR(255) NOT NULL, -- Node the message is for
+				descendants TEXT NOT NULL, -- Comma separated subtree of the destination when delivery failed
+				message TEXT NOT NULL, -- JSON encoded MulticastMessage
+				created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+			)`,
+	},
+	{
+		Version: 2,
+		Name:    "log typed operations and terms",
+		Startup: true,
+		SQL: `
+			ALTER TABLE transaction_log ADD COLUMN IF NOT EXISTS operation TEXT; -- Versioned JSON encoding, see operations.go
+			ALTER TABLE transaction_log ADD COLUMN IF NOT EXISTS term INTEGER NOT NULL DEFAULT 0 -- Leader's term when the entry committed`,
+	},
+	{
+		Version: 3,
+		Name:    "index hinted handoff by destination",
+		SQL:     `CREATE INDEX IF NOT EXISTS hinted_handoff_destination ON hinted_handoff (destination, id)`,
+	},
+}
+
+// AppliedMigration is a row of schema_migrations.
+type AppliedMigration struct {
+	Version     int       `json:"version"`
+	Name        string    `json:"name"`
+	Checksum    string    `json:"checksum"`
+	LogPosition int       `json:"log_position"`
+	Startup     bool      `json:"startup"`
+	AppliedAt   time.Time `json:"applied_at"`
+}
+
+// Migrate is the operation that runs a replicated migration.
+type Migrate struct {
+	Version  int    `json:"version"`
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"`
+}
+
+var (
+	migrateMutex sync.Mutex   // One leader pass over the pending migrations at a time
+	migratedTerm atomic.Int64 // Term in which this node, as leader, logged every migration it knows
+)
+
+// Checksum identifies what the migration does.
+func (m Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%d\n%t\n%s", m.Version, m.Startup, m.SQL)))
+	return hex.EncodeToString(sum[:])
+}
+
+// findMigration returns the migration with version.
+func findMigration(version int) (Migration, bool) {
+	for _, m := range migrations {
+		if m.Version == version {
+			return m, true
+		}
+	}
+	return Migration{}, false
+}
+
+// latestMigration returns the highest version this build knows.
+func latestMigration() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// checkMigrations verifies that the versions run 1, 2, 3... with every
+// startup migration before the replicated ones.
+func checkMigrations() error {
+	replicated := false
+	for i, m := range migrations {
+		if m.Version != i+1 {
+			return fmt.Errorf("migration %q has version %d, want %d", m.Name, m.Version, i+1)
+		}
+		if m.Startup && replicated {
+			return fmt.Errorf("startup migration %d follows a replicated one", m.Version)
+		}
+		replicated = !m.Startup
+	}
+	return nil
+}
+
+// verifyApplied checks the applied migrations against this build: each must
+// be known, with the checksum it was applied with.
+func verifyApplied(applied []AppliedMigration) error {
+	for _, a := range applied {
+		m, ok := findMigration(a.Version)
+		if !ok {
+			return fmt.Errorf("schema is at migration %d (%s), newer than this build knows (%d)", a.Version, a.Name, latestMigration())
+		}
+		if a.Checksum != m.Checksum() {
+			return fmt.Errorf("migration %d (%s) was changed after it was applied: checksum %s, applied %s", a.Version, m.Name, m.Checksum(), a.Checksum)
+		}
+	}
+	return nil
+}
+
+// migrateOnOpen verifies the applied migrations and runs the pending startup
+// migrations in order, each in a transaction of its own.
+func migrateOnOpen(s Store) error {
+	if err := checkMigrations(); err != nil {
+		return err
+	}
+	applied, err := s.Migrations()
+	if err != nil {
+		return err
+	}
+	if err := verifyApplied(applied); err != nil {
+		return err
+	}
+	done := make(map[int]bool, len(applied))
+	for _, a := range applied {
+		done[a.Version] = true
+	}
+
+	for _, m := range migrations {
+		if !m.Startup || done[m.Version] {
+			continue
+		}
+		tx, err := s.Begin()
+		if err != nil {
+			return fmt.Errorf("failed to begin migration %d: %v", m.Version, err)
+		}
+		if err := tx.ApplyMigration(m); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error applying migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		// The log exists from the first migration on
+		position, err := tx.LastLogID()
+		if err == nil {
+			err = tx.RecordMigration(AppliedMigration{Version: m.Version, Name: m.Name, Checksum: m.Checksum(), LogPosition: position, Startup: true})
+		}
+		if err == nil {
+			err = tx.Commit()
+		}
+		if err != nil {
+			tx.Rollback()
+			return fmt.Errorf("error recording migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		log.Printf("Applied startup migration %d (%s) at log position %d", m.Version, m.Name, position)
+	}
+	return nil
+}
+
+// applyMigration runs the replicated migration a Migrate entry at position
+// names, refusing one this build does not know or knows differently.
+func applyMigration(tx StoreTx, op *Migrate, position int) error {
+	m, ok := findMigration(op.Version)
+	if !ok {
+		return fmt.Errorf("migration %d (%s) is unknown to this build, which knows up to %d", op.Version, op.Name, latestMigration())
+	}
+	if m.Startup {
+		return fmt.Errorf("migration %d runs at startup, not from the log", m.Version)
+	}
+	if op.Checksum != m.Checksum() {
+		return fmt.Errorf("migration %d checksum %s does not match this build's %s", m.Version, op.Checksum, m.Checksum())
+	}
+	if err := tx.ApplyMigration(m); err != nil {
+		return err
+	}
+	if err := tx.RecordMigration(AppliedMigration{Version: m.Version, Name: m.Name, Checksum: op.Checksum, LogPosition: position}); err != nil {
+		return err
+	}
+	log.Printf("Applied migration %d (%s) at log position %d", m.Version, m.Name, position)
+	return nil
+}
+
+// schemaVersion returns the highest applied migration.
+func schemaVersion(applied []AppliedMigration) int {
+	version := 0
+	for _, a := range applied {
+		if a.Version > version {
+			version = a.Version
+		}
+	}
+	return version
+}
+
+// pendingMigrations returns the migrations this build knows after the
+// highest one applied.
+func pendingMigrations(applied []AppliedMigration) []Migration {
+	version := schemaVersion(applied)
+	var pending []Migration
+	for _, m := range migrations {
+		if m.Version > version {
+			pending = append(pending, m)
+		}
+	}
+	return pending
+}
+
+// needsMigration reports whether the leader has yet to log its pending
+// migrations in the current term.
+func needsMigration(node *Node) bool {
+	return migratedTerm.Load() != int64(node.core.Term())
+}
+
+// migrateCluster logs the replicated migrations the cluster has not run yet,
+// in order. Called by the leader; the entries reach every replica like any
+// other write.
+func migrateCluster(node *Node) {
+	if !migrateMutex.TryLock() {
+		return
+	}
+	defer migrateMutex.Unlock()
+
+	term := node.core.Term()
+	if migratedTerm.Load() == int64(term) {
+		return
+	}
+	applied, err := store.Migrations()
+	if err != nil {
+		log.Printf("Node %d: %v", node.ID, err)
+		return
+	}
+
+	for _, m := range pendingMigrations(applied) {
+		op := Operation{Kind: OpMigrate, Migrate: &Migrate{Version: m.Version, Name: m.Name, Checksum: m.Checksum()}}
+		result := submitWrite(QueryTypeMigrate, op, false, true, nil)
+		if result.err != nil {
+			log.Printf("Node %d: Failed to apply migration %d (%s): %v", node.ID, m.Version, m.Name, result.err)
+			return
+		}
+		if result.multicastErr != nil {
+			// Replicas that missed it run it when they catch up on the log
+			log.Printf("Node %d: Migration %d not yet replicated everywhere: %v", node.ID, m.Version, result.multicastErr)
+		}
+		fmt.Printf("Logged migration %d (%s) at position %d\n", m.Version, m.Name, result.position)
+	}
+	migratedTerm.Store(int64(term))
+}
+
+// PendingMigration is a migration this build knows that has not run.
+type PendingMigration struct {
+	Version  int    `json:"version"`
+	Name     string `json:"name"`
+	Checksum string `json:"checksum"`
+	Startup  bool   `json:"startup"`
+}
+
+// SchemaStatus is the answer to GET /schema.
+type SchemaStatus struct {
+	Node    int                `json:"node"`
+	Store   string             `json:"store"`
+	Version int                `json:"version"` // Highest applied migration
+	Latest  int                `json:"latest"`  // Highest migration this build knows
+	Applied []AppliedMigration `json:"applied"`
+	Pending []PendingMigration `json:"pending"`
+}
+
+// handleSchema serves GET /schema: the migrations this node applied, at
+// which log positions, and the ones still pending.
+func handleSchema(node *Node) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		applied, err := store.Migrations()
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Error reading schema migrations: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		status := SchemaStatus{
+			Node:    node.ID,
+			Store:   store.Name(),
+			Version: schemaVersion(applied),
+			Latest:  latestMigration(),
+			Applied: applied,
+			Pending: []PendingMigration{},
+		}
+		if status.Applied == nil {
+			status.Applied = []AppliedMigration{}
+		}
+		for _, m := range pendingMigrations(applied) {
+			status.Pending = append(status.Pending, PendingMigration{Version: m.Version, Name: m.Name, Checksum: m.Checksum(), Startup: m.Startup})
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(status)
+	}
+}
+
+// writeSchemaMetrics writes the schema version in Prometheus text format.
+func writeSchemaMetrics(w io.Writer, nodeID int) {
+	applied, err := store.Migrations()
+	if err != nil {
+		log.Printf("Error reading schema migrations: %v", err)
+		return
+	}
+	fmt.Fprintf(w, "# HELP node_schema_version Highest schema migration applied\n")
+	fmt.Fprintf(w, "# TYPE node_schema_version gauge\n")
+	fmt.Fprintf(w, "node_schema_version{node_id=\"%d\"} %d\n", nodeID, schemaVersion(applied))
+
+	fmt.Fprintf(w, "# HELP node_schema_pending_migrations Migrations this build knows that have not run\n")
+	fmt.Fprintf(w, "# TYPE node_schema_pending_migrations gauge\n")
+	fmt.Fprintf(w, "node_schema_pending_migrations{node_id=\"%d\"} %d\n", nodeID, len(pendingMigrations(applied)))
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// withMigrations runs fn with the migrations list replaced by list.
+func withMigrations(t *testing.T, list []Migration, fn func()) {
+	t.Helper()
+	saved := migrations
+	migrations = list
+	defer func() { migrations = saved }()
+	fn()
+}
+
+func TestCheckMigrations(t *testing.T) {
+	tests := []struct {
+		name       string
+		migrations []Migration
+		wantErr    string
+	}{
+		{
+			name:       "released migrations",
+			migrations: migrations,
+		},
+		{
+			name: "startup then replicated",
+			migrations: []Migration{
+				{Version: 1, Name: "a", Startup: true},
+				{Version: 2, Name: "b", Startup: true},
+				{Version: 3, Name: "c"},
+				{Version: 4, Name: "d"},
+			},
+		},
+		{
+			name: "gap in versions",
+			migrations: []Migration{
+				{Version: 1, Name: "a", Startup: true},
+				{Version: 3, Name: "c"},
+			},
+			wantErr: `migration "c" has version 3, want 2`,
+		},
+		{
+			name: "versions out of order",
+			migrations: []Migration{
+				{Version: 2, Name: "b", Startup: true},
+				{Version: 1, Name: "a", Startup: true},
+			},
+			wantErr: `migration "b" has version 2, want 1`,
+		},
+		{
+			name: "startup after replicated",
+			migrations: []Migration{
+				{Version: 1, Name: "a", Startup: true},
+				{Version: 2, Name: "b"},
+				{Version: 3, Name: "c", Startup: true},
+			},
+			wantErr: "startup migration 3 follows a replicated one",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMigrations(t, tt.migrations, func() {
+				checkError(t, checkMigrations(), tt.wantErr)
+			})
+		})
+	}
+}
+
+func TestVerifyApplied(t *testing.T) {
+	list := []Migration{
+		{Version: 1, Name: "create", Startup: true, SQL: "CREATE TABLE t (id INT)"},
+		{Version: 2, Name: "index", SQL: "CREATE INDEX ON t (id)"},
+	}
+	applied := func(version int, checksum string) AppliedMigration {
+		return AppliedMigration{Version: version, Name: list[version-1].Name, Checksum: checksum}
+	}
+
+	tests := []struct {
+		name    string
+		applied []AppliedMigration
+		wantErr string
+	}{
+		{
+			name: "nothing applied",
+		},
+		{
+			name:    "every migration applied",
+			applied: []AppliedMigration{applied(1, list[0].Checksum()), applied(2, list[1].Checksum())},
+		},
+		{
+			name:    "older schema",
+			applied: []AppliedMigration{applied(1, list[0].Checksum())},
+		},
+		{
+			name:    "unknown migration",
+			applied: []AppliedMigration{applied(1, list[0].Checksum()), {Version: 3, Name: "future"}},
+			wantErr: "schema is at migration 3 (future), newer than this build knows (2)",
+		},
+		{
+			name:    "checksum mismatch",
+			applied: []AppliedMigration{applied(1, list[0].Checksum()), applied(2, "0123")},
+			wantErr: "migration 2 (index) was changed after it was applied",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withMigrations(t, list, func() {
+				checkError(t, verifyApplied(tt.applied), tt.wantErr)
+			})
+		})
+	}
+}
+
+func TestMigrationChecksum(t *testing.T) {
+	base := Migration{Version: 2, Name: "index", SQL: "CREATE INDEX ON t (id)"}
+
+	renamed := base
+	renamed.Name = "renamed"
+	if renamed.Checksum() != base.Checksum() {
+		t.Errorf("renaming a migration changed its checksum")
+	}
+
+	for name, changed := range map[string]Migration{
+		"version": {Version: 3, Name: base.Name, SQL: base.SQL},
+		"startup": {Version: base.Version, Name: base.Name, Startup: true, SQL: base.SQL},
+		"sql":     {Version: base.Version, Name: base.Name, SQL: "CREATE INDEX ON t (id, name)"},
+	} {
+		if changed.Checksum() == base.Checksum() {
+			t.Errorf("changing the %s kept the checksum", name)
+		}
+	}
+}
+
+func TestApplyMigrationChecksumMismatch(t *testing.T) {
+	store = newMemoryStore()
+	if err := migrateOnOpen(store); err != nil {
+		t.Fatal(err)
+	}
+	m := migrations[len(migrations)-1]
+
+	tests := []struct {
+		name    string
+		op      Migrate
+		wantErr string
+	}{
+		{
+			name: "known migration",
+			op:   Migrate{Version: m.Version, Name: m.Name, Checksum: m.Checksum()},
+		},
+		{
+			name:    "checksum mismatch",
+			op:      Migrate{Version: m.Version, Name: m.Name, Checksum: "0123"},
+			wantErr: "does not match this build's",
+		},
+		{
+			name:    "unknown migration",
+			op:      Migrate{Version: m.Version + 1, Name: "future"},
+			wantErr: "is unknown to this build",
+		},
+		{
+			name:    "startup migration",
+			op:      Migrate{Version: 1, Name: migrations[0].Name, Checksum: migrations[0].Checksum()},
+			wantErr: "runs at startup, not from the log",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx, err := store.Begin()
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer tx.Rollback()
+			checkError(t, applyMigration(tx, &tt.op, 1), tt.wantErr)
+		})
+	}
+}
+
+// checkError fails the test unless err contains want, or is nil if want is empty.
+func checkError(t *testing.T, err error, want string) {
+	t.Helper()
+	switch {
+	case want == "" && err != nil:
+		t.Fatalf("unexpected error: %v", err)
+	case want != "" && err == nil:
+		t.Fatalf("got no error, want %q", want)
+	case want != "" && !strings.Contains(err.Error(), want):
+		t.Fatalf("got error %q, want %q", err, want)
+	}
+}
@@ -0,0 +1,37 @@
+#!/bin/sh
+# Generates a CA plus one certificate per service for optional mutual TLS.
+# Each certificate is bound to its identity through a DNS SAN
+# (node-<id>, membership, middleware), which peers verify on every connection.
+#
+# Usage: scripts/gen-certs.sh [output-dir] [node-count]
+set -e
+
+OUT=${1:-certs}
+NODES=${2:-4}
+DAYS=365
+
+mkdir -p "$OUT"
+
+openssl req -x509 -newkey rsa:2048 -nodes -days "$DAYS" \
+	-subj "/CN=identity-cluster-ca" \
+	-keyout "$OUT/ca.key" -out "$OUT/ca.crt"
+
+issue() {
+	name=$1
+	openssl req -newkey rsa:2048 -nodes -subj "/CN=$name" \
+		-keyout "$OUT/$name.key" -out "$OUT/$name.csr"
+	printf "subjectAltName=DNS:%s,DNS:localhost\nextendedKeyUsage=serverAuth,clientAuth\n" "$name" > "$OUT/$name.ext"
+	openssl x509 -req -in "$OUT/$name.csr" -CA "$OUT/ca.crt" -CAkey "$OUT/ca.key" \
+		-CAcreateserial -days "$DAYS" -extfile "$OUT/$name.ext" -out "$OUT/$name.crt"
+	rm -f "$OUT/$name.csr" "$OUT/$name.ext"
+}
+
+i=1
+while [ "$i" -le "$NODES" ]; do
+	issue "node-$i"
+	i=$((i + 1))
+done
+issue membership
+issue middleware
+
+echo "Certificates written to $OUT"
@@ -0,0 +1,456 @@
+// Package simulation runs a cluster of consensus nodes in one process with
+// simulated time, so elections and replication can be exercised without
+// docker-compose or wall-clock sleeps.
+//
+// A run is fully determined by its seed: the scheduler always wakes the node
+// with the earliest pending tick, and every random choice (start offsets,
+// election jitter, dropped deliveries) comes from the seeded source.
+//
+//	c := simulation.NewCluster(simulation.Config{Seed: 1, Nodes: 5})
+//	c.Run(30 * time.Second)
+//	c.Partition([]int{1, 2}, []int{3, 4, 5})
+//	c.Run(30 * time.Second)
+//	c.Heal()
+//	c.Run(30 * time.Second)
+//	if err := c.CheckElectionSafety(); err != nil {
+//		t.Fatal(err)
+//	}
+package simulation
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"mymodule/consensus"
+)
+
+// Config describes a simulated cluster. Zero timings use the consensus defaults.
+type Config struct {
+	Seed  int64
+	Nodes int                    // Node IDs are 1..Nodes
+	Roles map[int]consensus.Role // Defaults to voter
+
+	HeartbeatInterval time.Duration
+	LeaderTimeout     time.Duration
+
+	// DropRate is the probability that a single replication delivery is lost.
+	// A receiver holds the entries after the gap for ReorderTimeout, then
+	// fetches the missing ones from the leader. With no later entries, the
+	// gap is found at the next anti-entropy round.
+	DropRate       float64
+	ReorderTimeout time.Duration
+
+	// AntiEntropyInterval is how often each node runs an anti-entropy round.
+	// Zero disables anti-entropy.
+	AntiEntropyInterval time.Duration
+}
+
+// Cluster is a set of simulated nodes sharing one clock and network.
+type Cluster struct {
+	cfg Config
+
+	mu      sync.RWMutex
+	randMu  sync.Mutex
+	rand    *rand.Rand
+	now     time.Time
+	nodes   map[int]*simNode
+	ids     []int
+	group   map[int]int // Partition group per node; nodes talk only within a group
+	crashed map[int]bool
+
+	// leaders records the first leader seen for each term
+	leaders    map[int]int
+	violations []string
+}
+
+type simNode struct {
+	node            *consensus.Node
+	storage         *MemoryStorage
+	nextTick        time.Time
+	nextAntiEntropy time.Time
+}
+
+// clock reads the cluster's simulated time.
+type clock struct {
+	cluster *Cluster
+}
+
+func (c clock) Now() time.Time {
+	c.cluster.mu.RLock()
+	defer c.cluster.mu.RUnlock()
+	return c.cluster.now
+}
+
+// NewCluster creates a cluster of cfg.Nodes nodes with staggered first ticks.
+func NewCluster(cfg Config) *Cluster {
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = consensus.DefaultHeartbeatInterval
+	}
+	if cfg.LeaderTimeout == 0 {
+		cfg.LeaderTimeout = consensus.DefaultLeaderTimeout
+	}
+
+	c := &Cluster{
+		cfg:     cfg,
+		rand:    rand.New(rand.NewSource(cfg.Seed)),
+		now:     time.Unix(0, 0).UTC(),
+		nodes:   make(map[int]*simNode),
+		group:   make(map[int]int),
+		crashed: make(map[int]bool),
+		leaders: make(map[int]int),
+	}
+
+	for id := 1; id <= cfg.Nodes; id++ {
+		c.ids = append(c.ids, id)
+		storage := &MemoryStorage{}
+		c.nodes[id] = &simNode{
+			node:     c.newNode(id, storage),
+			storage:  storage,
+			nextTick: c.now.Add(c.randDuration(cfg.HeartbeatInterval)),
+		}
+	}
+	return c
+}
+
+// voters is the committed voter configuration: every node that is not a
+// learner, as the first leader of a real cluster would bootstrap it.
+func (c *Cluster) voters() []int {
+	var voters []int
+	for id := 1; id <= c.cfg.Nodes; id++ {
+		if c.cfg.Roles[id] != consensus.RoleLearner {
+			voters = append(voters, id)
+		}
+	}
+	return voters
+}
+
+func (c *Cluster) newNode(id int, storage *MemoryStorage) *consensus.Node {
+	role := consensus.RoleVoter
+	if r, ok := c.cfg.Roles[id]; ok {
+		role = r
+	}
+	node := consensus.NewNode(consensus.Options{
+		ID:                id,
+		Role:              role,
+		Transport:         &transport{cluster: c, from: id},
+		Clock:             clock{cluster: c},
+		Storage:           storage,
+		Rand:              rand.New(rand.NewSource(c.randInt63())),
+		HeartbeatInterval: c.cfg.HeartbeatInterval,
+		LeaderTimeout:     c.cfg.LeaderTimeout,
+		ReorderTimeout:    c.cfg.ReorderTimeout,
+	})
+	node.SetVoters(c.voters())
+	return node
+}
+
+func (c *Cluster) randInt63() int64 {
+	c.randMu.Lock()
+	defer c.randMu.Unlock()
+	return c.rand.Int63()
+}
+
+func (c *Cluster) randDuration(max time.Duration) time.Duration {
+	c.randMu.Lock()
+	defer c.randMu.Unlock()
+	return time.Duration(c.rand.Int63n(int64(max)))
+}
+
+// drop reports whether the next replication delivery should be lost.
+func (c *Cluster) drop() bool {
+	if c.cfg.DropRate <= 0 {
+		return false
+	}
+	c.randMu.Lock()
+	defer c.randMu.Unlock()
+	return c.rand.Float64() < c.cfg.DropRate
+}
+
+// IDs returns the node IDs in ascending order.
+func (c *Cluster) IDs() []int {
+	return append([]int(nil), c.ids...)
+}
+
+// Now returns the current simulated time.
+func (c *Cluster) Now() time.Time {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.now
+}
+
+// Node returns the consensus node with the given ID.
+func (c *Cluster) Node(id int) *consensus.Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nodes[id].node
+}
+
+// Log returns a copy of a node's log.
+func (c *Cluster) Log(id int) []consensus.Entry {
+	return c.storage(id).Entries()
+}
+
+func (c *Cluster) storage(id int) *MemoryStorage {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.nodes[id].storage
+}
+
+// reachable returns the target node if from can currently reach it.
+func (c *Cluster) reachable(from, to int) *consensus.Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	target, ok := c.nodes[to]
+	if !ok || c.crashed[from] || c.crashed[to] || c.group[from] != c.group[to] {
+		return nil
+	}
+	return target.node
+}
+
+// Partition splits the network into the given groups. Nodes not listed are
+// isolated together in one extra group.
+func (c *Cluster) Partition(groups ...[]int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, id := range c.ids {
+		c.group[id] = len(groups) + 1
+	}
+	for i, group := range groups {
+		for _, id := range group {
+			c.group[id] = i + 1
+		}
+	}
+}
+
+// Heal removes every partition.
+func (c *Cluster) Heal() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.group = make(map[int]int)
+}
+
+// Crash stops a node. Its log is kept for Restart.
+func (c *Cluster) Crash(id int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.crashed[id] = true
+}
+
+// Restart brings a crashed node back with fresh in-memory state and its old
+// log, then catches it up from the leader the way the node binary does.
+func (c *Cluster) Restart(id int) {
+	c.mu.Lock()
+	sn := c.nodes[id]
+	sn.node = c.newNode(id, sn.storage)
+	delete(c.crashed, id)
+	sn.nextTick = c.now.Add(c.cfg.HeartbeatInterval)
+	c.mu.Unlock()
+
+	sn.node.SetMembers(c.membersFor(id))
+	for _, peer := range c.IDs() {
+		target := c.reachable(id, peer)
+		if peer == id || target == nil {
+			continue
+		}
+		if status := target.Status(); status.LeaderID > 0 {
+			sn.node.ObserveLeader(status.LeaderID, status.Term)
+			sn.node.CatchUp()
+			break
+		}
+	}
+}
+
+// membersFor returns the membership view of a node: every live node it can
+// reach, flagged with whether that node currently claims leadership.
+func (c *Cluster) membersFor(id int) map[int]consensus.Member {
+	members := make(map[int]consensus.Member)
+	for _, peer := range c.IDs() {
+		target := c.reachable(id, peer)
+		if target == nil {
+			continue
+		}
+		members[peer] = consensus.Member{Role: target.Role(), IsLeader: target.IsLeader()}
+	}
+	return members
+}
+
+// Leader returns the live leader with the highest term, or 0 if none.
+func (c *Cluster) Leader() int {
+	leader, term := 0, -1
+	for _, id := range c.IDs() {
+		if c.isCrashed(id) {
+			continue
+		}
+		status := c.Node(id).Status()
+		if status.IsLeader && status.Term > term {
+			leader, term = id, status.Term
+		}
+	}
+	return leader
+}
+
+func (c *Cluster) isCrashed(id int) bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.crashed[id]
+}
+
+// Propose submits a write to the current leader. The operation is stored
+// as given and never applied.
+func (c *Cluster) Propose(table, operation string) (consensus.Entry, error) {
+	leader := c.Leader()
+	if leader == 0 {
+		return consensus.Entry{}, consensus.ErrNoLeader
+	}
+	entry, err := c.Node(leader).Propose(consensus.Entry{Type: "INSERT", Table: table, Operation: json.RawMessage(operation)})
+	c.observe()
+	return entry, err
+}
+
+// Run advances simulated time by d, waking nodes in tick order.
+func (c *Cluster) Run(d time.Duration) {
+	end := c.Now().Add(d)
+	for {
+		id, at := c.nextEvent()
+		if id == 0 || at.After(end) {
+			break
+		}
+
+		c.mu.Lock()
+		c.now = at
+		sn := c.nodes[id]
+		c.mu.Unlock()
+
+		sn.node.SetMembers(c.membersFor(id))
+		wait := sn.node.Tick()
+
+		// Anti-entropy piggybacks on the node's ticks
+		antiEntropy := c.cfg.AntiEntropyInterval > 0 && !at.Before(sn.nextAntiEntropy)
+		if antiEntropy {
+			sn.node.AntiEntropy()
+		}
+
+		c.mu.Lock()
+		sn.nextTick = c.now.Add(wait)
+		if antiEntropy {
+			sn.nextAntiEntropy = c.now.Add(c.cfg.AntiEntropyInterval)
+		}
+		c.mu.Unlock()
+
+		c.observe()
+	}
+
+	c.mu.Lock()
+	c.now = end
+	c.mu.Unlock()
+}
+
+// nextEvent returns the live node with the earliest pending tick, lowest ID first.
+func (c *Cluster) nextEvent() (int, time.Time) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	next, at := 0, time.Time{}
+	for _, id := range c.ids {
+		if c.crashed[id] {
+			continue
+		}
+		tick := c.nodes[id].nextTick
+		if next == 0 || tick.Before(at) {
+			next, at = id, tick
+		}
+	}
+	return next, at
+}
+
+// observe records which node leads each term and notes any term with two leaders.
+func (c *Cluster) observe() {
+	for _, id := range c.IDs() {
+		if c.isCrashed(id) {
+			continue
+		}
+		status := c.Node(id).Status()
+		if !status.IsLeader {
+			continue
+		}
+
+		c.mu.Lock()
+		if leader, ok := c.leaders[status.Term]; !ok {
+			c.leaders[status.Term] = id
+		} else if leader != id {
+			c.violations = append(c.violations, fmt.Sprintf(
+				"term %d has two leaders: node %d and node %d (at %v)", status.Term, leader, id, c.now.Sub(time.Unix(0, 0))))
+		}
+		c.mu.Unlock()
+	}
+}
+
+// Leaders returns the leader observed for each term so far.
+func (c *Cluster) Leaders() map[int]int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	leaders := make(map[int]int, len(c.leaders))
+	for term, id := range c.leaders {
+		leaders[term] = id
+	}
+	return leaders
+}
+
+// CheckElectionSafety returns an error if any term ever had more than one leader.
+func (c *Cluster) CheckElectionSafety() error {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	if len(c.violations) > 0 {
+		return fmt.Errorf("election safety violated: %s", c.violations[0])
+	}
+	return nil
+}
+
+// CheckLogConvergence returns an error unless every live node holds the same log.
+func (c *Cluster) CheckLogConvergence() error {
+	var reference []consensus.Entry
+	referenceID := 0
+	for _, id := range c.IDs() {
+		if c.isCrashed(id) {
+			continue
+		}
+		entries := c.Log(id)
+		if referenceID == 0 {
+			reference, referenceID = entries, id
+			continue
+		}
+		if len(entries) != len(reference) {
+			return fmt.Errorf("node %d has %d entries, node %d has %d", id, len(entries), referenceID, len(reference))
+		}
+		for i := range entries {
+			if !sameEntry(entries[i], reference[i]) {
+				return fmt.Errorf("node %d and node %d differ at entry %d", id, referenceID, reference[i].ID)
+			}
+		}
+	}
+	return nil
+}
+
+func sameEntry(a, b consensus.Entry) bool {
+	return a.ID == b.ID && a.Term == b.Term && a.Type == b.Type && a.Table == b.Table && bytes.Equal(a.Operation, b.Operation)
+}
+
+// Summary describes each node's state, for failure messages.
+func (c *Cluster) Summary() string {
+	out := fmt.Sprintf("t=%v\n", c.Now().Sub(time.Unix(0, 0)))
+	for _, id := range c.IDs() {
+		status := c.Node(id).Status()
+		last, _ := c.storage(id).LastEntryID()
+		out += fmt.Sprintf("  node %d: term=%d leader=%v knownLeader=%d lastEntry=%d crashed=%v\n",
+			id, status.Term, status.IsLeader, status.LeaderID, last, c.isCrashed(id))
+	}
+	return out
+}
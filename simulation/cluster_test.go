@@ -0,0 +1,194 @@
+package simulation
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"mymodule/consensus"
+)
+
+// seeds is the sweep every scenario runs over. A failing seed replays exactly.
+var seeds = []int64{1, 2, 3, 5, 7, 11, 13, 17, 19, 23, 29, 31, 37, 41, 43, 47}
+
+// proposeEach submits count writes to the current leader, one per interval.
+func proposeEach(c *Cluster, label string, count int, interval time.Duration) {
+	for i := 0; i < count; i++ {
+		c.Propose("users", fmt.Sprintf(`{"%s":%d}`, label, i))
+		c.Run(interval)
+	}
+}
+
+// checkLeader fails the test unless the cluster has settled on one leader.
+func checkLeader(t *testing.T, c *Cluster, seed int64) {
+	t.Helper()
+	if c.Leader() == 0 {
+		t.Fatalf("seed %d: no leader\n%s", seed, c.Summary())
+	}
+	if err := c.CheckElectionSafety(); err != nil {
+		t.Fatalf("seed %d: %v\n%s", seed, err, c.Summary())
+	}
+}
+
+// checkFollowers fails the test unless every live node follows the leader in
+// the leader's term.
+func checkFollowers(t *testing.T, c *Cluster, seed int64) {
+	t.Helper()
+	leader := c.Node(c.Leader()).Status()
+	for _, id := range c.IDs() {
+		if c.isCrashed(id) {
+			continue
+		}
+		status := c.Node(id).Status()
+		if status.Term != leader.Term || status.LeaderID != leader.ID {
+			t.Fatalf("seed %d: node %d is in term %d following %d, leader %d is in term %d\n%s",
+				seed, id, status.Term, status.LeaderID, leader.ID, leader.Term, c.Summary())
+		}
+	}
+}
+
+func TestElectsOneLeaderPerTerm(t *testing.T) {
+	for _, seed := range seeds {
+		c := NewCluster(Config{Seed: seed, Nodes: 5})
+		c.Run(30 * time.Second)
+		checkLeader(t, c, seed)
+		checkFollowers(t, c, seed)
+	}
+}
+
+func TestLeaderCrashElectsNewLeader(t *testing.T) {
+	for _, seed := range seeds {
+		c := NewCluster(Config{Seed: seed, Nodes: 5})
+		c.Run(30 * time.Second)
+		first := c.Leader()
+		firstTerm := c.Node(first).Term()
+
+		c.Crash(first)
+		c.Run(30 * time.Second)
+		checkLeader(t, c, seed)
+		if c.Leader() == first || c.Node(c.Leader()).Term() <= firstTerm {
+			t.Fatalf("seed %d: no new leader after node %d crashed\n%s", seed, first, c.Summary())
+		}
+	}
+}
+
+func TestMinorityPartitionCannotElect(t *testing.T) {
+	for _, seed := range seeds {
+		c := NewCluster(Config{Seed: seed, Nodes: 5})
+		c.Run(30 * time.Second)
+
+		c.Partition([]int{1, 2}, []int{3, 4, 5})
+		c.Run(60 * time.Second)
+		checkLeader(t, c, seed)
+		for _, id := range []int{1, 2} {
+			if c.Node(id).IsLeader() {
+				t.Fatalf("seed %d: node %d leads a minority partition\n%s", seed, id, c.Summary())
+			}
+		}
+	}
+}
+
+func TestLogsConvergeWithDrops(t *testing.T) {
+	for _, seed := range seeds {
+		c := NewCluster(Config{Seed: seed, Nodes: 5, DropRate: 0.2, AntiEntropyInterval: 5 * time.Second})
+		c.Run(30 * time.Second)
+		proposeEach(c, "write", 20, 500*time.Millisecond)
+		c.Run(30 * time.Second)
+
+		checkLeader(t, c, seed)
+		if err := c.CheckLogConvergence(); err != nil {
+			t.Fatalf("seed %d: %v\n%s", seed, err, c.Summary())
+		}
+	}
+}
+
+func TestLogsConvergeAfterPartition(t *testing.T) {
+	for _, seed := range seeds {
+		c := NewCluster(Config{Seed: seed, Nodes: 5, DropRate: 0.2, AntiEntropyInterval: 5 * time.Second})
+		c.Run(30 * time.Second)
+		proposeEach(c, "before", 5, time.Second)
+
+		// The old leader may be cut off with a minority and accept writes
+		// that never commit, while the majority elects a leader of its own
+		c.Partition([]int{1, 2}, []int{3, 4, 5})
+		proposeEach(c, "minority", 5, 3*time.Second)
+		c.Run(20 * time.Second)
+		proposeEach(c, "majority", 5, time.Second)
+
+		c.Heal()
+		c.Run(60 * time.Second)
+		proposeEach(c, "after", 5, time.Second)
+		c.Run(60 * time.Second)
+
+		// The minority campaigned to higher terms, so the majority's leader
+		// steps down on hearing them and a new election realigns every node
+		checkLeader(t, c, seed)
+		checkFollowers(t, c, seed)
+		if err := c.CheckLogConvergence(); err != nil {
+			t.Fatalf("seed %d: %v\n%s", seed, err, c.Summary())
+		}
+	}
+}
+
+func TestLogsConvergeAfterRestart(t *testing.T) {
+	for _, seed := range seeds {
+		c := NewCluster(Config{Seed: seed, Nodes: 5, DropRate: 0.1, AntiEntropyInterval: 5 * time.Second})
+		c.Run(30 * time.Second)
+		proposeEach(c, "before", 5, time.Second)
+
+		c.Crash(4)
+		proposeEach(c, "down", 5, time.Second)
+		c.Restart(4)
+		proposeEach(c, "after", 5, time.Second)
+		c.Run(30 * time.Second)
+
+		checkLeader(t, c, seed)
+		if err := c.CheckLogConvergence(); err != nil {
+			t.Fatalf("seed %d: %v\n%s", seed, err, c.Summary())
+		}
+	}
+}
+
+// checkSummaries fails the test unless every live node's log summaries, which
+// continue from cached digests, match digesting its log from the start.
+func checkSummaries(t *testing.T, c *Cluster, seed int64) {
+	t.Helper()
+	for _, id := range c.IDs() {
+		if c.isCrashed(id) {
+			continue
+		}
+		entries := c.Log(id)
+		for upTo := len(entries); upTo >= 0; upTo -= 7 {
+			summary, err := c.Node(id).LogSummary(upTo)
+			if err != nil {
+				t.Fatalf("seed %d: node %d: %v", seed, id, err)
+			}
+			if want := consensus.DigestEntries(entries[:upTo]); summary.Digest != want {
+				t.Fatalf("seed %d: node %d digests its first %d entries as %s, want %s\n%s",
+					seed, id, upTo, summary.Digest, want, c.Summary())
+			}
+		}
+	}
+}
+
+func TestLogSummariesAfterRepair(t *testing.T) {
+	for _, seed := range seeds {
+		c := NewCluster(Config{Seed: seed, Nodes: 5, DropRate: 0.1, AntiEntropyInterval: 5 * time.Second})
+		c.Run(30 * time.Second)
+		proposeEach(c, "before", 300, 50*time.Millisecond)
+
+		// The minority's writes are summarized, then truncated by the repair
+		c.Partition([]int{1, 2}, []int{3, 4, 5})
+		proposeEach(c, "minority", 5, 3*time.Second)
+		c.Run(20 * time.Second)
+		proposeEach(c, "majority", 300, 50*time.Millisecond)
+
+		c.Heal()
+		c.Run(60 * time.Second)
+		checkLeader(t, c, seed)
+		if err := c.CheckLogConvergence(); err != nil {
+			t.Fatalf("seed %d: %v\n%s", seed, err, c.Summary())
+		}
+		checkSummaries(t, c, seed)
+	}
+}
@@ -0,0 +1,80 @@
+package simulation
+
+import (
+	"sync"
+
+	"mymodule/consensus"
+)
+
+// MemoryStorage is an in-memory consensus.Storage. It survives simulated
+// crashes, standing in for the node's database.
+type MemoryStorage struct {
+	mu      sync.RWMutex
+	entries []consensus.Entry
+}
+
+// LastEntryID returns the ID of the last appended entry.
+func (s *MemoryStorage) LastEntryID() (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if len(s.entries) == 0 {
+		return 0, nil
+	}
+	return s.entries[len(s.entries)-1].ID, nil
+}
+
+// Append adds the entries to the log.
+func (s *MemoryStorage) Append(entries ...consensus.Entry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	last := 0
+	if len(s.entries) > 0 {
+		last = s.entries[len(s.entries)-1].ID
+	}
+	for _, e := range entries {
+		if e.ID <= last {
+			return consensus.ErrAlreadyApplied
+		}
+		last = e.ID
+	}
+
+	s.entries = append(s.entries, entries...)
+	return nil
+}
+
+// EntriesAfter returns the entries with an ID greater than id.
+func (s *MemoryStorage) EntriesAfter(id int) ([]consensus.Entry, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var entries []consensus.Entry
+	for _, e := range s.entries {
+		if e.ID > id {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+// Entries returns a copy of the whole log.
+func (s *MemoryStorage) Entries() []consensus.Entry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return append([]consensus.Entry(nil), s.entries...)
+}
+
+// TruncateFrom removes the entries with an ID of id or more.
+func (s *MemoryStorage) TruncateFrom(id int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for i, e := range s.entries {
+		if e.ID >= id {
+			s.entries = s.entries[:i:i]
+			break
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package simulation
+
+import (
+	"errors"
+
+	"mymodule/consensus"
+)
+
+// errUnreachable is returned for messages to crashed or partitioned nodes.
+var errUnreachable = errors.New("node unreachable")
+
+// transport delivers messages synchronously by calling the target node's
+// handlers, dropping them when the nodes cannot reach each other.
+type transport struct {
+	cluster *Cluster
+	from    int
+}
+
+func (t *transport) RequestVote(to int, req consensus.VoteRequest) (consensus.VoteResponse, error) {
+	target := t.cluster.reachable(t.from, to)
+	if target == nil {
+		return consensus.VoteResponse{}, errUnreachable
+	}
+	return target.HandleVoteRequest(req), nil
+}
+
+func (t *transport) SendHeartbeat(to int, hb consensus.Heartbeat) (consensus.HeartbeatResponse, error) {
+	target := t.cluster.reachable(t.from, to)
+	if target == nil {
+		return consensus.HeartbeatResponse{}, errUnreachable
+	}
+	return target.HandleHeartbeat(hb), nil
+}
+
+func (t *transport) FetchEntries(from int, afterID int) ([]consensus.Entry, error) {
+	if t.cluster.reachable(t.from, from) == nil {
+		return nil, errUnreachable
+	}
+	return t.cluster.storage(from).EntriesAfter(afterID)
+}
+
+func (t *transport) LogSummary(from int, upTo int) (consensus.LogSummary, error) {
+	target := t.cluster.reachable(t.from, from)
+	if target == nil {
+		return consensus.LogSummary{}, errUnreachable
+	}
+	return target.LogSummary(upTo)
+}
+
+// Broadcast delivers the entry to every reachable member in ID order. Each
+// delivery may be dropped according to the cluster's drop rate, leaving a
+// gap the receiver has to fill from the leader later.
+func (t *transport) Broadcast(entry consensus.Entry) error {
+	for _, id := range t.cluster.IDs() {
+		if id == t.from || t.cluster.drop() {
+			continue
+		}
+		target := t.cluster.reachable(t.from, id)
+		if target == nil {
+			continue
+		}
+		target.HandleEntry(entry)
+	}
+	return nil
+}
@@ -0,0 +1,426 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"mymodule/consensus"
+)
+
+// Storage backends: everything a node keeps locally goes through a Store, so
+// the node runs against Postgres, a single file or memory alone. STORE picks
+// the backend:
+//
+//	postgres  the DB_HOST server (default)
+//	file      an append-only file at STORE_PATH, replayed on start
+//	memory    nothing survives a restart; a new node catches up from the leader
+const defaultStore = "postgres"
+
+// Store is the node's local storage: users, the transaction log, metadata
+// (the voter configuration, the hinted handoff queue and the applied schema
+// migrations) and snapshots.
+type Store interface {
+	// Name returns the backend, as configured by STORE.
+	Name() string
+
+	// Select reads the fields of a table's rows matching where, for a SELECT
+	// from the middleware. Columns are lower case, as Postgres returns them.
+	Select(table string, fields []string, where map[string]string) ([]map[string]interface{}, error)
+	// Users returns every user, ordered by email.
+	Users() ([]UserRecord, error)
+
+	// LastLogID returns the ID of the most recent logged entry, or 0.
+	LastLogID() (int, error)
+	// LatestLogEntry returns the ID and time of the most recent logged entry.
+	LatestLogEntry() (int, time.Time, error)
+	// LogsAfter returns the logged entries after id, in order.
+	LogsAfter(id int) ([]LogRecord, error)
+
+	// LatestConfig returns the voter configuration applied last, or errNoClusterConfig.
+	LatestConfig() (*ClusterConfig, error)
+
+	// HintCounts returns the number of queued hints for each destination.
+	HintCounts() (map[string]int, error)
+	// Hints returns destination's hints in the order they were queued.
+	Hints(destination string) ([]HintRecord, error)
+	AddHint(destination string, descendants []string, message string) error
+	// RemoveHint deletes a hint, reporting whether it was still queued.
+	RemoveHint(id int) (bool, error)
+	// TrimHints deletes destination's oldest hints beyond the newest keep and
+	// returns how many it deleted.
+	TrimHints(destination string, keep int) (int, error)
+
+	// Migrations returns the applied schema migrations, ordered by version.
+	Migrations() ([]AppliedMigration, error)
+
+	// Begin starts a write transaction. Writes are only made through one.
+	Begin() (StoreTx, error)
+
+	// Snapshot returns a consistent copy of everything stored.
+	Snapshot() (*Snapshot, error)
+	// Restore replaces everything stored with snapshot. The startup
+	// migrations stay as they are; the replicated ones are the snapshot's,
+	// and any of them not applied here yet are run.
+	Restore(snapshot *Snapshot) error
+	// Reset deletes the users, the log, the voter configuration and the
+	// hint queue, and forgets the replicated migrations, whose positions no
+	// longer exist.
+	Reset() error
+
+	Close() error
+}
+
+// StoreTx is a write transaction. A failed write is undone with
+// RollbackToSavepoint, leaving the rest of the transaction in place.
+type StoreTx interface {
+	// LastLogID returns the ID of the most recent logged entry and holds the
+	// log until the transaction ends, so positions can be assigned after it.
+	LastLogID() (int, error)
+	// AppendLog logs record at its ID, returning errLogPositionTaken if the
+	// position is already logged.
+	AppendLog(record LogRecord) error
+	// TruncateLog deletes the logged entries from position from on, along
+	// with everything applied from the log: the users, the voter
+	// configuration and the replicated migrations. The caller applies the
+	// entries it keeps again.
+	TruncateLog(from int) error
+
+	UserExists(email string) (bool, error)
+	UpsertUser(u *UpsertUser) (int64, error)
+	DeleteUser(email string) (int64, error)
+	DeleteAllUsers() (int64, error)
+	AddConfig(voters []int) error
+
+	// ApplyMigration changes the schema as m describes.
+	ApplyMigration(m Migration) error
+	RecordMigration(applied AppliedMigration) error
+
+	Savepoint() error
+	RollbackToSavepoint() error
+	ReleaseSavepoint() error
+
+	Commit() error
+	// Rollback abandons the transaction. It does nothing after Commit.
+	Rollback() error
+}
+
+// errLogPositionTaken is returned by AppendLog for a position already logged.
+var errLogPositionTaken = errors.New("log position already taken")
+
+// UserRecord is a row of the users table. Roles holds only the roles that
+// were ever set; the others are NULL.
+type UserRecord struct {
+	Email        string          `json:"email"`
+	PasswordHash string          `json:"password_hash"`
+	Roles        map[string]bool `json:"roles,omitempty"`
+}
+
+// LogRecord is an entry of the transaction log. Operation is empty for
+// entries that predate typed operations.
+type LogRecord struct {
+	ID        int       `json:"id"`
+	Term      int       `json:"term"`
+	Type      string    `json:"type"`
+	Table     string    `json:"table_name"`
+	Query     string    `json:"query"`
+	Operation string    `json:"operation,omitempty"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// ConfigRecord is a row of the cluster_config table.
+type ConfigRecord struct {
+	ID        int       `json:"id"`
+	Voters    []int     `json:"voters"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// HintRecord is a message queued for a destination that could not be reached.
+type HintRecord struct {
+	ID          int       `json:"id"`
+	Destination string    `json:"destination"`
+	Descendants []string  `json:"descendants,omitempty"`
+	Message     string    `json:"message"` // JSON encoded MulticastMessage
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+// Snapshot is everything a store holds at one log position. It can be
+// restored into a store of any backend.
+type Snapshot struct {
+	Store    string         `json:"store"`    // Backend it was taken from
+	Position int            `json:"position"` // Last logged entry
+	Taken    time.Time      `json:"taken"`
+	Users    []UserRecord   `json:"users"`
+	Log      []LogRecord    `json:"log"`
+	Configs  []ConfigRecord `json:"configs"`
+	Hints    []HintRecord   `json:"hints"`
+
+	Migrations []AppliedMigration `json:"migrations"`
+}
+
+var store Store // The node's local storage, opened by openStore
+
+// storeBackend reads STORE.
+func storeBackend() string {
+	if value := strings.ToLower(os.Getenv("STORE")); value != "" {
+		return value
+	}
+	return defaultStore
+}
+
+// storePath reads STORE_PATH, the file the file backend keeps its data in.
+func storePath() string {
+	if value := os.Getenv("STORE_PATH"); value != "" {
+		return value
+	}
+	return fmt.Sprintf("node-%s.store", os.Getenv("NODE_ID"))
+}
+
+// openStore opens the backend selected by STORE, runs the pending startup
+// migrations and, if the store is empty, loads the snapshot named by
+// STORE_RESTORE into it.
+func openStore() (Store, error) {
+	var s Store
+	var err error
+	switch backend := storeBackend(); backend {
+	case "postgres":
+		s, err = openPostgresStore()
+	case "file":
+		s, err = openFileStore(storePath())
+	case "memory":
+		log.Printf("Node %s is using in-memory storage, nothing survives a restart", os.Getenv("NODE_ID"))
+		s = newMemoryStore()
+	default:
+		return nil, fmt.Errorf("unknown STORE %q (want postgres, file or memory)", backend)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := migrateOnOpen(s); err != nil {
+		s.Close()
+		return nil, err
+	}
+
+	if path := os.Getenv("STORE_RESTORE"); path != "" {
+		if err := restoreSnapshot(s, path); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// restoreSnapshot loads the snapshot at path, as served by /snapshot, into s
+// unless s already holds a log.
+func restoreSnapshot(s Store, path string) error {
+	last, err := s.LastLogID()
+	if err != nil {
+		return err
+	}
+	if last > 0 {
+		log.Printf("Store already holds the log up to %d, ignoring STORE_RESTORE", last)
+		return nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("error reading snapshot: %v", err)
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return fmt.Errorf("error decoding snapshot %s: %v", path, err)
+	}
+	if err := verifyApplied(snapshot.Migrations); err != nil {
+		return fmt.Errorf("cannot restore snapshot %s: %v", path, err)
+	}
+	if err := s.Restore(&snapshot); err != nil {
+		return fmt.Errorf("error restoring snapshot %s: %v", path, err)
+	}
+	log.Printf("Restored %s snapshot at log position %d into the %s store", snapshot.Store, snapshot.Position, s.Name())
+	return nil
+}
+
+// logRow is the /logs encoding of record, the columns Postgres returned
+// before there were other backends.
+func logRow(record LogRecord) map[string]interface{} {
+	var operation interface{}
+	if record.Operation != "" {
+		operation = record.Operation
+	}
+	return map[string]interface{}{
+		"id":         int64(record.ID),
+		"term":       int64(record.Term),
+		"type":       record.Type,
+		"table_name": record.Table,
+		"query":      record.Query,
+		"operation":  operation,
+	}
+}
+
+// getLogsAfter returns the logged entries after lastID as served by /logs.
+func getLogsAfter(lastID int) ([]map[string]interface{}, error) {
+	records, err := store.LogsAfter(lastID)
+	if err != nil {
+		return nil, err
+	}
+	logs := make([]map[string]interface{}, 0, len(records))
+	for _, record := range records {
+		logs = append(logs, logRow(record))
+	}
+	return logs, nil
+}
+
+// nodeStorage is the node's consensus.Storage: the store's transaction log
+// plus the data its entries are applied to.
+type nodeStorage struct{}
+
+// LastEntryID returns the ID of the most recent logged entry.
+func (nodeStorage) LastEntryID() (int, error) {
+	return store.LastLogID()
+}
+
+// EntriesAfter returns the logged entries after id.
+func (nodeStorage) EntriesAfter(id int) ([]consensus.Entry, error) {
+	logs, err := getLogsAfter(id)
+	if err != nil {
+		return nil, err
+	}
+	return logsToEntries(logs), nil
+}
+
+// Append logs and applies the entries within a transaction. Entries keep the
+// leader's sequence number as their log ID, and its term, so the record of an
+// applied position commits atomically with the data it changed.
+// A position that is already logged fails and nothing is applied, which makes
+// replay exactly-once across restarts.
+func (nodeStorage) Append(entries ...consensus.Entry) error {
+	if len(entries) == 0 {
+		return nil
+	}
+
+	tx, err := store.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for applying logs: %v", err)
+	}
+	defer tx.Rollback() // Rollback if anything fails
+
+	for _, entry := range entries {
+		// A malformed or unknown operation is refused before anything is applied
+		op, err := decodeOperation(entry.Operation)
+		if err != nil {
+			return fmt.Errorf("invalid log entry %d: %v", entry.ID, err)
+		}
+		log.Printf("Applying log entry %d: [%s] %s\n", entry.ID, entry.Type, op)
+
+		// 1. Log the entry itself at its position
+		err = tx.AppendLog(LogRecord{ID: entry.ID, Term: entry.Term, Type: entry.Type, Table: op.table(), Query: op.String(), Operation: string(entry.Operation)})
+		if err != nil {
+			if errors.Is(err, errLogPositionTaken) {
+				return consensus.ErrAlreadyApplied
+			}
+			return fmt.Errorf("error logging entry %d: %v", entry.ID, err)
+		}
+
+		// Witnesses keep the log for voting purposes but store no user data
+		if !storesTable(op.table()) {
+			continue
+		}
+
+		// 2. Apply the operation through the same code path as the leader
+		if _, err := applyOperation(tx, op, entry.ID); err != nil {
+			// If applying the operation fails, rollback is critical
+			return fmt.Errorf("error applying log entry %d: %v", entry.ID, err)
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	reportApplied(entries[0].ID, entries[len(entries)-1].ID)
+	for _, entry := range entries {
+		if entry.Table == configTable {
+			configAppended()
+			break
+		}
+	}
+	return nil
+}
+
+// TruncateFrom removes the log from position id on. What those entries
+// applied cannot be undone on its own, so the data is rebuilt by applying the
+// entries before id again, within the same transaction. Entries logged before
+// writes were replicated as operations hold only their SQL text, which is not
+// safe to execute, so they stay in the log but are not applied again.
+func (nodeStorage) TruncateFrom(id int) error {
+	records, err := store.LogsAfter(0)
+	if err != nil {
+		return err
+	}
+	var kept []Operation
+	var positions []int
+	legacy := 0
+	for _, record := range records {
+		if record.ID >= id {
+			break
+		}
+		if record.Operation == "" {
+			legacy++
+			continue
+		}
+		op, err := decodeOperation([]byte(record.Operation))
+		if err != nil {
+			return fmt.Errorf("cannot rebuild from log entry %d: %v", record.ID, err)
+		}
+		kept = append(kept, op)
+		positions = append(positions, record.ID)
+	}
+	if legacy > 0 {
+		log.Printf("Rebuilding without %d log entries that predate replicated operations", legacy)
+	}
+
+	tx, err := store.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction for truncating the log: %v", err)
+	}
+	defer tx.Rollback()
+
+	if err := tx.TruncateLog(id); err != nil {
+		return fmt.Errorf("error truncating log: %v", err)
+	}
+	for i, op := range kept {
+		if !storesTable(op.table()) {
+			continue
+		}
+		if _, err := applyOperation(tx, op, positions[i]); err != nil {
+			return fmt.Errorf("error applying log entry %d again: %v", positions[i], err)
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	log.Printf("Truncated the log from entry %d and rebuilt the data from %d entries", id, len(kept))
+	// A configuration entry may have been truncated, returning to the one before
+	configAppended()
+	return nil
+}
+
+// handleSnapshot serves GET /snapshot: a copy of everything this node stores,
+// which can be restored into any backend.
+func handleSnapshot(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	snapshot, err := store.Snapshot()
+	if err != nil {
+		http.Error(w, fmt.Sprintf("Error taking snapshot: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(snapshot)
+}
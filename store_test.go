@@ -0,0 +1,429 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"mymodule/consensus"
+)
+
+// storeBackends opens a fresh, migrated store of every backend that runs
+// without a server.
+var storeBackends = map[string]func(t *testing.T) Store{
+	"memory": func(t *testing.T) Store {
+		return migrated(t, newMemoryStore())
+	},
+	"file": func(t *testing.T) Store {
+		s, err := openFileStore(filepath.Join(t.TempDir(), "node.store"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		return migrated(t, s)
+	},
+}
+
+func migrated(t *testing.T, s Store) Store {
+	t.Helper()
+	if err := migrateOnOpen(s); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// forEachBackend runs the contract test fn against every backend.
+func forEachBackend(t *testing.T, fn func(t *testing.T, s Store)) {
+	for name, open := range storeBackends {
+		t.Run(name, func(t *testing.T) {
+			fn(t, open(t))
+		})
+	}
+}
+
+// write runs fn in a transaction and commits it.
+func write(t *testing.T, s Store, fn func(tx StoreTx) error) {
+	t.Helper()
+	tx, err := s.Begin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		t.Fatal(err)
+	}
+	if err := tx.Commit(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// addUser logs the creation of a user at position and applies it.
+func addUser(tx StoreTx, position int, email string) error {
+	if err := tx.AppendLog(LogRecord{ID: position, Term: 1, Type: "INSERT", Table: "users"}); err != nil {
+		return err
+	}
+	_, err := tx.UpsertUser(&UpsertUser{Email: email, PasswordHash: "hash"})
+	return err
+}
+
+// emails returns the stored users' emails in order.
+func emails(t *testing.T, s Store) []string {
+	t.Helper()
+	users, err := s.Users()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var emails []string
+	for _, u := range users {
+		emails = append(emails, u.Email)
+	}
+	return emails
+}
+
+// logIDs returns the logged positions in order.
+func logIDs(t *testing.T, s Store) []int {
+	t.Helper()
+	records, err := s.LogsAfter(0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []int
+	for _, r := range records {
+		ids = append(ids, r.ID)
+	}
+	return ids
+}
+
+func equal[T comparable](a, b []T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func TestStoreAppendLog(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		write(t, s, func(tx StoreTx) error {
+			if err := addUser(tx, 1, "a@example.com"); err != nil {
+				return err
+			}
+			return addUser(tx, 2, "b@example.com")
+		})
+
+		// A taken position fails and the transaction applies nothing
+		tx, err := s.Begin()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := addUser(tx, 3, "c@example.com"); err != nil {
+			t.Fatal(err)
+		}
+		if err := tx.AppendLog(LogRecord{ID: 2, Term: 1, Type: "INSERT", Table: "users"}); !errors.Is(err, errLogPositionTaken) {
+			t.Fatalf("appending a taken position returned %v, want errLogPositionTaken", err)
+		}
+		tx.Rollback()
+
+		if got := logIDs(t, s); !equal(got, []int{1, 2}) {
+			t.Fatalf("log is %v, want [1 2]", got)
+		}
+		if got := emails(t, s); !equal(got, []string{"a@example.com", "b@example.com"}) {
+			t.Fatalf("users are %v", got)
+		}
+		if last, err := s.LastLogID(); err != nil || last != 2 {
+			t.Fatalf("LastLogID = %d, %v, want 2", last, err)
+		}
+	})
+}
+
+func TestStoreSavepointRollback(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		write(t, s, func(tx StoreTx) error {
+			if err := tx.Savepoint(); err != nil {
+				return err
+			}
+			if err := addUser(tx, 1, "a@example.com"); err != nil {
+				return err
+			}
+			if err := tx.ReleaseSavepoint(); err != nil {
+				return err
+			}
+
+			// A failed write is undone on its own, and the position reused
+			if err := tx.Savepoint(); err != nil {
+				return err
+			}
+			if err := addUser(tx, 2, "bad@example.com"); err != nil {
+				return err
+			}
+			if err := tx.RollbackToSavepoint(); err != nil {
+				return err
+			}
+			if err := tx.ReleaseSavepoint(); err != nil {
+				return err
+			}
+
+			if err := tx.Savepoint(); err != nil {
+				return err
+			}
+			if err := addUser(tx, 2, "b@example.com"); err != nil {
+				return err
+			}
+			return tx.ReleaseSavepoint()
+		})
+
+		if got := logIDs(t, s); !equal(got, []int{1, 2}) {
+			t.Fatalf("log is %v, want [1 2]", got)
+		}
+		if got := emails(t, s); !equal(got, []string{"a@example.com", "b@example.com"}) {
+			t.Fatalf("users are %v", got)
+		}
+	})
+}
+
+func TestStoreReset(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		write(t, s, func(tx StoreTx) error {
+			if err := addUser(tx, 1, "a@example.com"); err != nil {
+				return err
+			}
+			if err := tx.AddConfig([]int{1, 2, 3}); err != nil {
+				return err
+			}
+			m := migrations[len(migrations)-1]
+			return tx.RecordMigration(AppliedMigration{Version: m.Version, Name: m.Name, Checksum: m.Checksum(), LogPosition: 1})
+		})
+		if err := s.AddHint("2", nil, "{}"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.Reset(); err != nil {
+			t.Fatal(err)
+		}
+		if got := logIDs(t, s); len(got) != 0 {
+			t.Errorf("log is %v after reset", got)
+		}
+		if got := emails(t, s); len(got) != 0 {
+			t.Errorf("users are %v after reset", got)
+		}
+		if _, err := s.LatestConfig(); !errors.Is(err, errNoClusterConfig) {
+			t.Errorf("LatestConfig after reset returned %v, want errNoClusterConfig", err)
+		}
+		if counts, err := s.HintCounts(); err != nil || len(counts) != 0 {
+			t.Errorf("hints after reset are %v, %v", counts, err)
+		}
+		applied, err := s.Migrations()
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, a := range applied {
+			if !a.Startup {
+				t.Errorf("replicated migration %d survived the reset", a.Version)
+			}
+		}
+		if len(applied) == 0 {
+			t.Errorf("reset dropped the startup migrations")
+		}
+	})
+}
+
+func TestStoreSnapshotRestore(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		write(t, s, func(tx StoreTx) error {
+			if err := addUser(tx, 1, "a@example.com"); err != nil {
+				return err
+			}
+			if err := addUser(tx, 2, "b@example.com"); err != nil {
+				return err
+			}
+			return tx.AddConfig([]int{1, 2})
+		})
+		if err := s.AddHint("3", []string{"4"}, "{}"); err != nil {
+			t.Fatal(err)
+		}
+		snapshot, err := s.Snapshot()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if snapshot.Position != 2 {
+			t.Fatalf("snapshot position is %d, want 2", snapshot.Position)
+		}
+
+		// Restore into a fresh store of every backend
+		for name, open := range storeBackends {
+			target := open(t)
+			write(t, target, func(tx StoreTx) error { return addUser(tx, 1, "stale@example.com") })
+			if err := target.Restore(snapshot); err != nil {
+				t.Fatalf("restoring into %s: %v", name, err)
+			}
+			if got := emails(t, target); !equal(got, []string{"a@example.com", "b@example.com"}) {
+				t.Errorf("%s: users are %v", name, got)
+			}
+			if got := logIDs(t, target); !equal(got, []int{1, 2}) {
+				t.Errorf("%s: log is %v", name, got)
+			}
+			if config, err := target.LatestConfig(); err != nil || !equal(config.Voters, []int{1, 2}) {
+				t.Errorf("%s: configuration is %v, %v", name, config, err)
+			}
+			if counts, err := target.HintCounts(); err != nil || counts["3"] != 1 {
+				t.Errorf("%s: hints are %v, %v", name, counts, err)
+			}
+		}
+	})
+}
+
+func TestStoreTruncateLog(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		write(t, s, func(tx StoreTx) error {
+			for i, email := range []string{"a@example.com", "b@example.com", "c@example.com"} {
+				if err := addUser(tx, i+1, email); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		write(t, s, func(tx StoreTx) error { return tx.TruncateLog(2) })
+
+		// The applied data goes with it, for the caller to rebuild
+		if got := logIDs(t, s); !equal(got, []int{1}) {
+			t.Fatalf("log is %v, want [1]", got)
+		}
+		if got := emails(t, s); len(got) != 0 {
+			t.Fatalf("users are %v after truncating", got)
+		}
+		write(t, s, func(tx StoreTx) error { return addUser(tx, 2, "d@example.com") })
+		if got := logIDs(t, s); !equal(got, []int{1, 2}) {
+			t.Fatalf("log is %v, want [1 2]", got)
+		}
+	})
+}
+
+func TestStoreHintQueue(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		for _, message := range []string{"1", "2", "3"} {
+			if err := s.AddHint("2", nil, message); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := s.AddHint("3", nil, "other"); err != nil {
+			t.Fatal(err)
+		}
+
+		dropped, err := s.TrimHints("2", 2)
+		if err != nil || dropped != 1 {
+			t.Fatalf("TrimHints = %d, %v, want 1", dropped, err)
+		}
+		queued, err := s.Hints("2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(queued) != 2 || queued[0].Message != "2" || queued[1].Message != "3" {
+			t.Fatalf("queue after trimming is %+v, want the newest two", queued)
+		}
+
+		if removed, err := s.RemoveHint(queued[0].ID); err != nil || !removed {
+			t.Fatalf("RemoveHint = %v, %v, want true", removed, err)
+		}
+		if removed, err := s.RemoveHint(queued[0].ID); err != nil || removed {
+			t.Fatalf("removing a hint twice = %v, %v, want false", removed, err)
+		}
+		if counts, err := s.HintCounts(); err != nil || counts["2"] != 1 || counts["3"] != 1 {
+			t.Fatalf("hint counts are %v, %v", counts, err)
+		}
+	})
+}
+
+func TestFileStoreReplay(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.store")
+	s, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrated(t, s)
+	write(t, s, func(tx StoreTx) error { return addUser(tx, 1, "a@example.com") })
+	write(t, s, func(tx StoreTx) error { return addUser(tx, 2, "b@example.com") })
+	s.Close()
+
+	// A crash in the middle of a commit leaves its line incomplete
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteString(`[{"kind":"append_log","log":{"id":3,`); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	reopened, err := openFileStore(path)
+	if err != nil {
+		t.Fatalf("reopening after a torn write: %v", err)
+	}
+	defer reopened.Close()
+	if got := logIDs(t, reopened); !equal(got, []int{1, 2}) {
+		t.Fatalf("log after replay is %v, want [1 2]", got)
+	}
+	if got := emails(t, reopened); !equal(got, []string{"a@example.com", "b@example.com"}) {
+		t.Fatalf("users after replay are %v", got)
+	}
+
+	// Compaction dropped the torn line, so later commits replay too
+	write(t, reopened, func(tx StoreTx) error { return addUser(tx, 3, "c@example.com") })
+	reopened.Close()
+	again, err := openFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer again.Close()
+	if got := logIDs(t, again); !equal(got, []int{1, 2, 3}) {
+		t.Fatalf("log after the second replay is %v, want [1 2 3]", got)
+	}
+}
+
+func TestFileStoreCorruptLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "node.store")
+	// A complete line that does not decode is corruption, not a torn write
+	if err := os.WriteFile(path, []byte("[{\"kind\":\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openFileStore(path); err == nil {
+		t.Fatal("opened a store file with a corrupt transaction")
+	}
+}
+
+func TestTruncateFromLegacyEntries(t *testing.T) {
+	forEachBackend(t, func(t *testing.T, s Store) {
+		store = s
+		// Entries logged before operations were replicated carry only their SQL
+		write(t, s, func(tx StoreTx) error {
+			return tx.AppendLog(LogRecord{ID: 1, Term: 1, Type: "INSERT", Table: "users",
+				Query: "INSERT INTO users (email) VALUES ('legacy@example.com')"})
+		})
+
+		var entries []consensus.Entry
+		for i, email := range []string{"a@example.com", "b@example.com"} {
+			op, err := encodeOperation(Operation{Kind: OpUpsertUser, UpsertUser: &UpsertUser{Email: email, PasswordHash: "hash"}})
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, consensus.Entry{ID: i + 2, Term: 1, Type: "INSERT", Table: "users", Operation: op})
+		}
+		if err := (nodeStorage{}).Append(entries...); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := (nodeStorage{}).TruncateFrom(3); err != nil {
+			t.Fatalf("truncating after a legacy entry: %v", err)
+		}
+		if got := logIDs(t, s); !equal(got, []int{1, 2}) {
+			t.Fatalf("log is %v, want [1 2]", got)
+		}
+		if got := emails(t, s); !equal(got, []string{"a@example.com"}) {
+			t.Fatalf("users are %v, want the kept entry's", got)
+		}
+	})
+}
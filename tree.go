@@ -1,33 +1,27 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"net/http"
+	"io"
+	"log"
+	"maps"
 	"os"
 	"sort"
+	"strconv"
 	"sync"
 )
 
 func GetTree() *SpanningTree {
 	treeOnce.Do(func() {
 		globalTree = &SpanningTree{
-			Root: nil,
-			mu:   sync.RWMutex{},
+			Root:   nil,
+			Fanout: treeFanout(),
+			mu:     sync.RWMutex{},
 		}
 	})
 	return globalTree
 }
 
-type GetTreeRequest struct {
-	Leader  string `json:"leader"`
-	Address string `json:"address"`
-	Node    string `json:"recoveredNode"`
-	Naddr   string `json:"naddr"`
-}
-
 type SerializableNode struct {
 	ID       string             `json:"id"`
 	Address  string             `json:"address"`
@@ -35,346 +29,297 @@ type SerializableNode struct {
 	Children []SerializableNode `json:"children,omitempty"`
 }
 
-func (s *SpanningTree) AddNode(nodeID, address, leaderID string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
+// The spanning tree is a complete k-ary tree: in breadth-first order every
+// node has Fanout children until the nodes run out, so the tree is
+// ceil(log_k(n)) levels deep and no node forwards to more than k children.
+// BuildTree derives it from the membership list alone, so every node that
+// sees the same members and leader computes the same tree.
+const defaultTreeFanout = 2
 
-	node := &SpanningTreeNode{
-		ID:       nodeID,
-		address:  address,
-		Parent:   nil,
-		Children: make([]*SpanningTreeNode, 0),
-		mu:       sync.RWMutex{},
-	}
-
-	if s.Root.FindNodeDFS(nodeID) != nil {
-		return
-	}
+var (
+	fanoutOnce       sync.Once
+	configuredFanout int
+)
 
-	if s.Root == nil {
-		// If there's no root, this node becomes the root
-		s.Root = node
-	} else {
-		// Use BFS or another method to find where to add this node
-		queue := []*SpanningTreeNode{s.Root}
-		for len(queue) > 0 {
-			current := queue[0]
-			queue = queue[1:]
-
-			if len(current.Children) < 2 {
-				current.Children = append(current.Children, node)
-				node.Parent = current
-				break
+// treeFanout reads TREE_FANOUT, the fan-out this node uses as leader. A larger
+// fan-out gives a shallower tree at the cost of more outbound messages from
+// each interior node.
+func treeFanout() int {
+	fanoutOnce.Do(func() {
+		configuredFanout = defaultTreeFanout
+		if value := os.Getenv("TREE_FANOUT"); value != "" {
+			if k, err := strconv.Atoi(value); err == nil && k > 0 {
+				configuredFanout = k
+			} else {
+				log.Printf("Invalid TREE_FANOUT %q, using %d", value, defaultTreeFanout)
 			}
-
-			// Add children to queue for further exploration
-			queue = append(queue, current.Children...)
 		}
-	}
-	fmt.Println("the rebalancing is starting")
-	// Rebalance from the root downwards
-	s.Root = rebalance(s.Root)
+	})
+	return configuredFanout
+}
 
-	fmt.Println("The rebalancing is done")
-	// Ensure leader remains root
-	if s.Root.ID != leaderID {
-		s.EnsureLeaderAsRoot(leaderID)
+// fanout returns the tree's fan-out. Caller must hold s.mu.
+func (s *SpanningTree) fanout() int {
+	if s.Fanout < 1 {
+		return defaultTreeFanout
 	}
+	return s.Fanout
 }
 
-func (s *SpanningTree) RemoveNode(nodeID string, leaderID string) {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
+// nodesBFS returns the tree's nodes in breadth-first order. Caller must hold s.mu.
+func (s *SpanningTree) nodesBFS() []*SpanningTreeNode {
 	if s.Root == nil {
-		return
+		return nil
 	}
-
-	var removeNode func(*SpanningTreeNode, string) *SpanningTreeNode
-	removeNode = func(node *SpanningTreeNode, id string) *SpanningTreeNode {
-		if node == nil {
-			return nil
-		}
-
-		if id < node.ID {
-			if len(node.Children) > 0 {
-				node.Children[0] = removeNode(node.Children[0], id)
-			}
-		} else if id > node.ID {
-			if len(node.Children) > 1 {
-				node.Children[1] = removeNode(node.Children[1], id)
-			}
-		} else {
-			// Node found: handle removal logic here
-
-			if len(node.Children) == 0 {
-				return nil
-			} else if len(node.Children) == 1 {
-				return node.Children[0]
-			} else {
-				successor := findMin(node.Children[1])
-				if successor == nil || successor.ID == node.ID {
-					return node.Children[0]
-				}
-				node.ID = successor.ID
-				node.address = successor.address
-				node.Children[1] = removeNode(node.Children[1], successor.ID)
+	nodes := []*SpanningTreeNode{s.Root}
+	for i := 0; i < len(nodes); i++ {
+		nodes[i].mu.RLock()
+		for _, child := range nodes[i].Children {
+			if child != nil {
+				nodes = append(nodes, child)
 			}
 		}
-
-		return rebalance(node)
+		nodes[i].mu.RUnlock()
 	}
-
-	s.Root = removeNode(s.Root, nodeID)
-
-	// Ensure leader remains root after removal and rebalancing.
-	s.EnsureLeaderAsRoot(leaderID)
+	return nodes
 }
 
-// Helper function to find minimum value in a subtree (in-order successor)
-func findMin(node *SpanningTreeNode) *SpanningTreeNode {
-	current := node
-	if current == nil {
-		return nil
+// SetFanout rebuilds the tree with fan-out k, keeping the nodes in the same
+// breadth-first order.
+func (s *SpanningTree) SetFanout(k int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if k < 1 || k == s.fanout() {
+		return
 	}
-	for len(current.Children) > 0 && current.Children[0] != nil {
-		current = current.Children[0]
+	if s.Plan != 0 {
+		// The leader's plan already respects its fan-out
+		s.Fanout = k
+		return
 	}
-	return current
+	s.Fanout = k
+	s.layout(s.nodesBFS())
+	fmt.Printf("Rebuilt spanning tree with fan-out %d\n", k)
+	s.check("fan-out change")
 }
 
-func (s *SpanningTree) EnsureLeaderAsRoot(leaderID string) {
-	fmt.Printf("start swapping")
-	if s.Root != nil && s.Root.ID != leaderID {
-		leaderNode := s.Root.FindNodeDFS(leaderID)
-		fmt.Printf("Insisde ensureleader %v", leaderNode)
-		if leaderNode != nil {
-			// Swap IDs and addresses between the root and the leader node
-			s.Root.ID, leaderNode.ID = leaderNode.ID, s.Root.ID
-			s.Root.address, leaderNode.address = leaderNode.address, s.Root.address
+// linkComplete links nodes, in order, as a complete k-ary tree rooted at
+// nodes[0]: node i's children are nodes k*i+1 to k*i+k.
+func linkComplete(nodes []*SpanningTreeNode, k int) {
+	for i, node := range nodes {
+		node.mu.Lock()
+		node.Children = make([]*SpanningTreeNode, 0, k)
+		for j := k*i + 1; j <= k*i+k && j < len(nodes); j++ {
+			node.Children = append(node.Children, nodes[j])
+			nodes[j].Parent = node
 		}
+		node.mu.Unlock()
 	}
 }
 
-func rebalance(node *SpanningTreeNode) *SpanningTreeNode {
-	if node == nil {
-		return nil
+// layout links nodes, rooted at nodes[0], as the tree's shape. Caller must
+// hold s.mu.
+//
+// With region labels the root's region forms a complete k-ary tree under the
+// root, and every other region forms one under its relay, its first node,
+// which is the root's only child in that region. A multicast then crosses
+// into each region exactly once, however the regions' nodes are numbered.
+// Unlabelled nodes stay in the root's region.
+func (s *SpanningTree) layout(nodes []*SpanningTreeNode) {
+	s.Version++
+	if len(nodes) == 0 {
+		s.Root = nil
+		return
 	}
+	root := nodes[0]
+	root.Parent = nil
+	s.Root = root
+	k := s.fanout()
 
-	leftHeight := 0
-	rightHeight := 0
-
-	if len(node.Children) > 0 {
-		leftHeight = height(node.Children[0])
-	}
-	if len(node.Children) > 1 {
-		rightHeight = height(node.Children[1])
+	if s.Regions == nil {
+		linkComplete(nodes, k)
+		return
 	}
 
-	balance := leftHeight - rightHeight
-
-	// Left heavy
-	if balance > 1 {
-		if len(node.Children[0].Children) > 1 && height(node.Children[0].Children[0]) >= height(node.Children[0].Children[1]) {
-			// Left-Left case
-			return rotateRight(node)
-		} else {
-			// Left-Right case
-			node.Children[0] = rotateLeft(node.Children[0])
-			return rotateRight(node)
+	home := s.Regions[root.ID]
+	local := []*SpanningTreeNode{root}
+	remote := make(map[string][]*SpanningTreeNode)
+	var regions []string
+	for _, node := range nodes[1:] {
+		region := s.Regions[node.ID]
+		if region == "" || region == home {
+			local = append(local, node)
+			continue
 		}
-	}
-
-	// Right heavy
-	if balance < -1 {
-		if len(node.Children[1].Children) > 1 && height(node.Children[1].Children[1]) >= height(node.Children[1].Children[0]) {
-			// Right-Right case
-			return rotateLeft(node)
-		} else {
-			// Right-Left case
-			node.Children[1] = rotateRight(node.Children[1])
-			return rotateLeft(node)
+		if remote[region] == nil {
+			regions = append(regions, region)
 		}
+		remote[region] = append(remote[region], node)
 	}
+	linkComplete(local, k)
 
-	return node
-}
-
-// Helper function to perform a right rotation
-func rotateRight(y *SpanningTreeNode) *SpanningTreeNode {
-	if y == nil || len(y.Children) == 0 {
-		return y
-	}
-
-	x := y.Children[0]
-	if x == nil {
-		return y
+	sort.Strings(regions)
+	for _, region := range regions {
+		members := remote[region]
+		linkComplete(members, k)
+		relay := members[0]
+		relay.Parent = root
+		root.mu.Lock()
+		root.Children = append(root.Children, relay)
+		root.mu.Unlock()
 	}
+}
 
-	// Safely handle T2 (which might not exist)
-	var T2 *SpanningTreeNode
-	if len(x.Children) > 1 {
-		T2 = x.Children[1]
+// memberRegions maps each member to its region label, or returns nil when no
+// member has one and the tree should ignore regions.
+func memberRegions(members map[string]*MemberInfo1) map[string]string {
+	regions := make(map[string]string, len(members))
+	labelled := false
+	for id, member := range members {
+		regions[id] = member.Region
+		if member.Region != "" {
+			labelled = true
+		}
 	}
-
-	// Ensure x has enough capacity for children
-	if len(x.Children) < 2 {
-		x.Children = append(x.Children, nil)
+	if !labelled {
+		return nil
 	}
+	return regions
+}
 
-	// Perform rotation
-	x.Children[1] = y
+// Install replaces the tree with the leader's latency plan.
+func (s *SpanningTree) Install(plan *LatencyPlan) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Ensure y has enough capacity for children
-	if len(y.Children) < 1 {
-		y.Children = append(y.Children, nil)
+	if s.Plan == plan.Version && s.Root != nil && s.Root.ID == plan.Leader {
+		return
 	}
-	y.Children[0] = T2
-
-	return x
+	s.Root = reconstructNode(&plan.Root, nil, make(map[string]*SpanningTreeNode))
+	s.Regions = nil
+	s.Plan = plan.Version
+	s.members = nil
+	s.leader = plan.Leader
+	s.Version++
+	s.check("installing latency plan")
 }
 
-// Helper function to perform a left rotation
-func rotateLeft(x *SpanningTreeNode) *SpanningTreeNode {
-	// Check if x exists and has enough children
-	if x == nil || len(x.Children) < 2 {
-		return x
-	}
-
-	// Check if right child exists
-	y := x.Children[1]
-	if y == nil {
-		return x
+// BuildTree returns the spanning tree for members with leader at the root and
+// the given fan-out. The other members follow the leader in ID order, laid
+// out by region when any member has a region label. The result depends only
+// on its arguments.
+func BuildTree(members map[string]*MemberInfo1, leader string, fanout int) *SpanningTree {
+	tree := &SpanningTree{Fanout: fanout, Regions: memberRegions(members)}
+
+	ids := make([]string, 0, len(members))
+	for id := range members {
+		if id != leader {
+			ids = append(ids, id)
+		}
 	}
-
-	// Safely handle T2 (which might not exist)
-	var T2 *SpanningTreeNode
-	if len(y.Children) > 0 {
-		T2 = y.Children[0]
+	sort.Strings(ids)
+	if members[leader] != nil {
+		ids = append([]string{leader}, ids...)
 	}
 
-	// Ensure y has enough capacity for children
-	if len(y.Children) < 1 {
-		y.Children = append(y.Children, nil)
+	nodes := make([]*SpanningTreeNode, 0, len(ids))
+	for _, id := range ids {
+		nodes = append(nodes, &SpanningTreeNode{
+			ID:       id,
+			address:  members[id].Address,
+			Children: make([]*SpanningTreeNode, 0),
+		})
 	}
+	tree.layout(nodes)
+	return tree
+}
 
-	// Perform rotation
-	y.Children[0] = x
+// Rebuild replaces the tree with BuildTree at the tree's fan-out, unless that
+// is the tree it already has.
+func (s *SpanningTree) Rebuild(members map[string]*MemberInfo1, leaderID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 
-	// Ensure x has enough capacity for children
-	if len(x.Children) < 2 {
-		x.Children = append(x.Children, nil)
+	s.members = members
+	s.leader = leaderID
+	built := BuildTree(members, leaderID, s.fanout())
+	if s.Plan == 0 && maps.Equal(s.Regions, built.Regions) && sameTree(s.Root, built.Root) {
+		return
 	}
-	x.Children[1] = T2
-
-	return y
+	s.Root = built.Root
+	s.Regions = built.Regions
+	s.Plan = 0
+	s.Version++
+	fmt.Printf("Rebuilt spanning tree for %d members with leader %s\n", len(members), leaderID)
+	s.check("rebuild")
 }
 
-// Helper function to calculate the height of a node
-func height(n *SpanningTreeNode) int {
-	if n == nil {
-		return 0
-	}
-
-	leftHeight := 0
-	rightHeight := 0
-
-	if len(n.Children) > 0 {
-		leftHeight = height(n.Children[0])
+// sameTree reports whether a and b have the same nodes, addresses and edges.
+func sameTree(a, b *SpanningTreeNode) bool {
+	if a == nil || b == nil {
+		return a == b
 	}
-
-	if len(n.Children) > 1 {
-		rightHeight = height(n.Children[1])
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if a.ID != b.ID || a.address != b.address || len(a.Children) != len(b.Children) {
+		return false
 	}
-
-	if leftHeight > rightHeight {
-		return leftHeight + 1
+	for i := range a.Children {
+		if !sameTree(a.Children[i], b.Children[i]) {
+			return false
+		}
 	}
-
-	return rightHeight + 1
+	return true
 }
 
-func (s *SpanningTree) findParent() *SpanningTreeNode {
-	var findNodeWithFewestChildren func(*SpanningTreeNode) *SpanningTreeNode
-	findNodeWithFewestChildren = func(n *SpanningTreeNode) *SpanningTreeNode {
-		if len(n.Children) < 2 {
-			return n
+// Shape returns the tree's fan-out, its depth and how many children nodeID
+// forwards to.
+func (s *SpanningTree) Shape(nodeID string) (fanout, depth, children int) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	level := map[*SpanningTreeNode]int{}
+	for _, node := range s.nodesBFS() {
+		if node.Parent != nil {
+			level[node] = level[node.Parent] + 1
 		}
-		for _, child := range n.Children {
-			if node := findNodeWithFewestChildren(child); node != nil {
-				return node
-			}
+		if level[node]+1 > depth {
+			depth = level[node] + 1
+		}
+		if node.ID == nodeID {
+			node.mu.RLock()
+			children = len(node.Children)
+			node.mu.RUnlock()
 		}
-		return nil
 	}
-
-	return findNodeWithFewestChildren(s.Root)
+	return s.fanout(), depth, children
 }
 
-func GetLeaderTree(leader string, address string, id string, addr string) error {
-	getTreeReq := &GetTreeRequest{
-		Leader:  leader,
-		Address: address,
-		Node:    id,
-		Naddr:   addr,
-	}
-	jsonData, err := json.Marshal(getTreeReq)
-	if err != nil {
-		return fmt.Errorf("failed to marshal get Tree message: %v", err)
-	}
+// writeTreeMetrics writes the spanning tree's shape in Prometheus text format.
+func writeTreeMetrics(w io.Writer, nodeID int) {
+	fanout, depth, children := GetGlobalTree().Shape(strconv.Itoa(nodeID))
 
-	fmt.Printf("http://%s/getTreeFromLeader", address)
-	resp, err := http.Post(fmt.Sprintf("http://%s/getTreeFromLeader", address), "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return fmt.Errorf("failed to send multicast: %v", err)
-	}
-	defer resp.Body.Close()
-	tree := GetGlobalTree()
-	body, err := ioutil.ReadAll(resp.Body)
-	stree, err := ReconstructTree(body)
-	tree.Root = stree.Root
-	return nil
-}
+	fmt.Fprintf(w, "# HELP node_tree_fanout Maximum children per node in the spanning tree\n")
+	fmt.Fprintf(w, "# TYPE node_tree_fanout gauge\n")
+	fmt.Fprintf(w, "node_tree_fanout{node_id=\"%d\"} %d\n", nodeID, fanout)
 
-func GetTreeFromLeader(w http.ResponseWriter, r *http.Request) {
-	fmt.Printf("Received Request for Tree\n")
-	var req GetTreeRequest
+	fmt.Fprintf(w, "# HELP node_tree_depth Levels in the spanning tree\n")
+	fmt.Fprintf(w, "# TYPE node_tree_depth gauge\n")
+	fmt.Fprintf(w, "node_tree_depth{node_id=\"%d\"} %d\n", nodeID, depth)
 
-	err := json.NewDecoder(r.Body).Decode(&req)
-	if err != nil {
-		fmt.Printf("Error decoding GetTree request: %v", err)
-		http.Error(w, "Bad request", http.StatusBadRequest)
-		return
-	}
-	tree := GetGlobalTree()
-	tree.AddNode(req.Node, req.Naddr, req.Leader)
-	serialTree, err := tree.Root.ToSerializable()
-	w.Header().Set("Content-Type", "application/json")
-	prevMembershipList = append(prevMembershipList, req.Node)
-	json.NewEncoder(w).Encode(serialTree)
-}
-
-func ConstructSpanningTree(tree *SpanningTree, members map[string]*MemberInfo1, leader string) error {
-	fmt.Printf("Recovery : %v\n", recovery)
-	if recovery == true {
-		id := fmt.Sprint(os.Getenv("NODE_ID"))
-		return GetLeaderTree(leader, members[leader].Address, id, members[id].Address)
-	}
-	keys := make([]string, 0, len(members))
-	for k := range members {
-		keys = append(keys, k)
-	}
-	sort.Strings(keys)
+	fmt.Fprintf(w, "# HELP node_tree_epoch Epoch of the leader's tree this node routes with\n")
+	fmt.Fprintf(w, "# TYPE node_tree_epoch gauge\n")
+	fmt.Fprintf(w, "node_tree_epoch{node_id=\"%d\"} %d\n", nodeID, GetGlobalTree().CurrentEpoch())
 
-	fmt.Printf("Keys : %v", keys)
+	fmt.Fprintf(w, "# HELP node_tree_fetches_total Fetches of the leader's tree for a newer epoch\n")
+	fmt.Fprintf(w, "# TYPE node_tree_fetches_total counter\n")
+	fmt.Fprintf(w, "node_tree_fetches_total{node_id=\"%d\",result=\"ok\"} %d\n", nodeID, treeFetches.Load()-treeFetchErrors.Load())
+	fmt.Fprintf(w, "node_tree_fetches_total{node_id=\"%d\",result=\"error\"} %d\n", nodeID, treeFetchErrors.Load())
 
-	for _, key := range keys {
-		memberInfo := members[key]
-		fmt.Println("going to add the node")
-		tree.AddNode(key, memberInfo.Address, leader) // Assuming Address is a string field in MemberInfo1
-	}
-	fmt.Printf("Tree.root %s :%s\n", tree.Root.ID, tree.Root.address)
-	return nil
+	fmt.Fprintf(w, "# HELP node_tree_children Children this node forwards multicasts to\n")
+	fmt.Fprintf(w, "# TYPE node_tree_children gauge\n")
+	fmt.Fprintf(w, "node_tree_children{node_id=\"%d\"} %d\n", nodeID, children)
 }
 
 func (node *SpanningTreeNode) FindNodeDFS(targetID string) *SpanningTreeNode {
@@ -501,19 +446,6 @@ func (node *SpanningTreeNode) ToSerializable() (SerializableNode, error) {
 	return serialNode, nil
 }
 
-// Function to reconstruct the tree from JSON
-func ReconstructTree(data []byte) (*SpanningTree, error) {
-	var serialNode SerializableNode
-	if err := json.Unmarshal(data, &serialNode); err != nil {
-		return nil, err
-	}
-
-	nodeMap := make(map[string]*SpanningTreeNode)
-	root := reconstructNode(&serialNode, nil, nodeMap)
-
-	return &SpanningTree{Root: root}, nil
-}
-
 func reconstructNode(serialNode *SerializableNode, parent *SpanningTreeNode, nodeMap map[string]*SpanningTreeNode) *SpanningTreeNode {
 	node := &SpanningTreeNode{
 		ID:       serialNode.ID,
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"math/rand"
+	"testing"
+)
+
+// randomMembers returns n members with IDs in random order and, when regions
+// is positive, region labels drawn from that many regions. Some members stay
+// unlabelled, as nodes started without NODE_REGION do.
+func randomMembers(r *rand.Rand, n, regions int) []*MemberInfo1 {
+	members := make([]*MemberInfo1, 0, n)
+	for _, i := range r.Perm(n) {
+		member := &MemberInfo1{ID: fmt.Sprint(i + 1), Address: fmt.Sprintf("node%d:8080", i+1)}
+		if regions > 0 && r.Intn(5) > 0 {
+			member.Region = fmt.Sprintf("region-%d", r.Intn(regions))
+		}
+		members = append(members, member)
+	}
+	return members
+}
+
+// membershipMap inserts members into a new map in the given order.
+func membershipMap(members []*MemberInfo1, order []int) map[string]*MemberInfo1 {
+	m := make(map[string]*MemberInfo1, len(members))
+	for _, i := range order {
+		m[members[i].ID] = members[i]
+	}
+	return m
+}
+
+func TestBuildTreeProperties(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for run := 0; run < 500; run++ {
+		n := 1 + r.Intn(40)
+		fanout := 1 + r.Intn(4)
+		members := randomMembers(r, n, r.Intn(4))
+		leader := members[r.Intn(n)].ID
+		name := fmt.Sprintf("run %d: %d members, fan-out %d, leader %s", run, n, fanout, leader)
+
+		tree := BuildTree(membershipMap(members, r.Perm(n)), leader, fanout)
+
+		// The result depends only on the membership, not on map order
+		for i := 0; i < 3; i++ {
+			other := BuildTree(membershipMap(members, r.Perm(n)), leader, fanout)
+			if !sameTree(tree.Root, other.Root) || !maps.Equal(tree.Regions, other.Regions) {
+				t.Fatalf("%s: trees differ between insertion orders", name)
+			}
+		}
+
+		if tree.Root == nil || tree.Root.ID != leader {
+			t.Fatalf("%s: root is not the leader", name)
+		}
+
+		seen := make(map[string]int)
+		for _, node := range tree.nodesBFS() {
+			seen[node.ID]++
+			checkFanout(t, name, tree, node, fanout)
+		}
+		for _, member := range members {
+			if seen[member.ID] != 1 {
+				t.Fatalf("%s: member %s appears %d times", name, member.ID, seen[member.ID])
+			}
+		}
+		if len(seen) != n {
+			t.Fatalf("%s: tree has %d nodes, want %d", name, len(seen), n)
+		}
+
+		tree.members = membershipMap(members, r.Perm(n))
+		tree.leader = leader
+		if violations := tree.Validate(); len(violations) != 0 {
+			t.Fatalf("%s: %v", name, violations)
+		}
+	}
+}
+
+// checkFanout fails the test if node forwards to more than fanout children
+// in its own region. Only the root may exceed that, with one relay for each
+// other region, and every relay must be the root's child.
+func checkFanout(t *testing.T, name string, tree *SpanningTree, node *SpanningTreeNode, fanout int) {
+	t.Helper()
+	home := tree.Regions[tree.Root.ID]
+	region := func(n *SpanningTreeNode) string {
+		if r := tree.Regions[n.ID]; r != "" {
+			return r
+		}
+		return home
+	}
+
+	local := 0
+	relays := make(map[string]bool)
+	for _, child := range node.Children {
+		if region(child) == region(node) {
+			local++
+			continue
+		}
+		if node != tree.Root {
+			t.Fatalf("%s: node %s in %s forwards across regions to %s in %s",
+				name, node.ID, region(node), child.ID, region(child))
+		}
+		if relays[region(child)] {
+			t.Fatalf("%s: root has two relays into %s", name, region(child))
+		}
+		relays[region(child)] = true
+	}
+	if local > fanout {
+		t.Fatalf("%s: node %s has %d children, fan-out is %d", name, node.ID, local, fanout)
+	}
+}
+
+func TestBuildTreeLeaderNotMember(t *testing.T) {
+	members := randomMembers(rand.New(rand.NewSource(1)), 5, 0)
+	tree := BuildTree(membershipMap(members, []int{0, 1, 2, 3, 4}), "9", 2)
+
+	// Without the leader the tree is rooted at the lowest ID
+	if tree.Root == nil || tree.Root.ID != "1" {
+		t.Fatalf("root is %v, want node 1", tree.Root)
+	}
+	if got := len(tree.nodesBFS()); got != 5 {
+		t.Fatalf("tree has %d nodes, want 5", got)
+	}
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"sync/atomic"
+)
+
+// The tree is checked after every change: it must hold exactly the members it
+// was built from, with the leader at the root, no node reachable twice, no
+// duplicate IDs, Parent pointers that match the edges and no node over its
+// fan-out. A tree that fails is rebuilt from its members when this node
+// derived it; a tree adopted from the leader is dropped instead, so the next
+// multicast fetches or derives a fresh one.
+
+var (
+	treeViolations atomic.Int64 // Violations found
+	treeRepairs    atomic.Int64 // Trees rebuilt or dropped because of them
+)
+
+// TreeValidation is the answer to GET /tree/validate.
+type TreeValidation struct {
+	Valid      bool     `json:"valid"`
+	Violations []string `json:"violations"`
+	Epoch      int      `json:"epoch"`
+	Version    int      `json:"version"`
+	Repairs    int64    `json:"repairs"`
+}
+
+// Validate reports every way the tree breaks its invariants.
+func (s *SpanningTree) Validate() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.validate()
+}
+
+// validate is Validate for a caller that holds s.mu.
+func (s *SpanningTree) validate() []string {
+	violations := []string{}
+	if s.Root == nil {
+		if len(s.members) > 0 {
+			violations = append(violations, fmt.Sprintf("tree is empty but has %d members", len(s.members)))
+		}
+		return violations
+	}
+
+	if s.Root.Parent != nil {
+		violations = append(violations, fmt.Sprintf("root %s has parent %s", s.Root.ID, s.Root.Parent.ID))
+	}
+	// A leader that is not yet a member cannot be the root of a tree derived from membership
+	if s.leader != "" && s.Root.ID != s.leader && (s.members == nil || s.members[s.leader] != nil) {
+		violations = append(violations, fmt.Sprintf("root is %s but the leader is %s", s.Root.ID, s.leader))
+	}
+
+	// Walk by pointer, so a cycle or a node linked twice is reported instead of looping
+	visited := make(map[*SpanningTreeNode]bool)
+	ids := make(map[string]bool)
+	queue := []*SpanningTreeNode{s.Root}
+	visited[s.Root] = true
+	for len(queue) > 0 {
+		node := queue[0]
+		queue = queue[1:]
+
+		node.mu.RLock()
+		id, children := node.ID, append([]*SpanningTreeNode(nil), node.Children...)
+		node.mu.RUnlock()
+
+		if ids[id] {
+			violations = append(violations, fmt.Sprintf("node %s appears more than once", id))
+		}
+		ids[id] = true
+
+		limit := s.fanout()
+		if s.Plan != 0 || (s.Regions != nil && node == s.Root) {
+			// Plans follow the leader's fan-out, and a regional root also has one relay per other region
+			limit = len(children)
+		}
+		if len(children) > limit {
+			violations = append(violations, fmt.Sprintf("node %s has %d children, fan-out is %d", id, len(children), limit))
+		}
+
+		for _, child := range children {
+			if child == nil {
+				violations = append(violations, fmt.Sprintf("node %s has a nil child", id))
+				continue
+			}
+			if child.Parent != node {
+				parent := "none"
+				if child.Parent != nil {
+					parent = child.Parent.ID
+				}
+				violations = append(violations, fmt.Sprintf("node %s is a child of %s but its parent is %s", child.ID, id, parent))
+			}
+			if visited[child] {
+				violations = append(violations, fmt.Sprintf("node %s is reachable twice (cycle or shared subtree)", child.ID))
+				continue
+			}
+			visited[child] = true
+			queue = append(queue, child)
+		}
+	}
+
+	if s.members != nil {
+		var missing, extra []string
+		for id := range s.members {
+			if !ids[id] {
+				missing = append(missing, id)
+			}
+		}
+		for id := range ids {
+			if s.members[id] == nil {
+				extra = append(extra, id)
+			}
+		}
+		sort.Strings(missing)
+		sort.Strings(extra)
+		for _, id := range missing {
+			violations = append(violations, fmt.Sprintf("member %s is missing from the tree", id))
+		}
+		for _, id := range extra {
+			violations = append(violations, fmt.Sprintf("node %s is not a member", id))
+		}
+	}
+	return violations
+}
+
+// check validates the tree after a change and repairs it if it is broken,
+// returning the violations it found. Caller must hold s.mu.
+func (s *SpanningTree) check(change string) []string {
+	violations := s.validate()
+	if len(violations) == 0 {
+		return violations
+	}
+	treeViolations.Add(int64(len(violations)))
+	treeRepairs.Add(1)
+	log.Printf("Spanning tree invalid after %s: %v", change, violations)
+
+	if s.members != nil {
+		built := BuildTree(s.members, s.leader, s.fanout())
+		s.Root = built.Root
+		s.Regions = built.Regions
+		s.Plan = 0
+	} else {
+		s.Root = nil
+	}
+	s.Version++
+	return violations
+}
+
+// handleTreeValidate serves GET /tree/validate: the violations found in this
+// node's tree. It only reports them; repairs happen when the tree changes.
+func handleTreeValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	tree := GetGlobalTree()
+	tree.mu.RLock()
+	violations := tree.validate()
+	result := TreeValidation{
+		Valid:      len(violations) == 0,
+		Violations: violations,
+		Epoch:      tree.Epoch,
+		Version:    tree.Version,
+		Repairs:    treeRepairs.Load(),
+	}
+	tree.mu.RUnlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(result)
+}
+
+// writeTreeValidationMetrics writes the validator's counters in Prometheus text format.
+func writeTreeValidationMetrics(w io.Writer, nodeID int) {
+	fmt.Fprintf(w, "# HELP node_tree_violations_total Spanning tree invariant violations found after a change\n")
+	fmt.Fprintf(w, "# TYPE node_tree_violations_total counter\n")
+	fmt.Fprintf(w, "node_tree_violations_total{node_id=\"%d\"} %d\n", nodeID, treeViolations.Load())
+
+	fmt.Fprintf(w, "# HELP node_tree_repairs_total Invalid spanning trees rebuilt or dropped\n")
+	fmt.Fprintf(w, "# TYPE node_tree_repairs_total counter\n")
+	fmt.Fprintf(w, "node_tree_repairs_total{node_id=\"%d\"} %d\n", nodeID, treeRepairs.Load())
+}
@@ -0,0 +1,189 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Edge health as seen by the node serving /tree.
+const (
+	EdgeOK      = "ok"      // This node's last multicast to the child succeeded
+	EdgeFailing = "failing" // This node's last multicast to the child failed after every retry
+	EdgeDown    = "down"    // The child is not an active member
+	EdgeUnknown = "unknown" // Another node's edge, or one this node has not used yet
+)
+
+// TreeEdge is one parent to child link in a node's view of the tree.
+type TreeEdge struct {
+	Parent    string     `json:"parent"`
+	Child     string     `json:"child"`
+	Health    string     `json:"health"`
+	RTTMillis float64    `json:"rtt_ms,omitempty"`
+	Failures  int        `json:"failures,omitempty"` // Consecutive failed deliveries
+	LastOK    *time.Time `json:"last_ok,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// TreeView is the answer to GET /tree.
+type TreeView struct {
+	Node    string            `json:"node"`
+	Version int               `json:"version"`
+	Epoch   int               `json:"epoch"`
+	Term    int               `json:"epoch_term"` // Leader's term when it published Epoch
+	Fanout  int               `json:"fanout"`
+	Plan    int               `json:"plan,omitempty"`
+	Regions map[string]string `json:"regions,omitempty"`
+	Root    *SerializableNode `json:"root"`
+	Edges   []TreeEdge        `json:"edges"`
+}
+
+// edgeState is the outcome of this node's deliveries to one child.
+type edgeState struct {
+	lastOK    time.Time
+	failures  int
+	lastError string
+}
+
+// edgeTracker remembers how deliveries to each child went, keyed by node ID.
+type edgeTracker struct {
+	mu     sync.Mutex
+	states map[string]edgeState
+}
+
+var edgeHealth = &edgeTracker{states: make(map[string]edgeState)}
+
+// record notes the result of delivering a multicast to child.
+func (t *edgeTracker) record(child string, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	state := t.states[child]
+	if err == nil {
+		state.lastOK = time.Now()
+		state.failures = 0
+		state.lastError = ""
+	} else {
+		state.failures++
+		state.lastError = err.Error()
+	}
+	t.states[child] = state
+}
+
+// get returns the state of the edge to child.
+func (t *edgeTracker) get(child string) (edgeState, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	state, ok := t.states[child]
+	return state, ok
+}
+
+// View returns the tree as nodeID sees it, with the health of every edge.
+// active is the consensus view of which nodes are up.
+func (s *SpanningTree) View(nodeID string, active map[int]bool) TreeView {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	view := TreeView{Node: nodeID, Version: s.Version, Epoch: s.Epoch, Term: s.EpochTerm, Fanout: s.fanout(), Plan: s.Plan, Regions: s.Regions, Edges: []TreeEdge{}}
+	if s.Root == nil {
+		return view
+	}
+	root, _ := s.Root.ToSerializable()
+	view.Root = &root
+
+	measured := links.snapshot()
+	for _, node := range s.nodesBFS() {
+		node.mu.RLock()
+		parent, children := node.ID, append([]*SpanningTreeNode(nil), node.Children...)
+		node.mu.RUnlock()
+
+		for _, child := range children {
+			edge := TreeEdge{Parent: parent, Child: child.ID, Health: EdgeUnknown}
+			id, _ := strconv.Atoi(child.ID)
+			if up, known := active[id]; known && !up {
+				edge.Health = EdgeDown
+			} else if parent == nodeID {
+				if state, ok := edgeHealth.get(child.ID); ok {
+					edge.Failures, edge.LastError = state.failures, state.lastError
+					if !state.lastOK.IsZero() {
+						lastOK := state.lastOK
+						edge.LastOK = &lastOK
+					}
+					edge.Health = EdgeOK
+					if state.failures > 0 {
+						edge.Health = EdgeFailing
+					}
+				}
+				edge.RTTMillis = measured[id].RTTMillis
+			}
+			view.Edges = append(view.Edges, edge)
+		}
+	}
+	return view
+}
+
+// edgeColors maps edge health to its Graphviz style.
+var edgeColors = map[string]string{
+	EdgeOK:      "color=darkgreen",
+	EdgeFailing: "color=red,penwidth=2",
+	EdgeDown:    "color=gray,style=dashed",
+	EdgeUnknown: "color=black",
+}
+
+// writeTreeDOT writes view as a Graphviz digraph.
+func writeTreeDOT(w io.Writer, view TreeView) {
+	fmt.Fprintf(w, "digraph tree {\n")
+	fmt.Fprintf(w, "  label=\"Spanning tree as seen by node %s (epoch %d, version %d)\";\n", view.Node, view.Epoch, view.Version)
+	fmt.Fprintf(w, "  node [shape=circle];\n")
+	if view.Root != nil {
+		fmt.Fprintf(w, "  \"%s\" [shape=doublecircle];\n", view.Root.ID)
+	}
+
+	regions := make([]string, 0, len(view.Regions))
+	for id := range view.Regions {
+		regions = append(regions, id)
+	}
+	sort.Strings(regions)
+	for _, id := range regions {
+		if region := view.Regions[id]; region != "" {
+			fmt.Fprintf(w, "  \"%s\" [xlabel=\"%s\"];\n", id, region)
+		}
+	}
+
+	for _, edge := range view.Edges {
+		label := edge.Health
+		if edge.RTTMillis > 0 {
+			label = fmt.Sprintf("%s %.1fms", edge.Health, edge.RTTMillis)
+		}
+		fmt.Fprintf(w, "  \"%s\" -> \"%s\" [%s,label=\"%s\"];\n", edge.Parent, edge.Child, edgeColors[edge.Health], label)
+	}
+	fmt.Fprintf(w, "}\n")
+}
+
+// handleTree serves this node's view of the spanning tree on GET /tree, as
+// JSON or, with ?format=dot, as Graphviz. It never changes the tree.
+func handleTree(node *Node) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		view := GetGlobalTree().View(strconv.Itoa(node.ID), node.core.Status().Active)
+		switch r.URL.Query().Get("format") {
+		case "", "json":
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(view)
+		case "dot":
+			w.Header().Set("Content-Type", "text/vnd.graphviz")
+			writeTreeDOT(w, view)
+		default:
+			http.Error(w, "Invalid format (use 'json' or 'dot')", http.StatusBadRequest)
+		}
+	}
+}
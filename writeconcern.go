@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Write concerns accepted in QueryRequest.WriteConcern. A non-negative number
+// asks for that many replica acknowledgements.
+const (
+	WriteConcernLocal    = "local"    // Answer once the leader has applied the write (default)
+	WriteConcernMajority = "majority" // Wait until a majority of data-bearing nodes applied it
+	WriteConcernAll      = "all"      // Wait for every live data-bearing replica
+)
+
+// WriteConcern says how many replicas must apply a write before the leader answers.
+type WriteConcern struct {
+	Mode     string // One of the WriteConcern constants, or "" when Replicas is set
+	Replicas int
+}
+
+func (wc WriteConcern) String() string {
+	if wc.Mode == "" {
+		return strconv.Itoa(wc.Replicas)
+	}
+	return wc.Mode
+}
+
+// parseWriteConcern parses a write concern, defaulting to local.
+func parseWriteConcern(value string) (WriteConcern, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "", WriteConcernLocal:
+		return WriteConcern{Mode: WriteConcernLocal}, nil
+	case WriteConcernMajority:
+		return WriteConcern{Mode: WriteConcernMajority}, nil
+	case WriteConcernAll:
+		return WriteConcern{Mode: WriteConcernAll}, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return WriteConcern{}, fmt.Errorf("invalid write concern %q (use 'local', 'majority', 'all' or a replica count)", value)
+	}
+	return WriteConcern{Replicas: n}, nil
+}
+
+// dataReplicas returns the live members other than the leader that store user data.
+func dataReplicas(members map[string]*MemberInfo1, leaderID string) map[string]bool {
+	replicas := make(map[string]bool)
+	for id, member := range members {
+		if id != leaderID && NodeRole(member.Role) != RoleWitness {
+			replicas[id] = true
+		}
+	}
+	return replicas
+}
+
+// requiredAcks returns how many replica acknowledgements satisfy the concern.
+// Majority counts the leader itself, so it needs floor(n/2) of n-1 replicas.
+func (wc WriteConcern) requiredAcks(replicas int) (int, error) {
+	switch wc.Mode {
+	case WriteConcernLocal:
+		return 0, nil
+	case WriteConcernMajority:
+		return (replicas + 1) / 2, nil
+	case WriteConcernAll:
+		return replicas, nil
+	}
+	if wc.Replicas > replicas {
+		return 0, fmt.Errorf("write concern needs %d replicas but only %d are available", wc.Replicas, replicas)
+	}
+	return wc.Replicas, nil
+}
+
+// replicaAcks filters acks down to distinct data-bearing replicas, sorted by ID.
+func replicaAcks(acks []string, replicas map[string]bool) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, id := range acks {
+		if replicas[id] && !seen[id] {
+			seen[id] = true
+			result = append(result, id)
+		}
+	}
+	sort.Strings(result)
+	return result
+}
+
+// ackCollector gathers the replicas that applied a batch as their acks reach
+// the leader: from each of its children's answers, and from the applied
+// reports every replica sends it. A write concern is then met as soon as
+// enough replicas confirmed, without waiting for the rest of the
+// dissemination, which may be retrying a slow or unreachable node.
+type ackCollector struct {
+	position int // Last entry of the batch
+	mu       sync.Mutex
+	acks     []string
+	seen     map[string]bool
+	finished bool
+	err      error
+	changed  chan struct{} // Closed and replaced whenever acks arrive or dissemination finishes
+}
+
+// ackCollectors are the collectors of batches still being disseminated,
+// keyed by the batch's last position.
+var (
+	ackCollectorsMu sync.Mutex
+	ackCollectors   = make(map[int]*ackCollector)
+)
+
+// collectAcks starts collecting acks for the batch ending at position.
+func collectAcks(position int) *ackCollector {
+	c := &ackCollector{position: position, seen: make(map[string]bool), changed: make(chan struct{})}
+	ackCollectorsMu.Lock()
+	ackCollectors[position] = c
+	ackCollectorsMu.Unlock()
+	return c
+}
+
+// add records acks from the given nodes.
+func (c *ackCollector) add(ids []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	added := false
+	for _, id := range ids {
+		if !c.seen[id] {
+			c.seen[id] = true
+			c.acks = append(c.acks, id)
+			added = true
+		}
+	}
+	if added {
+		close(c.changed)
+		c.changed = make(chan struct{})
+	}
+}
+
+// finish records that dissemination returned with err. Acks that arrive
+// later are no longer collected.
+func (c *ackCollector) finish(err error) {
+	ackCollectorsMu.Lock()
+	delete(ackCollectors, c.position)
+	ackCollectorsMu.Unlock()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.finished, c.err = true, err
+	close(c.changed)
+	c.changed = make(chan struct{})
+}
+
+// wait returns the acks once enough holds for them, or once dissemination
+// has finished, with its error. A nil enough waits for dissemination.
+func (c *ackCollector) wait(enough func(acks []string) bool) ([]string, error) {
+	for {
+		c.mu.Lock()
+		acks := append([]string(nil), c.acks...)
+		finished, err, changed := c.finished, c.err, c.changed
+		c.mu.Unlock()
+
+		if finished {
+			return acks, err
+		}
+		if enough != nil && enough(acks) {
+			return acks, nil
+		}
+		<-changed
+	}
+}
+
+// ackApplied passes an applied report to the collector of every batch it
+// covers the end of. Replicas apply in log order, so applying a batch's last
+// position means applying the whole batch.
+func ackApplied(r deliveryReport) {
+	if r.Status != DeliveryApplied {
+		return
+	}
+	ackCollectorsMu.Lock()
+	var covered []*ackCollector
+	for position, c := range ackCollectors {
+		if position <= r.To {
+			covered = append(covered, c)
+		}
+	}
+	ackCollectorsMu.Unlock()
+
+	for _, c := range covered {
+		c.add([]string{r.Node})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+// waitAsync runs c.wait(enough) in the background.
+func waitAsync(c *ackCollector, enough func([]string) bool) <-chan []string {
+	done := make(chan []string, 1)
+	go func() {
+		acks, _ := c.wait(enough)
+		done <- acks
+	}()
+	return done
+}
+
+func TestAckCollectorAnswersOnceEnough(t *testing.T) {
+	c := collectAcks(10)
+	defer c.finish(nil)
+	replicas := map[string]bool{"2": true, "3": true, "4": true, "5": true}
+	done := waitAsync(c, func(acks []string) bool { return len(replicaAcks(acks, replicas)) >= 2 })
+
+	// The leader's own report and a repeated ack do not count
+	c.add([]string{"1", "2"})
+	c.add([]string{"2"})
+	select {
+	case acks := <-done:
+		t.Fatalf("answered with %v before a second replica acked", acks)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	// An applied report from deep in the tree arrives before the tree answers
+	deliveries.record(deliveryReport{Node: "5", From: 9, To: 11, Status: DeliveryApplied, At: time.Now()})
+	select {
+	case acks := <-done:
+		if got := replicaAcks(acks, replicas); !equal(got, []string{"2", "5"}) {
+			t.Fatalf("answered with %v, want [2 5]", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("still waiting after two replicas acked")
+	}
+}
+
+func TestAckCollectorIgnoresEarlierPositions(t *testing.T) {
+	c := collectAcks(20)
+	deliveries.record(deliveryReport{Node: "3", From: 15, To: 19, Status: DeliveryApplied, At: time.Now()})
+	deliveries.record(deliveryReport{Node: "4", From: 20, To: 20, Status: DeliveryFailed, At: time.Now()})
+	c.finish(nil)
+
+	if acks, _ := c.wait(nil); len(acks) != 0 {
+		t.Fatalf("collected %v from reports that do not cover the batch", acks)
+	}
+}
+
+func TestAckCollectorFinish(t *testing.T) {
+	c := collectAcks(30)
+	done := waitAsync(c, nil)
+	c.add([]string{"2"})
+	select {
+	case acks := <-done:
+		t.Fatalf("answered with %v before dissemination finished", acks)
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	failed := errors.New("multicast failed to all 2 children")
+	c.finish(failed)
+	if acks := <-done; !equal(acks, []string{"2"}) {
+		t.Fatalf("answered with %v, want [2]", acks)
+	}
+	if _, err := c.wait(func([]string) bool { return false }); err != failed {
+		t.Fatalf("wait after finishing returned %v, want the multicast's error", err)
+	}
+
+	// Reports after the end are not collected
+	deliveries.record(deliveryReport{Node: "3", From: 30, To: 30, Status: DeliveryApplied, At: time.Now()})
+	if acks, _ := c.wait(nil); !equal(acks, []string{"2"}) {
+		t.Fatalf("collected %v after finishing", acks)
+	}
+}